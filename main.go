@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 
 	_ "github.com/mattn/go-sqlite3"
@@ -35,28 +40,31 @@ func createOrOpenSQLiteDB(sqlFilePath string) (*sql.DB, error) {
 	return db, nil
 }
 
-// createTable creates a table in the SQLite database to store your data.
-func createTable(db *sql.DB) error {
-	createTableSQL := `
-    CREATE TABLE IF NOT EXISTS friends (
-		id INTEGER PRIMARY KEY AUTOINCREMENT,
-		name TEXT NOT NULL,
-		lastContacted TEXT NOT NULL,
-		birthday TEXT NOT NULL,
-		notes TEXT NOT NULL
-    );`
-
-	_, err := db.Exec(createTableSQL)
+// The bearer token the scheduled jobs call the API with, so they can use the admin endpoints
+var schedulerToken string
+
+// callScheduledEndpoint calls one of the app's own endpoints on behalf of the scheduler.
+// Changes made by these calls are recorded against the scheduler in the audit log because of the token they're sent with
+func callScheduledEndpoint(method string, path string) (*http.Response, error) {
+	req, err := http.NewRequest(method, "http://localhost:8080"+path, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return nil
+	token := schedulerToken
+	if token == "" {
+		token = os.Getenv("ADMIN_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return http.DefaultClient.Do(req)
 }
 
 // CheckBirthdaysToday is used daily
 func CheckBirthdaysToday() {
-	resp, err := http.Get("http://localhost:8080/birthdays")
+	resp, err := callScheduledEndpoint("GET", "/api/v1/birthdays")
 	if err != nil {
 		logger.LogMessage(logger.LogLevelError, "Error calling GetRandomFriend: %v", err)
 		return
@@ -66,8 +74,7 @@ func CheckBirthdaysToday() {
 
 // GetRandomFriendScheduled is used for scheduled calls, without a Gin context
 func GetRandomFriendScheduled() {
-	// Example of making an HTTP request to the endpoint
-	resp, err := http.Get("http://localhost:8080/friends/random")
+	resp, err := callScheduledEndpoint("GET", "/api/v1/friends/random")
 	if err != nil {
 		logger.LogMessage(logger.LogLevelError, "Error calling GetRandomFriend: %v", err)
 		return
@@ -75,6 +82,83 @@ func GetRandomFriendScheduled() {
 	defer resp.Body.Close()
 }
 
+// GetRandomTaggedFriendScheduled is used for scheduled calls that pick from friends with the tag, without a Gin context
+func GetRandomTaggedFriendScheduled(tag string) {
+	resp, err := callScheduledEndpoint("GET", "/api/v1/friends/random?tag="+url.QueryEscape(tag))
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Error calling GetRandomFriend for tag %s: %v", tag, err)
+		return
+	}
+	defer resp.Body.Close()
+}
+
+// PurgeTrashScheduled is used to empty old friends out of the trash, without a Gin context
+func PurgeTrashScheduled() {
+	resp, err := callScheduledEndpoint("POST", "/api/v1/admin/trash/purge")
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Error calling PurgeTrash: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+}
+
+// RunScheduledBackup is used for scheduled backups, without a Gin context
+func RunScheduledBackup() {
+	resp, err := callScheduledEndpoint("POST", "/api/v1/admin/backup")
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Error calling PostBackup: %v", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		logger.LogMessage(logger.LogLevelError, "Scheduled backup failed. Status: %s", resp.Status)
+	}
+}
+
+// runCommand handles the commands that can be run instead of starting the webserver.
+// The webserver should be stopped while these run
+func runCommand(dbFilePath string, args []string) error {
+	switch args[0] {
+	case "restore":
+		// ./howarethey restore sql/backups/friends-20240101-080000.db
+		if len(args) != 2 {
+			return errors.New("usage: howarethey restore <backup file>")
+		}
+
+		db, err := createOrOpenSQLiteDB(dbFilePath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		return models.RestoreDB(db, args[1])
+	case "rotate-key":
+		// Re-encrypts every friend with NEW_ENCRYPTION_KEY. ENCRYPTION_KEY must be the key the data is currently encrypted with,
+		// or blank if it isn't encrypted yet. Leave NEW_ENCRYPTION_KEY blank to decrypt everything
+		oldKey, err := models.LoadEncryptionKey("ENCRYPTION_KEY")
+		if err != nil {
+			return err
+		}
+
+		newKey, err := models.LoadEncryptionKey("NEW_ENCRYPTION_KEY")
+		if err != nil {
+			return err
+		}
+
+		db, err := createOrOpenSQLiteDB(dbFilePath)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+
+		_, err = models.RotateEncryptionKey(db, oldKey, newKey)
+		return err
+	default:
+		return fmt.Errorf("unknown command %s", args[0])
+	}
+}
+
 func main() {
 
 	var (
@@ -87,8 +171,31 @@ func main() {
 	// Sets up the logger
 	logger.SetupLogger()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(dbFilePath, os.Args[1:]); err != nil {
+			logger.LogMessage(logger.LogLevelFatal, "Command failed: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger.LogMessage(logger.LogLevelInfo, "Starting app")
 
+	// Encrypt sensitive fields if a key has been provided
+	encryptionKey, err := models.LoadEncryptionKey("ENCRYPTION_KEY")
+	if err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "Failed to load encryption key: %v", err)
+		panic(err)
+	}
+
+	if encryptionKey != nil {
+		if err := models.SetEncryptionKey(encryptionKey); err != nil {
+			logger.LogMessage(logger.LogLevelFatal, "Failed to set encryption key: %v", err)
+			panic(err)
+		}
+		logger.LogMessage(logger.LogLevelInfo, "Encrypting notes at rest")
+	}
+
 	// Open the database connection
 	db, err := createOrOpenSQLiteDB(dbFilePath)
 	if err != nil {
@@ -100,11 +207,31 @@ func main() {
 	logger.LogMessage(logger.LogLevelInfo, "Database opened")
 
 	// Create the table
-	if err := createTable(db); err != nil {
+	if err := models.CreateTables(db); err != nil {
 		logger.LogMessage(logger.LogLevelFatal, "Failed to create table: %v", err)
 		panic(err)
 	}
 
+	// Catch mistakes in a custom notification template before any friends get picked
+	if err := models.ValidateReminderTemplate(os.Getenv("NOTIFICATION_TEMPLATE")); err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "NOTIFICATION_TEMPLATE is not a valid template: %v", err)
+		panic(err)
+	}
+
+	// Sync the friends from the seed file into the db if one is provided
+	if seedFilePath := os.Getenv("SEED_FILE"); seedFilePath != "" {
+		seed, err := models.LoadSeedFile(seedFilePath)
+		if err != nil {
+			logger.LogMessage(logger.LogLevelFatal, "Failed to load seed file: %v", err)
+			panic(err)
+		}
+
+		if _, err := models.SyncSeed(db, seed, os.Getenv("SEED_FILE_PRUNE") == "true"); err != nil {
+			logger.LogMessage(logger.LogLevelFatal, "Failed to sync seed file: %v", err)
+			panic(err)
+		}
+	}
+
 	friendsList, err := models.BuildFriendsList(db)
 	if err != nil {
 		logger.LogMessage(logger.LogLevelFatal, "Failed to build slice: %v", err)
@@ -112,6 +239,10 @@ func main() {
 	}
 
 	friendsHandler := handler.NewFriendsHandler(friendsList, db)
+	schedulerToken = friendsHandler.SchedulerToken
+
+	// Send events to the webhooks registered with POST /webhooks
+	friendsHandler.DeliverWebhooks(context.Background())
 
 	router := handler.SetupRouter(friendsHandler)
 
@@ -134,6 +265,26 @@ func main() {
 		panic(err)
 	}
 
+	// Pick friends with particular tags on their own schedules, i.e. family every week and work friends every month
+	tagSchedules, err := models.ParseTagSchedules(os.Getenv("TAG_SCHEDULES"))
+	if err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "error: %v", err)
+		panic(err)
+	}
+
+	for _, tagSchedule := range tagSchedules {
+		tag := tagSchedule.Tag
+		logger.LogMessage(logger.LogLevelInfo, "Picking friends tagged %s on the schedule: %s", tag, tagSchedule.Schedule)
+
+		_, err = c.AddFunc(tagSchedule.Schedule, func() {
+			GetRandomTaggedFriendScheduled(tag)
+		})
+		if err != nil {
+			logger.LogMessage(logger.LogLevelFatal, "error: %v", err)
+			panic(err)
+		}
+	}
+
 	if os.Getenv("IGNORE_BIRTHDAYS") != "true" {
 		// Get the time of day to check if today is anyones birthday. Defaults to 8am.
 		// Must be between 0-23
@@ -155,6 +306,33 @@ func main() {
 		}
 	}
 
+	// Purge friends that have been in the trash longer than TRASH_RETENTION_DAYS. Defaults to 4am every day
+	trash_purge_schedule := os.Getenv("TRASH_PURGE_CRON_SCHEDULE")
+	if trash_purge_schedule == "" {
+		trash_purge_schedule = "0 4 * * *"
+	}
+
+	_, err = c.AddFunc(trash_purge_schedule, func() {
+		PurgeTrashScheduled()
+	})
+	if err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "error: %v", err)
+		panic(err)
+	}
+
+	// Take a backup of the database on the schedule provided. Backups are turned off by default
+	if backup_schedule := os.Getenv("BACKUP_CRON_SCHEDULE"); backup_schedule != "" {
+		logger.LogMessage(logger.LogLevelInfo, "Backing up the database on the schedule: %s", backup_schedule)
+
+		_, err = c.AddFunc(backup_schedule, func() {
+			RunScheduledBackup()
+		})
+		if err != nil {
+			logger.LogMessage(logger.LogLevelFatal, "error: %v", err)
+			panic(err)
+		}
+	}
+
 	// Start the cron scheduler
 	c.Start()
 
@@ -175,6 +353,23 @@ func main() {
 		logger.LogMessage(logger.LogLevelInfo, "Sending notifications to "+notification_type)
 	}
 
+	// Serve the gRPC API beside the webserver, if a port has been set for it
+	if grpc_port := os.Getenv("GRPC_PORT"); grpc_port != "" {
+		grpcListener, err := net.Listen("tcp", ":"+grpc_port)
+		if err != nil {
+			logger.LogMessage(logger.LogLevelFatal, "Failed to listen for gRPC: %v", err)
+			panic(err)
+		}
+
+		grpcServer := handler.NewGRPCServer(friendsHandler)
+		go func() {
+			logger.LogMessage(logger.LogLevelInfo, "Starting gRPC server on port %s", grpc_port)
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				logger.LogMessage(logger.LogLevelFatal, "gRPC server stopped: %v", err)
+			}
+		}()
+	}
+
 	logger.LogMessage(logger.LogLevelInfo, "Starting webserver")
 
 	err = router.Run()
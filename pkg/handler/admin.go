@@ -0,0 +1,195 @@
+package handler
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/logger"
+	"howarethey/pkg/models"
+)
+
+const (
+	defaultBackupDir       = "sql/backups"
+	defaultBackupRetention = 7
+)
+
+// Where backups are written to. Set with BACKUP_DIR
+func backupDir() string {
+	if dir := os.Getenv("BACKUP_DIR"); dir != "" {
+		return dir
+	}
+	return defaultBackupDir
+}
+
+// How many backups to keep. Set with BACKUP_RETENTION
+func backupRetention() int {
+	retention, err := strconv.Atoi(os.Getenv("BACKUP_RETENTION"))
+	if err != nil || retention < 1 {
+		return defaultBackupRetention
+	}
+	return retention
+}
+
+var (
+	errAdminDisabled      = errors.New("admin endpoints are turned off until ADMIN_TOKEN is set")
+	errAdminTokenRequired = errors.New("admin token required")
+)
+
+// Checks the authorization, from the Authorization header or gRPC metadata, is ADMIN_TOKEN or the handler's SchedulerToken
+// as a bearer token. Returns errAdminDisabled if ADMIN_TOKEN isn't set, or errAdminTokenRequired if the token is missing or wrong
+func (h *FriendsHandler) checkAdminToken(authorization string) error {
+	if h.SchedulerToken != "" && isBearerToken(authorization, h.SchedulerToken) {
+		return nil
+	}
+
+	token := os.Getenv("ADMIN_TOKEN")
+	if token == "" {
+		return errAdminDisabled
+	}
+	if !isBearerToken(authorization, token) {
+		return errAdminTokenRequired
+	}
+	return nil
+}
+
+// RequireAdminToken protects the admin endpoints. Requests must send ADMIN_TOKEN as a bearer token in the Authorization header,
+// apart from the app's own scheduled jobs which send the handler's SchedulerToken instead.
+// The endpoints are turned off until ADMIN_TOKEN is set, so a backup can't be downloaded or restored by just anyone
+func (h *FriendsHandler) RequireAdminToken() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := h.checkAdminToken(c.GetHeader("Authorization"))
+		if errors.Is(err, errAdminDisabled) {
+			respondError(c, http.StatusServiceUnavailable, err)
+			return
+		}
+		if err != nil {
+			respondError(c, http.StatusUnauthorized, err)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Makes up a random token for the scheduled jobs. If one can't be made the jobs that call admin endpoints need ADMIN_TOKEN instead
+func newSchedulerToken() string {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to make a token for the scheduler: %v", err)
+		return ""
+	}
+	return hex.EncodeToString(token)
+}
+
+// Checks the authorization is the bearer token given, in constant time
+func isBearerToken(authorization string, token string) bool {
+	return subtle.ConstantTimeCompare([]byte(authorization), []byte("Bearer "+token)) == 1
+}
+
+// POST /admin/backup
+// Takes a hot backup of the database and deletes any backups past the retention limit
+func (h *FriendsHandler) PostBackup(c *gin.Context) {
+	backup, err := models.BackupDB(h.DB, backupDir())
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to back up the database: %v", err)
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if _, err := models.PruneBackups(backupDir(), backupRetention()); err != nil {
+		logger.LogMessage(logger.LogLevelWarn, "Failed to delete old backups: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, backup)
+}
+
+// GET /admin/backups
+func (h *FriendsHandler) GetBackups(c *gin.Context) {
+	backups, err := models.ListBackups(backupDir())
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, backups)
+}
+
+// GET /admin/backups/:name
+// Downloads the backup file
+func (h *FriendsHandler) GetBackup(c *gin.Context) {
+	name := c.Param("name")
+	if !models.IsBackupName(name) {
+		respondError(c, http.StatusBadRequest, errors.New("invalid backup name"))
+		return
+	}
+
+	path := filepath.Join(backupDir(), name)
+	if _, err := os.Stat(path); err != nil {
+		respondError(c, http.StatusNotFound, errors.New("backup not found"))
+		return
+	}
+
+	c.FileAttachment(path, name)
+}
+
+// POST /admin/restore
+// Restores the database from a backup in the backup directory, i.e. {"Name": "friends-20240101-080000.db"},
+// or from a database file uploaded as the "file" field of a multipart form.
+// The backup is validated before anything is overwritten
+func (h *FriendsHandler) PostRestore(c *gin.Context) {
+	var path string
+
+	if upload, err := c.FormFile("file"); err == nil {
+		tmpFile, err := os.CreateTemp("", "howarethey-restore-*.db")
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		tmpFile.Close()
+		defer os.Remove(tmpFile.Name())
+
+		if err := c.SaveUploadedFile(upload, tmpFile.Name()); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		path = tmpFile.Name()
+	} else {
+		var request struct {
+			Name string
+		}
+		if err := c.ShouldBindJSON(&request); err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if !models.IsBackupName(request.Name) {
+			respondError(c, http.StatusBadRequest, errors.New("invalid backup name"))
+			return
+		}
+		path = filepath.Join(backupDir(), request.Name)
+	}
+
+	if err := models.ValidateBackup(path); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	if err := models.RestoreDB(h.DB, path); err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to restore the database: %v", err)
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.refreshFriendsList(requestActor(c)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "database restored successfully", "count": len(h.FriendsList)})
+}
@@ -0,0 +1,93 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+const defaultAuditLimit = 100
+
+// Set on every request to who made it, for the audit log
+const actorKey = "actor"
+
+// Works out who made each request for the audit log, from how it was authenticated so nobody can make changes in someone else's name.
+// The app's own scheduled jobs are recorded as "scheduler", and other requests with a bearer token against a fingerprint of the token,
+// never the token itself
+func (h *FriendsHandler) identifyActor() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(actorKey, h.actorForAuthorization(c.GetHeader("Authorization"), "api"))
+		c.Next()
+	}
+}
+
+// Returns who made the request, as worked out by identifyActor
+func requestActor(c *gin.Context) string {
+	if actor := c.GetString(actorKey); actor != "" {
+		return actor
+	}
+	return "api"
+}
+
+// Works out the actor from the Authorization header, or returns fallback if there's no bearer token
+func (h *FriendsHandler) actorForAuthorization(authorization string, fallback string) string {
+	token := strings.TrimPrefix(authorization, "Bearer ")
+	if token == "" || token == authorization {
+		return fallback
+	}
+
+	if h.SchedulerToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(h.SchedulerToken)) == 1 {
+		return models.ActorScheduler
+	}
+
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:])[:12]
+}
+
+// Returns the db tagged with the actor making the request so changes are recorded in the audit log
+func (h *FriendsHandler) actorDB(c *gin.Context) models.DBTX {
+	return models.WithActor(h.DB, requestActor(c))
+}
+
+// GET /friends/:id/history
+func (h *FriendsHandler) GetFriendHistory(c *gin.Context) {
+	h.getAuditLog(c, h.resolveFriendID(c.Param("id")))
+}
+
+// GET /audit?friendId=&actor=&action=&limit=
+func (h *FriendsHandler) GetAuditLog(c *gin.Context) {
+	h.getAuditLog(c, c.Query("friendId"))
+}
+
+func (h *FriendsHandler) getAuditLog(c *gin.Context, friendID string) {
+	limit := defaultAuditLimit
+	if limitParam := c.Query("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 {
+			respondError(c, http.StatusBadRequest, errors.New("limit must be a positive number"))
+			return
+		}
+	}
+
+	entries, err := models.GetAuditLog(h.DB, models.AuditFilter{
+		FriendID: friendID,
+		Actor:    c.Query("actor"),
+		Action:   c.Query("action"),
+		Limit:    limit,
+	})
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, entries)
+}
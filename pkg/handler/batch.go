@@ -0,0 +1,38 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// POST /friends/batch
+// Creates, updates and deletes friends in one transaction and returns what happened to each operation.
+// In the default atomic mode nothing is saved if any operation fails, and the response is a 422
+func (h *FriendsHandler) PostBatch(c *gin.Context) {
+	var batch models.Batch
+	if err := c.ShouldBindJSON(&batch); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	report, err := models.RunBatch(h.DB, requestActor(c), batch)
+	if err != nil {
+		respondError(c, statusForError(err), err)
+		return
+	}
+
+	if !report.Committed {
+		c.JSON(http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	if err := h.refreshFriendsList(requestActor(c)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
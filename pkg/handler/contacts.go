@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// GET /friends/:id/contacts
+func (h *FriendsHandler) GetContactMethods(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	methods, err := models.ListContactMethods(h.DB, friend.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, methods)
+}
+
+// POST /friends/:id/contacts
+func (h *FriendsHandler) PostContactMethod(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	var method models.ContactMethod
+	if err := c.ShouldBindJSON(&method); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := models.ValidateContactMethod(method); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	method, err = models.AddContactMethod(h.DB, friend.ID, method)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, method)
+}
+
+// PUT /friends/:id/contacts/:contactId
+// Replaces the contact method with the one in the request
+func (h *FriendsHandler) PutContactMethod(c *gin.Context) {
+	friend, contactID, ok := h.contactMethodParams(c)
+	if !ok {
+		return
+	}
+
+	var method models.ContactMethod
+	if err := c.ShouldBindJSON(&method); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := models.ValidateContactMethod(method); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	method, err := models.UpdateContactMethod(h.DB, friend.ID, contactID, method)
+	if errors.Is(err, models.ErrContactMethodNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, method)
+}
+
+// DELETE /friends/:id/contacts/:contactId
+func (h *FriendsHandler) DeleteContactMethod(c *gin.Context) {
+	friend, contactID, ok := h.contactMethodParams(c)
+	if !ok {
+		return
+	}
+
+	err := models.DeleteContactMethod(h.DB, friend.ID, contactID)
+	if errors.Is(err, models.ErrContactMethodNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Contact method deleted successfully"})
+}
+
+// Looks up the friend and contact method ID from the path. Responds with an error and returns false if either is invalid
+func (h *FriendsHandler) contactMethodParams(c *gin.Context) (*models.Friend, int64, bool) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return nil, 0, false
+	}
+
+	contactID, err := strconv.ParseInt(c.Param("contactId"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errors.New("contact method ID must be a number"))
+		return nil, 0, false
+	}
+
+	return friend, contactID, true
+}
@@ -0,0 +1,110 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// Set on requests to the unversioned routes, which still send errors as {"error": "message"}
+const legacyRouteKey = "legacyRoute"
+
+// ErrorResponse is the body /api/v1 sends back when a request fails
+type ErrorResponse struct {
+	Error APIError `json:"error"`
+}
+
+// APIError describes what went wrong. Code is a short, stable name for the status, i.e. not_found,
+// and Details says which fields were invalid when the request failed validation
+type APIError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Details []FieldError `json:"details,omitempty"`
+}
+
+// FieldError is a problem with one field of the request
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+var errorCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusNotFound:              "not_found",
+	http.StatusConflict:              "conflict",
+	http.StatusPreconditionFailed:    "precondition_failed",
+	http.StatusRequestEntityTooLarge: "payload_too_large",
+	http.StatusUnsupportedMediaType:  "unsupported_media_type",
+	http.StatusUnprocessableEntity:   "validation_failed",
+	http.StatusInternalServerError:   "internal_error",
+}
+
+// Stops the request and sends the error back.
+// Use 400 when the request can't be understood, 422 when it can but the values in it aren't valid,
+// 404 when what it refers to doesn't exist, 409 when it clashes with something that already exists
+// and 412 when it was based on an old version of the friend
+func respondError(c *gin.Context, status int, err error) {
+	if c.GetBool(legacyRouteKey) {
+		c.AbortWithStatusJSON(status, gin.H{"error": err.Error()})
+		return
+	}
+
+	code, ok := errorCodes[status]
+	if !ok {
+		code = strings.ReplaceAll(strings.ToLower(http.StatusText(status)), " ", "_")
+	}
+
+	apiError := APIError{Code: code, Message: err.Error()}
+	var validationErr *models.ValidationError
+	if errors.As(err, &validationErr) {
+		apiError.Details = []FieldError{{Field: validationErr.Field, Message: validationErr.Message}}
+	}
+
+	c.AbortWithStatusJSON(status, ErrorResponse{Error: apiError})
+}
+
+// Picks 422 for validation errors, 409 when the slug is taken, 412 when the friend has changed since the version
+// the request was based on and 500 for anything else
+func statusForError(err error) int {
+	var validationErr *models.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, models.ErrSlugTaken):
+		return http.StatusConflict
+	case errors.Is(err, models.ErrVersionMismatch):
+		return http.StatusPreconditionFailed
+	}
+	return http.StatusInternalServerError
+}
+
+// Marks requests to the unversioned routes as deprecated and points clients at the /api/v1 equivalent
+func deprecatedRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(legacyRouteKey, true)
+		c.Header("Deprecation", "true")
+		c.Header("Link", "<"+apiV1Prefix+c.Request.URL.Path+`>; rel="successor-version"`)
+		c.Next()
+	}
+}
+
+// The prefix of the version of the API the request was made to, so links in the response point at the same version
+func routePrefix(c *gin.Context) string {
+	if c.GetBool(legacyRouteKey) {
+		return ""
+	}
+	return apiV1Prefix
+}
+
+// Sends a 404 for routes that don't exist, in the error format for the version of the API asked for
+func routeNotFound(c *gin.Context) {
+	if !strings.HasPrefix(c.Request.URL.Path, apiV1Prefix+"/") {
+		c.Set(legacyRouteKey, true)
+	}
+	respondError(c, http.StatusNotFound, errors.New("no route matches "+c.Request.Method+" "+c.Request.URL.Path))
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/net/websocket"
+
+	"howarethey/pkg/logger"
+	"howarethey/pkg/models"
+)
+
+const defaultEventHistorySize = 1000
+
+// How often a comment is sent down idle event streams so proxies don't close them
+const eventKeepAliveInterval = 30 * time.Second
+
+// How many recent events are kept for subscribers that reconnect with Last-Event-ID. Set with EVENT_HISTORY_SIZE
+func eventHistorySize() int {
+	size, err := strconv.Atoi(os.Getenv("EVENT_HISTORY_SIZE"))
+	if err != nil || size < 1 {
+		return defaultEventHistorySize
+	}
+	return size
+}
+
+// Rebuilds the cached friends list after a change, updates the search index and publishes an event for every friend that was added,
+// changed or removed
+func (h *FriendsHandler) refreshFriendsList(actor string) error {
+	friendsList, err := models.BuildFriendsList(h.DB)
+	if err != nil {
+		return err
+	}
+
+	previous := h.FriendsList
+	h.FriendsList = friendsList
+
+	if err := h.SearchIndex.Sync(friendsList); err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to update the search index: %v", err)
+	}
+
+	for _, event := range models.FriendsListEvents(previous, friendsList) {
+		h.publishEvent(actor, event.Type, event.Friend)
+	}
+	return nil
+}
+
+// Publishes an event about the friend against the actor that made the change
+func (h *FriendsHandler) publishEvent(actor string, eventType string, friend models.Friend) {
+	h.Events.Publish(models.Event{Type: eventType, Actor: actor, Friend: friend})
+}
+
+// GET /events?type=
+// Streams events as they happen, as Server-Sent Events or over a WebSocket if the request asks to upgrade.
+// Send the ID of the last event received in Last-Event-ID, or lastEventId for WebSockets, to get the events missed since
+func (h *FriendsHandler) GetEvents(c *gin.Context) {
+	if h.Events == nil {
+		respondError(c, http.StatusServiceUnavailable, errors.New("events aren't available"))
+		return
+	}
+
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("lastEventId")
+	}
+	var since int64
+	if lastEventID != "" {
+		var err error
+		since, err = strconv.ParseInt(lastEventID, 10, 64)
+		if err != nil || since < 0 {
+			respondError(c, http.StatusBadRequest, errors.New("Last-Event-ID must be the ID of an event"))
+			return
+		}
+	}
+
+	types := make(map[string]bool)
+	for _, eventType := range c.QueryArray("type") {
+		if !models.IsEventType(eventType) {
+			respondError(c, http.StatusBadRequest, errors.New("type must be one of "+strings.Join(models.EventTypes, ", ")))
+			return
+		}
+		types[eventType] = true
+	}
+	wanted := func(event models.Event) bool {
+		return len(types) == 0 || types[event.Type]
+	}
+
+	missed, events, unsubscribe := h.Events.Subscribe(since)
+	defer unsubscribe()
+
+	if strings.EqualFold(c.GetHeader("Upgrade"), "websocket") {
+		streamWebSocket(c, missed, events, wanted)
+		return
+	}
+	streamServerSentEvents(c, missed, events, wanted)
+}
+
+// Sends the events as Server-Sent Events until the client goes away or falls too far behind
+func streamServerSentEvents(c *gin.Context, missed []models.Event, events <-chan models.Event, wanted func(models.Event) bool) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Stops nginx from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+
+	send := func(event models.Event) bool {
+		if !wanted(event) {
+			return true
+		}
+		if err := writeServerSentEvent(c.Writer, event); err != nil {
+			logger.LogMessage(logger.LogLevelDebug, "Event stream closed: %v", err)
+			return false
+		}
+		c.Writer.Flush()
+		return true
+	}
+
+	for _, event := range missed {
+		if !send(event) {
+			return
+		}
+	}
+
+	keepAlive := time.NewTicker(eventKeepAliveInterval)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case event, ok := <-events:
+			// Subscribers that fall behind are dropped and can reconnect with Last-Event-ID to catch up
+			if !ok || !send(event) {
+				return
+			}
+		case <-keepAlive.C:
+			if _, err := io.WriteString(c.Writer, ": keep-alive\n\n"); err != nil {
+				return
+			}
+			c.Writer.Flush()
+		}
+	}
+}
+
+func writeServerSentEvent(w io.Writer, event models.Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+// Sends the events as JSON messages over a WebSocket until the client closes it or falls too far behind
+func streamWebSocket(c *gin.Context, missed []models.Event, events <-chan models.Event, wanted func(models.Event) bool) {
+	// A Server with no Handshake accepts connections from any origin, the same as the CORS config
+	server := websocket.Server{Handler: func(conn *websocket.Conn) {
+		defer conn.Close()
+
+		// Nothing is read from the client, but reading notices when they close the connection
+		closed := make(chan struct{})
+		go func() {
+			_, _ = io.Copy(io.Discard, conn)
+			close(closed)
+		}()
+
+		send := func(event models.Event) bool {
+			if !wanted(event) {
+				return true
+			}
+			if err := websocket.JSON.Send(conn, event); err != nil {
+				logger.LogMessage(logger.LogLevelDebug, "Event WebSocket closed: %v", err)
+				return false
+			}
+			return true
+		}
+
+		for _, event := range missed {
+			if !send(event) {
+				return
+			}
+		}
+
+		for {
+			select {
+			case <-closed:
+				return
+			case event, ok := <-events:
+				if !ok || !send(event) {
+					return
+				}
+			}
+		}
+	}}
+
+	server.ServeHTTP(c.Writer, c.Request)
+}
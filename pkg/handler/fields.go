@@ -0,0 +1,70 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// GET /fields
+func (h *FriendsHandler) GetCustomFields(c *gin.Context) {
+	fields, err := models.ListCustomFields(h.DB)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, fields)
+}
+
+// POST /fields
+// Declares a custom field that can then be set on any friend
+func (h *FriendsHandler) PostCustomField(c *gin.Context) {
+	var field models.CustomField
+	if err := c.ShouldBindJSON(&field); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := models.ValidateCustomField(field); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	err := models.AddCustomField(h.DB, field)
+	if errors.Is(err, models.ErrCustomFieldExists) {
+		respondError(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, field)
+}
+
+// DELETE /fields/:name
+// Removes the custom field and the value every friend had for it
+func (h *FriendsHandler) DeleteCustomField(c *gin.Context) {
+	name := c.Param("name")
+
+	err := models.DeleteCustomField(h.DB, name)
+	if errors.Is(err, models.ErrCustomFieldNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.refreshFriendsList(requestActor(c)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": name + " deleted successfully"})
+}
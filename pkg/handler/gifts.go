@@ -0,0 +1,129 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// GET /friends/:id/gifts
+func (h *FriendsHandler) GetGiftIdeas(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	gifts, err := models.ListGiftIdeas(h.DB, friend.ID)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gifts)
+}
+
+// POST /friends/:id/gifts
+func (h *FriendsHandler) PostGiftIdea(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	var gift models.GiftIdea
+	if err := c.ShouldBindJSON(&gift); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := models.ValidateGiftIdea(gift); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	gift, err = models.AddGiftIdea(h.DB, friend.ID, gift)
+	if errors.Is(err, models.ErrGiftAlreadyGiven) {
+		respondError(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, gift)
+}
+
+// PUT /friends/:id/gifts/:giftId
+// Replaces the gift idea with the one in the request, i.e. to mark it as bought or given
+func (h *FriendsHandler) PutGiftIdea(c *gin.Context) {
+	friend, giftID, ok := h.giftIdeaParams(c)
+	if !ok {
+		return
+	}
+
+	var gift models.GiftIdea
+	if err := c.ShouldBindJSON(&gift); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if _, err := models.ValidateGiftIdea(gift); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	gift, err := models.UpdateGiftIdea(h.DB, friend.ID, giftID, gift)
+	if errors.Is(err, models.ErrGiftIdeaNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if errors.Is(err, models.ErrGiftAlreadyGiven) {
+		respondError(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gift)
+}
+
+// DELETE /friends/:id/gifts/:giftId
+func (h *FriendsHandler) DeleteGiftIdea(c *gin.Context) {
+	friend, giftID, ok := h.giftIdeaParams(c)
+	if !ok {
+		return
+	}
+
+	err := models.DeleteGiftIdea(h.DB, friend.ID, giftID)
+	if errors.Is(err, models.ErrGiftIdeaNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Gift idea deleted successfully"})
+}
+
+// Looks up the friend and gift idea ID from the path. Responds with an error and returns false if either is invalid
+func (h *FriendsHandler) giftIdeaParams(c *gin.Context) (*models.Friend, int64, bool) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return nil, 0, false
+	}
+
+	giftID, err := strconv.ParseInt(c.Param("giftId"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errors.New("gift idea ID must be a number"))
+		return nil, 0, false
+	}
+
+	return friend, giftID, true
+}
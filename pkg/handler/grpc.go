@@ -0,0 +1,260 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	"howarethey/pkg/models"
+	"howarethey/pkg/pb"
+)
+
+// Changes made over gRPC without a bearer token are recorded against this actor
+const grpcActor = "grpc"
+
+// friendsServer serves FriendsService from the same friends list and database as the REST routes
+type friendsServer struct {
+	pb.UnimplementedFriendsServiceServer
+	handler *FriendsHandler
+}
+
+// Creates a gRPC server for the friends service, with reflection so tools like grpcurl can list the methods,
+// and the standard health service. Calls to the friends service need the admin token, the same as the admin endpoints
+func NewGRPCServer(handler *FriendsHandler) *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(handler.authorizeCall))
+	pb.RegisterFriendsServiceServer(server, &friendsServer{handler: handler})
+	reflection.Register(server)
+
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", grpc_health_v1.HealthCheckResponse_SERVING)
+	healthServer.SetServingStatus(pb.FriendsService_ServiceDesc.ServiceName, grpc_health_v1.HealthCheckResponse_SERVING)
+	grpc_health_v1.RegisterHealthServer(server, healthServer)
+
+	return server
+}
+
+// Gets the authorization metadata sent with the call, i.e. "Bearer <token>"
+func callAuthorization(ctx context.Context) string {
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get("authorization"); len(values) > 0 {
+			return values[0]
+		}
+	}
+	return ""
+}
+
+// Checks calls to the friends service have the admin token in their authorization metadata, the same way as RequireAdminToken.
+// Health checks are let through so they work without it
+func (h *FriendsHandler) authorizeCall(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, next grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, "/"+pb.FriendsService_ServiceDesc.ServiceName+"/") {
+		return next(ctx, req)
+	}
+
+	err := h.checkAdminToken(callAuthorization(ctx))
+	if errors.Is(err, errAdminDisabled) {
+		return nil, status.Error(codes.Unavailable, "the gRPC API is turned off until ADMIN_TOKEN is set")
+	}
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return next(ctx, req)
+}
+
+// Works out who made the call from the authorization metadata, the same way as identifyActor
+func (s *friendsServer) callActor(ctx context.Context) string {
+	return s.handler.actorForAuthorization(callAuthorization(ctx), grpcActor)
+}
+
+// Turns an error from the service layer into a gRPC status, the same way statusForError picks an HTTP status
+func grpcError(err error) error {
+	var validationErr *models.ValidationError
+	switch {
+	case errors.As(err, &validationErr):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, models.ErrSlugTaken):
+		return status.Error(codes.AlreadyExists, err.Error())
+	case errors.Is(err, models.ErrVersionMismatch):
+		return status.Error(codes.Aborted, err.Error())
+	case errors.Is(err, models.ErrFriendNotFound), errors.Is(err, errNothingToPick):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+func friendToProto(friend models.Friend) (*pb.Friend, error) {
+	message := &pb.Friend{
+		Id:            friend.ID,
+		Name:          friend.Name,
+		Slug:          friend.Slug,
+		LastContacted: friend.LastContacted,
+		Birthday:      friend.Birthday,
+		Notes:         friend.Notes,
+		Tags:          friend.Tags,
+		Version:       int64(friend.Version),
+	}
+
+	if len(friend.Fields) > 0 {
+		fields, err := structpb.NewStruct(friend.Fields)
+		if err != nil {
+			return nil, err
+		}
+		message.Fields = fields
+	}
+	return message, nil
+}
+
+func friendsToProto(friends models.FriendsList) ([]*pb.Friend, error) {
+	messages := make([]*pb.Friend, 0, len(friends))
+	for _, friend := range friends {
+		message, err := friendToProto(friend)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, nil
+}
+
+func friendFromProto(message *pb.Friend) models.Friend {
+	friend := models.Friend{
+		ID:            message.GetId(),
+		Name:          message.GetName(),
+		Slug:          message.GetSlug(),
+		LastContacted: message.GetLastContacted(),
+		Birthday:      message.GetBirthday(),
+		Notes:         message.GetNotes(),
+		Tags:          message.GetTags(),
+	}
+	if message.GetFields() != nil {
+		friend.Fields = message.GetFields().AsMap()
+	}
+	return friend
+}
+
+// Sends the friend back, or the error if they couldn't be saved
+func respondFriend(friend *models.Friend, err error) (*pb.Friend, error) {
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	message, err := friendToProto(*friend)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return message, nil
+}
+
+// Finds the friend by their ID or slug
+func (s *friendsServer) currentFriend(idOrSlug string) (*models.Friend, error) {
+	friend, err := models.GetFriendByID(idOrSlug, s.handler.FriendsList)
+	if err != nil {
+		return nil, status.Error(codes.NotFound, err.Error())
+	}
+	return friend, nil
+}
+
+func (s *friendsServer) ListFriends(ctx context.Context, req *pb.ListFriendsRequest) (*pb.ListFriendsResponse, error) {
+	if req.GetLimit() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "limit must be a positive number")
+	}
+
+	query := models.FriendsQuery{
+		Tags:            req.GetTags(),
+		Fields:          req.GetFields(),
+		ContactedBefore: req.GetContactedBefore(),
+		Sort:            req.GetSort(),
+		Limit:           int(req.GetLimit()),
+		Cursor:          req.GetCursor(),
+	}
+	if req.HasBirthday != nil {
+		hasBirthday := req.GetHasBirthday()
+		query.HasBirthday = &hasBirthday
+	}
+
+	page, err := models.QueryFriends(s.handler.FriendsList, query, time.Now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	friends, err := friendsToProto(page.Friends)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.ListFriendsResponse{Friends: friends, TotalCount: int32(page.Total), NextCursor: page.NextCursor}, nil
+}
+
+func (s *friendsServer) GetFriend(ctx context.Context, req *pb.GetFriendRequest) (*pb.Friend, error) {
+	friend, err := s.currentFriend(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	return respondFriend(friend, nil)
+}
+
+func (s *friendsServer) CreateFriend(ctx context.Context, req *pb.CreateFriendRequest) (*pb.Friend, error) {
+	if req.GetFriend() == nil {
+		return nil, status.Error(codes.InvalidArgument, "friend is required")
+	}
+
+	// IDs are always given out by the server
+	friend := friendFromProto(req.GetFriend())
+	friend.ID = ""
+
+	return respondFriend(s.handler.createFriend(s.callActor(ctx), friend))
+}
+
+func (s *friendsServer) UpdateFriend(ctx context.Context, req *pb.UpdateFriendRequest) (*pb.Friend, error) {
+	if req.GetFriend() == nil {
+		return nil, status.Error(codes.InvalidArgument, "friend is required")
+	}
+
+	current, err := s.currentFriend(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	replacement := friendFromProto(req.GetFriend())
+	replacement.ID = current.ID
+	replacement.DeletedAt = current.DeletedAt
+
+	return respondFriend(s.handler.replaceFriend(s.callActor(ctx), replacement, int(req.GetVersion())))
+}
+
+func (s *friendsServer) DeleteFriend(ctx context.Context, req *pb.DeleteFriendRequest) (*pb.DeleteFriendResponse, error) {
+	friend, err := s.currentFriend(req.GetId())
+	if err != nil {
+		return nil, err
+	}
+
+	if err := s.handler.deleteFriend(s.callActor(ctx), *friend, int(req.GetVersion())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &pb.DeleteFriendResponse{Id: friend.ID}, nil
+}
+
+func (s *friendsServer) PickFriend(ctx context.Context, req *pb.PickFriendRequest) (*pb.Friend, error) {
+	group := suggestGroupMeetUpsByDefault()
+	if req.Group != nil {
+		group = req.GetGroup()
+	}
+
+	friend, err := s.handler.pickFriend(s.callActor(ctx), req.GetTags(), group)
+	return respondFriend(&friend, err)
+}
+
+func (s *friendsServer) GetBirthdays(ctx context.Context, req *pb.GetBirthdaysRequest) (*pb.GetBirthdaysResponse, error) {
+	friends, err := friendsToProto(s.handler.checkBirthdays(s.callActor(ctx)))
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return &pb.GetBirthdaysResponse{Friends: friends}, nil
+}
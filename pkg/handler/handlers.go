@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/gin-contrib/cors"
@@ -16,15 +17,33 @@ import (
 type FriendsHandler struct {
 	FriendsList models.FriendsList
 	DB          *sql.DB
+	Events      *models.EventBus
+	// The bearer token the app's scheduled jobs call the API with. It's made up at startup so it never needs configuring
+	SchedulerToken string
+	// Kept in line with FriendsList so searches don't have to index every friend again
+	SearchIndex *models.SearchIndex
 }
 
 func NewFriendsHandler(friendsList models.FriendsList, db *sql.DB) *FriendsHandler {
+	searchIndex, err := models.NewSearchIndex()
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to create the search index, so every search will index the friends again: %v", err)
+	} else if err := searchIndex.Sync(friendsList); err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to index the friends for searching: %v", err)
+	}
+
 	return &FriendsHandler{
-		FriendsList: friendsList,
-		DB:          db,
+		FriendsList:    friendsList,
+		DB:             db,
+		Events:         models.NewEventBus(eventHistorySize()),
+		SchedulerToken: newSchedulerToken(),
+		SearchIndex:    searchIndex,
 	}
 }
 
+// Routes are served under /api/v1. The original unversioned routes are kept as deprecated aliases
+const apiV1Prefix = "/api/v1"
+
 func SetupRouter(handler *FriendsHandler) *gin.Engine {
 
 	gin.SetMode(gin.ReleaseMode)
@@ -35,96 +54,178 @@ func SetupRouter(handler *FriendsHandler) *gin.Engine {
 	// Allow CORS for the frontend to access
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"*"}
+	config.ExposeHeaders = []string{"X-Total-Count", "X-Next-Cursor", "Deprecation", "Link", "ETag", "Idempotent-Replayed"}
+	config.AddAllowHeaders("If-Match", "If-None-Match", "Idempotency-Key")
+
+	r.Use(cors.New(config), handler.identifyActor())
 
-	r.Use(cors.New(config))
+	r.GET("/openapi.json", GetOpenAPISpec)
+	r.GET("/docs/*any", swaggerUI())
+
+	registerRoutes(r.Group(apiV1Prefix, validateRequest(), handler.idempotent()), handler)
+	registerRoutes(r.Group("", deprecatedRoute(), validateRequest(), handler.idempotent()), handler)
+	r.NoRoute(routeNotFound)
+
+	return r
+}
 
+func registerRoutes(r *gin.RouterGroup, handler *FriendsHandler) {
 	r.DELETE("/friends/:id", handler.DeleteFriend)
+	r.DELETE("/friends/:id/tags/:tag", handler.DeleteFriendTag)
+	r.DELETE("/friends/:id/contacts/:contactId", handler.DeleteContactMethod)
+	r.DELETE("/friends/:id/related/:relationshipId", handler.DeleteRelationship)
+	r.DELETE("/friends/:id/gifts/:giftId", handler.DeleteGiftIdea)
+	r.DELETE("/friends/:id/photo", handler.DeletePhoto)
+	r.DELETE("/fields/:name", handler.DeleteCustomField)
+	r.GET("/audit", handler.GetAuditLog)
 	r.GET("/birthdays", handler.GetBirthdays)
+	r.GET("/events", handler.GetEvents)
+	r.GET("/export", handler.ExportFriends)
 	r.GET("/friends", handler.GetFriends)
 	r.GET("/friends/random", handler.GetRandomFriend)
 	r.GET("/friends/count", handler.GetFriendCount)
 	r.GET("/friends/id/:id", handler.GetFriendByID)
 	r.GET("/friends/name/:name", handler.GetFriendByName)
+	r.GET("/friends/:id/history", handler.GetFriendHistory)
+	r.GET("/friends/:id/contacts", handler.GetContactMethods)
+	r.GET("/friends/:id/related", handler.GetRelatedFriends)
+	r.GET("/friends/:id/gifts", handler.GetGiftIdeas)
+	r.GET("/friends/:id/photo", handler.GetPhoto)
+	r.GET("/fields", handler.GetCustomFields)
+	r.GET("/search", handler.Search)
+	r.GET("/tags", handler.GetTags)
+	r.GET("/trash", handler.GetTrash)
 	r.POST("/friends", handler.PostNewFriend)
+	r.POST("/friends/batch", handler.PostBatch)
+	r.POST("/friends/:id/restore", handler.RestoreFriend)
+	r.POST("/friends/:id/tags", handler.PostFriendTags)
+	r.POST("/friends/:id/contacts", handler.PostContactMethod)
+	r.POST("/friends/:id/related", handler.PostRelationship)
+	r.POST("/friends/:id/gifts", handler.PostGiftIdea)
+	r.POST("/fields", handler.PostCustomField)
+	r.POST("/import", handler.ImportFriends)
 	r.PUT("/friends/:id", handler.PutFriend)
+	r.PATCH("/friends/:id", handler.PatchFriend)
+	r.PUT("/friends/:id/contacts/:contactId", handler.PutContactMethod)
+	r.PUT("/friends/:id/gifts/:giftId", handler.PutGiftIdea)
+	r.PUT("/friends/:id/photo", handler.PutPhoto)
+
+	admin := r.Group("/admin", handler.RequireAdminToken())
+	admin.POST("/backup", handler.PostBackup)
+	admin.GET("/backups", handler.GetBackups)
+	admin.GET("/backups/:name", handler.GetBackup)
+	admin.POST("/restore", handler.PostRestore)
+	admin.POST("/trash/purge", handler.PurgeTrash)
+
+	// Webhooks send every event to a URL, so they need the admin token too
+	webhooks := r.Group("/webhooks", handler.RequireAdminToken())
+	webhooks.DELETE("/:id", handler.DeleteWebhook)
+	webhooks.GET("", handler.GetWebhooks)
+	webhooks.GET("/:id", handler.GetWebhook)
+	webhooks.GET("/:id/deliveries", handler.GetWebhookDeliveries)
+	webhooks.POST("", handler.PostWebhook)
+}
 
-	return r
+// Turns a slug into the friend's ID, including friends in the trash.
+// Anything that doesn't match a friend is returned as it is, since purged friends still have a history
+func (h *FriendsHandler) resolveFriendID(idOrSlug string) string {
+	if friend, err := models.GetFriendByID(idOrSlug, h.FriendsList); err == nil {
+		return friend.ID
+	}
+	if id, err := models.ResolveFriendID(h.DB, idOrSlug); err == nil {
+		return id
+	}
+	return idOrSlug
 }
 
 func IsValidDate(dateStr string) bool {
-	layout := "2006-01-02"
-	_, err := time.Parse(layout, dateStr)
-	return err == nil
+	return models.IsValidDate(dateStr)
 }
 
 // DELETE /friends/:id
+// Send the friend's ETag in If-Match to only delete them if they haven't changed since
 func (h *FriendsHandler) DeleteFriend(c *gin.Context) {
 	friendID := c.Param("id")
 
 	friend, err := models.GetFriendByID(friendID, h.FriendsList)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		respondError(c, http.StatusNotFound, err)
 		return
 	}
 
-	err = models.DeleteFriend(h.DB, *friend)
-	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	version, ok := checkPreconditions(c, *friend)
+	if !ok {
 		return
 	}
 
-	friendsList, err := models.BuildFriendsList(h.DB)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := h.deleteFriend(requestActor(c), *friend, version); err != nil {
+		respondError(c, statusForError(err), err)
 		return
 	}
-	h.FriendsList = friendsList
 
 	c.JSON(http.StatusOK, gin.H{"message": friend.Name + " removed successfully", "id": friend.ID})
 }
 
 // GET /birthdays
 func (h *FriendsHandler) GetBirthdays(c *gin.Context) {
-	logger.LogMessage(logger.LogLevelInfo, "Checking if any birthdays are today")
+	birthdays := h.checkBirthdays(requestActor(c))
 
-	c.JSON(http.StatusOK, models.CheckBirthdays(h.FriendsList, time.Now()))
+	c.JSON(http.StatusOK, birthdays)
 }
 
-// GET /friends
+// GET /friends?tag=&field[name]=&contactedBefore=&hasBirthday=&sort=&limit=&cursor=
+// Only friends with all of the tags and custom field values provided are returned.
+// The number of friends that matched is in X-Total-Count, and X-Next-Cursor is set when there's another page
 func (h *FriendsHandler) GetFriends(c *gin.Context) {
-	c.JSON(http.StatusOK, h.FriendsList)
-}
-
-// GET /friends/random
-func (h *FriendsHandler) GetRandomFriend(c *gin.Context) {
-	randomFriend, err := models.PickRandomFriend(h.FriendsList)
-	if err != nil {
-		logger.LogMessage(logger.LogLevelFatal, "Failed to get a random friend: %v", err)
-		c.JSON(http.StatusNotFound, "failed to pick a friend")
-		return
-	} else {
-		logger.LogMessage(logger.LogLevelInfo, randomFriend.Name+" has been chosen")
+	query := models.FriendsQuery{
+		Tags:            c.QueryArray("tag"),
+		Fields:          c.QueryMap("field"),
+		ContactedBefore: c.Query("contactedBefore"),
+		Sort:            c.Query("sort"),
+		Cursor:          c.Query("cursor"),
 	}
 
-	var content = "You should get in touch with " + randomFriend.Name + ". You haven't spoken to them since " +
-		randomFriend.LastContacted + ". "
-
-	if randomFriend.Notes != "" {
-		content = content + "Here's what you've got written down for them: " + randomFriend.Notes
+	if hasBirthday := c.Query("hasBirthday"); hasBirthday != "" {
+		value, err := strconv.ParseBool(hasBirthday)
+		if err != nil {
+			respondError(c, http.StatusBadRequest, errors.New("hasBirthday must be true or false"))
+			return
+		}
+		query.HasBirthday = &value
 	}
-	models.SendNotification(content)
 
-	updatedFriend := models.UpdateLastContacted(randomFriend, time.Now())
+	if limit := c.Query("limit"); limit != "" {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 {
+			respondError(c, http.StatusBadRequest, errors.New("limit must be a positive number"))
+			return
+		}
+		query.Limit = value
+	}
 
-	err = models.SqlUpdateFriend(h.DB, updatedFriend.ID, updatedFriend)
+	page, err := models.QueryFriends(h.FriendsList, query, time.Now())
 	if err != nil {
-		logger.LogMessage(logger.LogLevelFatal, "Failed to update friend: %v", err)
-		c.JSON(http.StatusNotFound, "failed to update a friend")
+		respondError(c, http.StatusBadRequest, err)
+		return
 	}
 
-	h.FriendsList, err = models.UpdateFriend(h.FriendsList, updatedFriend)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	c.Header("X-Total-Count", strconv.Itoa(page.Total))
+	if page.NextCursor != "" {
+		c.Header("X-Next-Cursor", page.NextCursor)
+	}
+	c.JSON(http.StatusOK, page.Friends)
+}
+
+// GET /friends/random?tag=&group=
+// If tags are provided, the friend is picked from the friends with all of those tags.
+// With group=true, or SUGGEST_GROUP_MEETUPS set to true, the notification suggests meeting up with any related friends that are also overdue
+func (h *FriendsHandler) GetRandomFriend(c *gin.Context) {
+	randomFriend, err := h.pickFriend(requestActor(c), c.QueryArray("tag"), suggestGroupMeetUps(c))
+	if errors.Is(err, errNothingToPick) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	} else if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
 		return
 	}
 
@@ -137,11 +238,15 @@ func (h *FriendsHandler) GetFriendCount(c *gin.Context) {
 }
 
 // GET /friends/id/:id
+// The friend's ETag is sent with them. Send it back in If-None-Match to get 304 Not Modified if they haven't changed
 func (h *FriendsHandler) GetFriendByID(c *gin.Context) {
 	friendID := c.Param("id")
 	friend, err := models.GetFriendByID(friendID, h.FriendsList)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if notModified(c, *friend) {
 		return
 	}
 	c.JSON(http.StatusOK, friend)
@@ -152,125 +257,114 @@ func (h *FriendsHandler) GetFriendByName(c *gin.Context) {
 	friendName := c.Param("name")
 	friend, err := models.GetFriendByName(friendName, h.FriendsList)
 	if err != nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if notModified(c, *friend) {
 		return
 	}
 	c.JSON(http.StatusOK, friend)
 }
 
 // POST /friends
+// Responds with the friend as they were saved, and their URL in the Location header
 func (h *FriendsHandler) PostNewFriend(c *gin.Context) {
 	var newFriend models.Friend
 	if err := c.ShouldBindJSON(&newFriend); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-		return
-	}
-
-	if newFriend.Name == "" {
-		err := errors.New("name must not be blank")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-		return
-	}
-
-	// TODO: TR72 - Turn this into a function
-	if newFriend.LastContacted != "" {
-		if !IsValidDate(newFriend.LastContacted) {
-			err := errors.New("last Contacted date must be in yyyy-mm-dd format. " + newFriend.LastContacted + " does not match")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-	}
-
-	// TODO: TR72
-	if newFriend.Birthday != "" {
-		if !IsValidDate(newFriend.Birthday) {
-			err := errors.New("birthday must be in yyyy-mm-dd format. " + newFriend.Birthday + " does not match")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-	}
-
-	err := models.AddFriend(h.DB, newFriend)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, http.StatusBadRequest, err)
 		return
 	}
 
-	friendsList, err := models.BuildFriendsList(h.DB)
+	createdFriend, err := h.createFriend(requestActor(c), newFriend)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, statusForError(err), err)
 		return
 	}
-	h.FriendsList = friendsList
 
-	successMsg := newFriend.Name + " added successfully"
-
-	c.JSON(http.StatusCreated, gin.H{"message": successMsg})
+	c.Header("Location", routePrefix(c)+"/friends/id/"+createdFriend.ID)
+	c.Header("ETag", friendETag(*createdFriend))
+	c.JSON(http.StatusCreated, createdFriend)
 }
 
 // PUT /friends/:id
-// Updates the specified friend. Any keys not sent in the payload will not be edited.
+// Replaces the friend with the one sent. Anything not sent is cleared, apart from the slug which stays the same.
+// Send the friend's ETag in If-Match to get 412 Precondition Failed instead of overwriting someone else's changes
 func (h *FriendsHandler) PutFriend(c *gin.Context) {
-	id := c.Param("id")
-
-	currentFriend, err := models.GetFriendByID(id, h.FriendsList)
+	currentFriend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Friend not found"})
+		respondError(c, http.StatusNotFound, errors.New("Friend not found"))
 		return
 	}
 
-	var updatedFriend models.Friend
-	if err := c.ShouldBindJSON(&updatedFriend); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	version, ok := checkPreconditions(c, *currentFriend)
+	if !ok {
 		return
 	}
 
-	if updatedFriend.Name != "" {
-		logger.LogMessage(logger.LogLevelDebug, "Setting name to "+updatedFriend.Name)
-		currentFriend.Name = updatedFriend.Name
+	var replacement models.Friend
+	if err := c.ShouldBindJSON(&replacement); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
 	}
+	replacement.ID = currentFriend.ID
+	replacement.DeletedAt = currentFriend.DeletedAt
 
-	// TODO: TR72
-	updatedLastContacted := updatedFriend.LastContacted
-	if updatedLastContacted != "" {
-		if !IsValidDate(updatedLastContacted) {
-			err = errors.New("Date must be in yyyy-mm-dd format." + updatedLastContacted + "does not match.")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		logger.LogMessage(logger.LogLevelDebug, "Setting last contacted to "+updatedLastContacted)
-		currentFriend.LastContacted = updatedLastContacted
+	h.saveFriend(c, replacement, version)
+}
+
+// PATCH /friends/:id
+// Changes part of the friend. Send a JSON Merge Patch, where null clears a field, or a JSON Patch
+// with the Content-Type application/json-patch+json. If-Match works the same as for PUT
+func (h *FriendsHandler) PatchFriend(c *gin.Context) {
+	currentFriend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, errors.New("Friend not found"))
+		return
 	}
 
-	// TODO: TR72
-	updatedBirthday := updatedFriend.Birthday
-	if updatedBirthday != "" {
-		if !IsValidDate(updatedBirthday) {
-			err = errors.New("Date must be in yyyy-mm-dd format." + updatedBirthday + "does not match.")
-			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-			return
-		}
-		logger.LogMessage(logger.LogLevelDebug, "Setting birthday to "+updatedBirthday)
-		currentFriend.Birthday = updatedBirthday
+	version, ok := checkPreconditions(c, *currentFriend)
+	if !ok {
+		return
 	}
 
-	if updatedFriend.Notes != "" {
-		logger.LogMessage(logger.LogLevelDebug, "Setting notes to "+updatedFriend.Notes)
-		currentFriend.Notes = updatedFriend.Notes
+	patch, err := c.GetRawData()
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
 	}
 
-	if err := models.SqlUpdateFriend(h.DB, id, currentFriend); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	patchedFriend, err := models.PatchFriend(*currentFriend, c.ContentType(), patch)
+	switch {
+	case errors.Is(err, models.ErrUnsupportedPatch):
+		respondError(c, http.StatusUnsupportedMediaType, err)
+		return
+	case errors.Is(err, models.ErrMalformedPatch):
+		respondError(c, http.StatusBadRequest, err)
+		return
+	case errors.Is(err, models.ErrPatchTestFailed):
+		respondError(c, http.StatusConflict, err)
+		return
+	case err != nil:
+		respondError(c, statusForError(err), err)
 		return
 	}
 
-	h.FriendsList, err = models.BuildFriendsList(h.DB)
+	h.saveFriend(c, patchedFriend, version)
+}
+
+// Saves the whole friend over the one with the same ID and responds with the friend's new ETag.
+// If version isn't 0 the friend is only saved if they are still at that version
+func (h *FriendsHandler) saveFriend(c *gin.Context, friend models.Friend, version int) {
+	saved, err := h.replaceFriend(requestActor(c), friend, version)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		respondError(c, statusForError(err), err)
 		return
 	}
 
-	successMsg := id + " updated successfully"
+	// The new ETag lets the client make another change without fetching the friend again
+	c.Header("ETag", friendETag(*saved))
+
+	successMsg := c.Param("id") + " updated successfully"
 
 	c.JSON(http.StatusOK, gin.H{"message": successMsg})
 }
@@ -0,0 +1,158 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/logger"
+	"howarethey/pkg/models"
+)
+
+const defaultIdempotencyWindowHours = 24
+
+// Keys longer than this are rejected so they can't be used to fill up the db
+const maxIdempotencyKeyLength = 255
+
+// How long a request can hold on to its key without saving a response before the key can be claimed again,
+// so a key isn't stuck if the app stops part way through a request
+const idempotencyClaimTimeout = 5 * time.Minute
+
+// Responses that depend on more than the request itself, like the token sent or the friend's current version, aren't saved
+// so a retry made after putting it right is run for real. Server errors aren't saved either
+var unsavedStatuses = map[int]bool{
+	http.StatusUnauthorized:       true,
+	http.StatusForbidden:          true,
+	http.StatusPreconditionFailed: true,
+}
+
+// The headers sent again along with the body when a response is replayed
+var replayedHeaders = []string{"Content-Type", "Location", "ETag", "Content-Disposition"}
+
+// How long the response to a request with an Idempotency-Key is kept for. Set in hours with IDEMPOTENCY_WINDOW_HOURS
+func idempotencyWindow() time.Duration {
+	hours, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_WINDOW_HOURS"))
+	if err != nil || hours < 1 {
+		hours = defaultIdempotencyWindowHours
+	}
+	return time.Duration(hours) * time.Hour
+}
+
+// Keeps a copy of the body as it's written so it can be saved
+type recordingWriter struct {
+	gin.ResponseWriter
+	body bytes.Buffer
+}
+
+func (w *recordingWriter) Write(data []byte) (int, error) {
+	w.body.Write(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *recordingWriter) WriteString(s string) (int, error) {
+	w.body.WriteString(s)
+	return w.ResponseWriter.WriteString(s)
+}
+
+// Makes POST, PUT, PATCH and DELETE requests safe to retry. If a request is sent with an Idempotency-Key header,
+// the response is saved and sent again to any retry with the same key instead of making the change twice.
+// Server errors, auth failures and failed preconditions aren't saved, so those requests can be retried for real
+func (h *FriendsHandler) idempotent() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := c.GetHeader("Idempotency-Key")
+		switch c.Request.Method {
+		case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		default:
+			key = ""
+		}
+		if key == "" {
+			c.Next()
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			respondError(c, http.StatusBadRequest, errors.New("Idempotency-Key can't be longer than "+strconv.Itoa(maxIdempotencyKeyLength)+" characters"))
+			return
+		}
+
+		// The body is read to tell retries apart from a different request sent with the same key,
+		// so it's limited to the size of the largest upload
+		maxSize := photoMaxSize() + 1<<20
+		body, err := io.ReadAll(io.LimitReader(c.Request.Body, maxSize+1))
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		if int64(len(body)) > maxSize {
+			respondError(c, http.StatusRequestEntityTooLarge, errors.New("requests sent with an Idempotency-Key must be smaller than "+strconv.FormatInt(maxSize>>20, 10)+"MB"))
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		fingerprint := sha256.New()
+		fingerprint.Write([]byte(c.Request.Method + " " + c.Request.URL.RequestURI() + "\n"))
+		fingerprint.Write(body)
+
+		actor := requestActor(c)
+		stored, err := models.ClaimIdempotencyKey(h.DB, key, actor, hex.EncodeToString(fingerprint.Sum(nil)),
+			time.Now().Add(-idempotencyWindow()), time.Now().Add(-idempotencyClaimTimeout))
+		switch {
+		case errors.Is(err, models.ErrIdempotencyKeyInUse):
+			respondError(c, http.StatusConflict, err)
+			return
+		case errors.Is(err, models.ErrIdempotencyKeyReused):
+			respondError(c, http.StatusUnprocessableEntity, err)
+			return
+		case err != nil:
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		case stored != nil:
+			for name, value := range stored.Header {
+				c.Header(name, value)
+			}
+			c.Header("Idempotent-Replayed", "true")
+			c.Data(stored.Status, stored.Header["Content-Type"], stored.Body)
+			c.Abort()
+			return
+		}
+
+		writer := &recordingWriter{ResponseWriter: c.Writer}
+		c.Writer = writer
+
+		saved := false
+		// The key is let go of if the handler panics, as well as on server errors
+		defer func() {
+			if saved {
+				return
+			}
+			if err := models.ReleaseIdempotencyKey(h.DB, key, actor); err != nil {
+				logger.LogMessage(logger.LogLevelError, "Failed to release Idempotency-Key: %v", err)
+			}
+		}()
+
+		c.Next()
+
+		if writer.Status() >= http.StatusInternalServerError || unsavedStatuses[writer.Status()] {
+			return
+		}
+
+		response := models.StoredResponse{Status: writer.Status(), Header: map[string]string{}, Body: writer.body.Bytes()}
+		for _, name := range replayedHeaders {
+			if value := writer.Header().Get(name); value != "" {
+				response.Header[name] = value
+			}
+		}
+		if err := models.SaveIdempotentResponse(h.DB, key, actor, response); err != nil {
+			logger.LogMessage(logger.LogLevelError, "Failed to save the response for Idempotency-Key: %v", err)
+			return
+		}
+		saved = true
+	}
+}
@@ -0,0 +1,177 @@
+package handler
+
+import (
+	_ "embed"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/getkin/kin-openapi/openapi3"
+	"github.com/getkin/kin-openapi/openapi3filter"
+	"github.com/getkin/kin-openapi/routers"
+	"github.com/gin-gonic/gin"
+	swaggerui "github.com/swaggest/swgui/v5emb"
+
+	"howarethey/pkg/models"
+)
+
+// The OpenAPI document describing every /api/v1 route. Keep it in step with registerRoutes
+//
+//go:embed openapi.yaml
+var openAPIDocument []byte
+
+var openAPISpec = mustLoadOpenAPISpec()
+
+// LoadOpenAPISpec parses the OpenAPI document the server is built with and checks it's valid
+func LoadOpenAPISpec() (*openapi3.T, error) {
+	loader := openapi3.NewLoader()
+	spec, err := loader.LoadFromData(openAPIDocument)
+	if err != nil {
+		return nil, err
+	}
+	if err := spec.Validate(loader.Context); err != nil {
+		return nil, err
+	}
+	return spec, nil
+}
+
+// The document is built into the binary, so if it doesn't load the server can't start
+func mustLoadOpenAPISpec() *openapi3.T {
+	spec, err := LoadOpenAPISpec()
+	if err != nil {
+		panic("openapi.yaml is not valid: " + err.Error())
+	}
+	return spec
+}
+
+// GET /openapi.json
+// Returns the OpenAPI document for the API
+func GetOpenAPISpec(c *gin.Context) {
+	c.JSON(http.StatusOK, openAPISpec)
+}
+
+// GET /docs
+// Serves Swagger UI for browsing and trying out the API
+func swaggerUI() gin.HandlerFunc {
+	return gin.WrapH(swaggerui.New("HowAreThey", "/openapi.json", "/docs/"))
+}
+
+// Gin writes path parameters as :id where OpenAPI uses {id}
+var ginPathParam = regexp.MustCompile(`:(\w+)`)
+
+// Finds the operation in the OpenAPI document for the route the request matched, or nil if it isn't documented
+func openAPIRoute(c *gin.Context) *routers.Route {
+	path := c.FullPath()
+	if path == "" {
+		return nil
+	}
+	path = ginPathParam.ReplaceAllString(strings.TrimPrefix(path, apiV1Prefix), "{$1}")
+
+	pathItem := openAPISpec.Paths.Value(path)
+	if pathItem == nil {
+		return nil
+	}
+	operation := pathItem.GetOperation(c.Request.Method)
+	if operation == nil {
+		return nil
+	}
+
+	return &routers.Route{
+		Spec:      openAPISpec,
+		Path:      path,
+		PathItem:  pathItem,
+		Method:    c.Request.Method,
+		Operation: operation,
+	}
+}
+
+// Bodies are only checked for routes that just take JSON. Uploads and imports can be sent in more than one format
+// and their handlers check what was actually sent
+func takesOnlyJSON(operation *openapi3.Operation) bool {
+	if operation.RequestBody == nil || operation.RequestBody.Value == nil {
+		return false
+	}
+	content := operation.RequestBody.Value.Content
+	return len(content) == 1 && content.Get("application/json") != nil
+}
+
+// Checks requests against the OpenAPI document before they reach the handlers, so clients are told exactly
+// which parameter or field is wrong. The admin token is checked by RequireAdminToken rather than here
+func validateRequest() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		route := openAPIRoute(c)
+		if route == nil {
+			c.Next()
+			return
+		}
+
+		pathParams := make(map[string]string, len(c.Params))
+		for _, param := range c.Params {
+			pathParams[param.Key] = param.Value
+		}
+
+		input := &openapi3filter.RequestValidationInput{
+			Request:    c.Request,
+			PathParams: pathParams,
+			Route:      route,
+			Options: &openapi3filter.Options{
+				ExcludeRequestBody:  !takesOnlyJSON(route.Operation),
+				SkipSettingDefaults: true,
+				AuthenticationFunc:  openapi3filter.NoopAuthenticationFunc,
+			},
+		}
+		if err := openapi3filter.ValidateRequest(c.Request.Context(), input); err != nil {
+			status, err := requestValidationError(err)
+			respondError(c, status, err)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Works out the status to send for a request that doesn't match the OpenAPI document, and which field was wrong.
+// Parameters that don't match are 400s, like any other query string that can't be understood, and bodies that
+// don't match are 422s, the same as when a handler rejects a value
+func requestValidationError(err error) (int, error) {
+	var requestErr *openapi3filter.RequestError
+	if !errors.As(err, &requestErr) {
+		return http.StatusBadRequest, err
+	}
+
+	var schemaErr *openapi3.SchemaError
+	isSchemaErr := errors.As(requestErr.Err, &schemaErr)
+	var pointer []string
+	if isSchemaErr {
+		pointer = schemaErr.JSONPointer()
+		// Schemas made with allOf wrap the error from the part that didn't match, with the rest of the path to the field
+		var origin *openapi3.SchemaError
+		for errors.As(schemaErr.Origin, &origin) {
+			schemaErr = origin
+			pointer = append(pointer, origin.JSONPointer()...)
+		}
+	}
+
+	switch {
+	case requestErr.Parameter != nil:
+		reason := requestErr.Reason
+		if isSchemaErr {
+			reason = schemaErr.Reason
+		} else if requestErr.Err != nil {
+			reason = requestErr.Err.Error()
+		}
+		name := requestErr.Parameter.Name
+		return http.StatusBadRequest, &models.ValidationError{Field: name, Message: name + ": " + reason}
+	case isSchemaErr:
+		field := strings.Join(pointer, ".")
+		if field == "" {
+			return http.StatusUnprocessableEntity, errors.New(schemaErr.Reason)
+		}
+		return http.StatusUnprocessableEntity, &models.ValidationError{Field: field, Message: field + ": " + schemaErr.Reason}
+	case requestErr.RequestBody != nil && requestErr.Err == nil:
+		// The only body error without a cause is a Content-Type the route doesn't accept
+		return http.StatusUnsupportedMediaType, errors.New(requestErr.Reason)
+	}
+	return http.StatusBadRequest, requestErr
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+const defaultPhotoMaxSizeMB = 5
+
+// The largest photo that can be uploaded in bytes. Set in megabytes with PHOTO_MAX_SIZE_MB
+func photoMaxSize() int64 {
+	size, err := strconv.Atoi(os.Getenv("PHOTO_MAX_SIZE_MB"))
+	if err != nil || size < 1 {
+		size = defaultPhotoMaxSizeMB
+	}
+	return int64(size) << 20
+}
+
+// GET /friends/:id/photo?size=thumbnail
+func (h *FriendsHandler) GetPhoto(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	photo, err := models.GetPhoto(h.DB, friend.ID, c.Query("size") == "thumbnail")
+	if errors.Is(err, models.ErrPhotoNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.Data(http.StatusOK, photo.ContentType, photo.Data)
+}
+
+// PUT /friends/:id/photo
+// Takes the image either as the request body or in the file field of a multipart form
+func (h *FriendsHandler) PutPhoto(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	maxSize := photoMaxSize()
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize+1<<20)
+
+	var upload io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/form-data") {
+		file, err := c.FormFile("file")
+		if err != nil {
+			respondError(c, http.StatusBadRequest, err)
+			return
+		}
+		opened, err := file.Open()
+		if err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+		defer opened.Close()
+		upload = opened
+	}
+
+	data, err := io.ReadAll(io.LimitReader(upload, maxSize+1))
+	if err != nil {
+		respondError(c, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if int64(len(data)) > maxSize {
+		respondError(c, http.StatusRequestEntityTooLarge, errors.New("photos must be "+strconv.FormatInt(maxSize>>20, 10)+"MB or less"))
+		return
+	}
+
+	err = models.SavePhoto(h.DB, friend.ID, data)
+	if errors.Is(err, models.ErrUnsupportedPhoto) {
+		respondError(c, http.StatusUnsupportedMediaType, err)
+		return
+	}
+	if errors.Is(err, models.ErrPhotoTooLarge) {
+		respondError(c, http.StatusRequestEntityTooLarge, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Photo saved for " + friend.Name})
+}
+
+// DELETE /friends/:id/photo
+func (h *FriendsHandler) DeletePhoto(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	err = models.DeletePhoto(h.DB, friend.ID)
+	if errors.Is(err, models.ErrPhotoNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Photo deleted for " + friend.Name})
+}
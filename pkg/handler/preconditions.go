@@ -0,0 +1,78 @@
+package handler
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// The ETag for the friend's current version. It includes the ID so a slug that moves to another friend gets a different ETag
+func friendETag(friend models.Friend) string {
+	return `"` + friend.ID + "-" + strconv.Itoa(friend.Version) + `"`
+}
+
+// Checks if the ETag is in an If-Match or If-None-Match header. * matches any ETag.
+// Weak ETags, i.e. W/"1-2", only match when weak is true, since If-Match needs an exact match and If-None-Match doesn't
+func etagMatches(header string, etag string, weak bool) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if !weak {
+				continue
+			}
+			candidate = strings.TrimPrefix(candidate, "W/")
+		}
+		if candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets the friend's ETag and sends 304 Not Modified if If-None-Match shows the client already has this version.
+// Returns true if the response has been sent
+func notModified(c *gin.Context, friend models.Friend) bool {
+	etag := friendETag(friend)
+	c.Header("ETag", etag)
+
+	if header := c.GetHeader("If-None-Match"); header != "" && etagMatches(header, etag, true) {
+		c.AbortWithStatus(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// Checks the If-Match and If-None-Match headers before the friend is changed, sending 412 Precondition Failed if they don't hold.
+// Returns the version the change has to be saved against, so it can be checked again in the same statement that writes it,
+// or 0 if the client didn't ask for a particular version
+func checkPreconditions(c *gin.Context, friend models.Friend) (int, bool) {
+	etag := friendETag(friend)
+
+	version := 0
+	if header := c.GetHeader("If-Match"); header != "" {
+		if !etagMatches(header, etag, false) {
+			c.Header("ETag", etag)
+			respondError(c, http.StatusPreconditionFailed, models.ErrVersionMismatch)
+			return 0, false
+		}
+		if strings.TrimSpace(header) != "*" {
+			version = friend.Version
+		}
+	}
+
+	// If-None-Match: * asks for the change to be made only if the friend doesn't exist yet, which they always do here
+	if header := c.GetHeader("If-None-Match"); header != "" && etagMatches(header, etag, true) {
+		c.Header("ETag", etag)
+		respondError(c, http.StatusPreconditionFailed, models.ErrVersionMismatch)
+		return 0, false
+	}
+
+	return version, true
+}
@@ -0,0 +1,115 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+const defaultGroupMeetUpOverdueDays = 30
+
+// Checks if the friend picker should suggest meeting up with related friends.
+// The group query param takes priority over SUGGEST_GROUP_MEETUPS
+func suggestGroupMeetUps(c *gin.Context) bool {
+	if group := c.Query("group"); group != "" {
+		return group == "true"
+	}
+	return suggestGroupMeetUpsByDefault()
+}
+
+// Checks if group meet-ups are suggested when the request doesn't say. Set with SUGGEST_GROUP_MEETUPS
+func suggestGroupMeetUpsByDefault() bool {
+	return os.Getenv("SUGGEST_GROUP_MEETUPS") == "true"
+}
+
+// Related friends that haven't been contacted since before this are suggested for a group meet-up.
+// Set the number of days with GROUP_MEETUP_OVERDUE_DAYS
+func groupMeetUpCutoff() time.Time {
+	days, err := strconv.Atoi(os.Getenv("GROUP_MEETUP_OVERDUE_DAYS"))
+	if err != nil || days < 0 {
+		days = defaultGroupMeetUpOverdueDays
+	}
+	return time.Now().AddDate(0, 0, -days)
+}
+
+// GET /friends/:id/related
+func (h *FriendsHandler) GetRelatedFriends(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	related, err := models.RelatedFriends(h.DB, friend.ID, h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, related)
+}
+
+// POST /friends/:id/related
+// Links the friend to the friend in RelatedID
+func (h *FriendsHandler) PostRelationship(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	var relationship models.Relationship
+	if err := c.ShouldBindJSON(&relationship); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	relationship.FriendID = friend.ID
+
+	if err := models.ValidateRelationship(relationship); err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	related, err := models.GetFriendByID(relationship.RelatedID, h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, errors.New("related friend not found"))
+		return
+	}
+	relationship.RelatedID = related.ID
+
+	relationship, err = models.AddRelationship(h.DB, relationship)
+	if errors.Is(err, models.ErrRelationshipExists) {
+		respondError(c, http.StatusConflict, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusCreated, relationship)
+}
+
+// DELETE /friends/:id/related/:relationshipId
+func (h *FriendsHandler) DeleteRelationship(c *gin.Context) {
+	relationshipID, err := strconv.ParseInt(c.Param("relationshipId"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errors.New("relationship ID must be a number"))
+		return
+	}
+
+	err = models.DeleteRelationship(h.DB, h.resolveFriendID(c.Param("id")), relationshipID)
+	if errors.Is(err, models.ErrRelationshipNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Relationship deleted successfully"})
+}
@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// GET /search?q=
+// Searches friends' names, tags, notes and custom fields, best match first.
+// Contact methods, gift ideas and the audit history aren't searched, since the index is built from the friends list
+// held in memory and those are only read from the db one friend at a time
+func (h *FriendsHandler) Search(c *gin.Context) {
+	results, err := h.SearchIndex.Search(h.FriendsList, c.Query("q"))
+	if errors.Is(err, models.ErrBlankSearch) {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, results)
+}
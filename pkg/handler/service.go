@@ -0,0 +1,152 @@
+package handler
+
+import (
+	"errors"
+	"time"
+
+	"howarethey/pkg/logger"
+	"howarethey/pkg/models"
+)
+
+// The changes to friends that both the REST routes and the gRPC server make. Each takes the actor making the change,
+// which is recorded in the audit log and on the events published
+
+var (
+	errNothingToPick = errors.New("failed to pick a friend")
+	errPickedUpdate  = errors.New("failed to update a friend")
+)
+
+// Validates and adds the friend, then returns them as they were saved
+func (h *FriendsHandler) createFriend(actor string, friend models.Friend) (*models.Friend, error) {
+	if err := models.ValidateFriend(friend); err != nil {
+		return nil, err
+	}
+
+	if _, err := models.NormaliseFields(h.DB, friend.Fields); err != nil {
+		return nil, err
+	}
+
+	createdFriend, err := models.AddFriend(models.WithActor(h.DB, actor), friend)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.refreshFriendsList(actor); err != nil {
+		return nil, err
+	}
+	return createdFriend, nil
+}
+
+// Validates and saves the whole friend over the one with the same ID, then returns them as they were saved.
+// Tags and custom fields that are missing are cleared. If version isn't 0 the friend is only saved if they are still at that version
+func (h *FriendsHandler) replaceFriend(actor string, friend models.Friend, version int) (*models.Friend, error) {
+	if err := models.ValidateFriend(friend); err != nil {
+		return nil, err
+	}
+
+	tags, err := models.NormaliseTags(friend.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if tags == nil {
+		tags = []string{}
+	}
+	friend.Tags = tags
+
+	fields, err := models.NormaliseFields(h.DB, friend.Fields)
+	if err != nil {
+		return nil, err
+	}
+	if fields == nil {
+		fields = map[string]interface{}{}
+	}
+	friend.Fields = fields
+
+	if err := models.SqlUpdateFriendAtVersion(models.WithActor(h.DB, actor), friend.ID, &friend, version); err != nil {
+		return nil, err
+	}
+
+	if err := h.refreshFriendsList(actor); err != nil {
+		return nil, err
+	}
+	return models.GetFriendByID(friend.ID, h.FriendsList)
+}
+
+// Moves the friend to the trash. If version isn't 0 they are only deleted if they are still at that version
+func (h *FriendsHandler) deleteFriend(actor string, friend models.Friend, version int) error {
+	if err := models.DeleteFriendAtVersion(models.WithActor(h.DB, actor), friend, version); err != nil {
+		return err
+	}
+	return h.refreshFriendsList(actor)
+}
+
+// Picks a friend with all of the tags, sends the reminder and moves their LastContacted on to today.
+// Returns the friend as they were when they were picked
+func (h *FriendsHandler) pickFriend(actor string, tags []string, group bool) (models.Friend, error) {
+	candidates := h.FriendsList
+	if len(tags) > 0 {
+		candidates = models.FilterByTags(candidates, tags)
+	}
+
+	randomFriend, err := models.PickRandomFriend(candidates)
+	if err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "Failed to get a random friend: %v", err)
+		return models.Friend{}, errNothingToPick
+	} else {
+		logger.LogMessage(logger.LogLevelInfo, randomFriend.Name+" has been chosen")
+	}
+
+	contactMethods, err := models.ListContactMethods(h.DB, randomFriend.ID)
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to load contact methods for %s: %v", randomFriend.Name, err)
+	}
+	var meetUp models.FriendsList
+	if group {
+		meetUp, err = models.OverdueRelatedFriends(h.DB, randomFriend.ID, h.FriendsList, groupMeetUpCutoff())
+		if err != nil {
+			logger.LogMessage(logger.LogLevelError, "Failed to load related friends for %s: %v", randomFriend.Name, err)
+		}
+	}
+
+	// The thumbnail is attached to notifications that support images
+	var photo *models.Photo
+	if thumbnail, err := models.GetPhoto(h.DB, randomFriend.ID, true); err == nil {
+		photo = &thumbnail
+	} else if !errors.Is(err, models.ErrPhotoNotFound) {
+		logger.LogMessage(logger.LogLevelError, "Failed to load the photo for %s: %v", randomFriend.Name, err)
+	}
+
+	models.SendNotificationWithImage(models.RenderReminder(randomFriend, contactMethods, meetUp), photo)
+
+	updatedFriend := models.UpdateLastContacted(randomFriend, time.Now())
+
+	err = models.SqlUpdateFriend(models.WithActor(h.DB, actor), updatedFriend.ID, updatedFriend)
+	if err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "Failed to update friend: %v", err)
+		return models.Friend{}, errPickedUpdate
+	}
+
+	h.FriendsList, err = models.UpdateFriend(h.FriendsList, updatedFriend)
+	if err != nil {
+		return models.Friend{}, err
+	}
+	h.publishEvent(actor, models.EventFriendPicked, *updatedFriend)
+
+	return randomFriend, nil
+}
+
+// Sends the notification for the friends whose birthday is today and returns them
+func (h *FriendsHandler) checkBirthdays(actor string) models.FriendsList {
+	logger.LogMessage(logger.LogLevelInfo, "Checking if any birthdays are today")
+
+	giftIdeas, err := models.OutstandingGiftIdeas(h.DB)
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to load gift ideas: %v", err)
+	}
+
+	birthdays := models.CheckBirthdays(h.FriendsList, time.Now(), giftIdeas)
+	for _, friend := range birthdays {
+		h.publishEvent(actor, models.EventBirthday, friend)
+	}
+	return birthdays
+}
@@ -0,0 +1,88 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// GET /tags
+func (h *FriendsHandler) GetTags(c *gin.Context) {
+	tags, err := models.ListTags(h.DB)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, tags)
+}
+
+// POST /friends/:id/tags
+// Adds the tags to the friend, keeping any tags they already have
+func (h *FriendsHandler) PostFriendTags(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	var body struct {
+		Tags []string `binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&body); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	tags, err := models.NormaliseTags(append(append([]string{}, friend.Tags...), body.Tags...))
+	if err != nil {
+		respondError(c, http.StatusUnprocessableEntity, err)
+		return
+	}
+
+	h.updateFriendTags(c, friend, tags)
+}
+
+// DELETE /friends/:id/tags/:tag
+func (h *FriendsHandler) DeleteFriendTag(c *gin.Context) {
+	friend, err := models.GetFriendByID(c.Param("id"), h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+
+	removed := models.NormaliseTag(c.Param("tag"))
+	if !friend.HasTag(removed) {
+		respondError(c, http.StatusNotFound, errors.New(friend.Name+" is not tagged with "+removed))
+		return
+	}
+
+	tags := []string{}
+	for _, tag := range friend.Tags {
+		if tag != removed {
+			tags = append(tags, tag)
+		}
+	}
+
+	h.updateFriendTags(c, friend, tags)
+}
+
+// Saves the friend's new tags and responds with the updated friend
+func (h *FriendsHandler) updateFriendTags(c *gin.Context, friend *models.Friend, tags []string) {
+	updated := *friend
+	updated.Tags = tags
+
+	if err := models.SqlUpdateFriend(h.actorDB(c), updated.ID, &updated); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.refreshFriendsList(requestActor(c)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, updated)
+}
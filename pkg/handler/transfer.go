@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+// GET /export?format=csv|json
+func (h *FriendsHandler) ExportFriends(c *gin.Context) {
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Disposition", `attachment; filename="friends.json"`)
+		c.JSON(http.StatusOK, h.FriendsList)
+	case "csv":
+		c.Header("Content-Disposition", `attachment; filename="friends.csv"`)
+		c.Header("Content-Type", "text/csv")
+		c.Status(http.StatusOK)
+		if err := models.WriteFriendsCSV(c.Writer, h.FriendsList); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+		}
+	default:
+		respondError(c, http.StatusBadRequest, errors.New("format must be one of csv, json"))
+	}
+}
+
+// POST /import?format=csv|json&dryRun=true
+// Imports the friends in the request body and returns a report of what happened to each row.
+// Nothing is written if any row fails or if dryRun is set
+func (h *FriendsHandler) ImportFriends(c *gin.Context) {
+	var (
+		friends models.FriendsList
+		err     error
+	)
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		friends, err = models.ParseFriendsJSON(c.Request.Body)
+	case "csv":
+		friends, err = models.ParseFriendsCSV(c.Request.Body)
+	default:
+		err = errors.New("format must be one of csv, json")
+	}
+	if err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	dryRun := c.Query("dryRun") == "true"
+
+	report, err := models.ImportFriends(h.DB, friends, dryRun)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if report.Committed {
+		if err := h.refreshFriendsList(requestActor(c)); err != nil {
+			respondError(c, http.StatusInternalServerError, err)
+			return
+		}
+	}
+
+	if report.Failed > 0 {
+		c.JSON(http.StatusUnprocessableEntity, report)
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
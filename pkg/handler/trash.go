@@ -0,0 +1,81 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+const defaultTrashRetentionDays = 30
+
+// How many days friends stay in the trash before they are purged. Set with TRASH_RETENTION_DAYS
+func trashRetentionDays() int {
+	days, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS"))
+	if err != nil || days < 0 {
+		return defaultTrashRetentionDays
+	}
+	return days
+}
+
+// GET /trash
+func (h *FriendsHandler) GetTrash(c *gin.Context) {
+	trash, err := models.BuildTrashList(h.DB)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+	c.JSON(http.StatusOK, trash)
+}
+
+// POST /friends/:id/restore
+func (h *FriendsHandler) RestoreFriend(c *gin.Context) {
+	friendID, err := models.ResolveFriendID(h.DB, c.Param("id"))
+	if err == nil {
+		err = models.RestoreFriend(h.actorDB(c), friendID)
+	}
+	if errors.Is(err, models.ErrFriendNotFound) {
+		respondError(c, http.StatusNotFound, errors.New("friend not found in the trash"))
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	if err := h.refreshFriendsList(requestActor(c)); err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	friend, err := models.GetFriendByID(friendID, h.FriendsList)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": friend.Name + " restored successfully", "id": friend.ID})
+}
+
+// POST /admin/trash/purge
+// Permanently deletes friends that have been in the trash for longer than TRASH_RETENTION_DAYS.
+// Send all=true to empty the whole trash
+func (h *FriendsHandler) PurgeTrash(c *gin.Context) {
+	cutoff := time.Now().AddDate(0, 0, -trashRetentionDays())
+	if c.Query("all") == "true" {
+		cutoff = time.Now().Add(time.Second)
+	}
+
+	count, err := models.PurgeDeletedFriends(h.actorDB(c), cutoff)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": strconv.Itoa(count) + " friends purged from the trash", "count": count})
+}
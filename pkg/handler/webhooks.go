@@ -0,0 +1,188 @@
+package handler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"howarethey/pkg/models"
+)
+
+const (
+	defaultWebhookMaxAttempts  = 5
+	defaultWebhookRetrySeconds = 30
+	defaultWebhookDeliveries   = 20
+)
+
+// How long to wait for a webhook to respond before the attempt counts as failed
+const webhookTimeout = 10 * time.Second
+
+// How many times an event is sent to a webhook before giving up. Set with WEBHOOK_MAX_ATTEMPTS
+func webhookMaxAttempts() int {
+	attempts, err := strconv.Atoi(os.Getenv("WEBHOOK_MAX_ATTEMPTS"))
+	if err != nil || attempts < 1 {
+		return defaultWebhookMaxAttempts
+	}
+	return attempts
+}
+
+// How long to wait before retrying a failed delivery the first time. It doubles after every failed attempt.
+// Set in seconds with WEBHOOK_RETRY_SECONDS
+func webhookRetryDelay() time.Duration {
+	seconds, err := strconv.Atoi(os.Getenv("WEBHOOK_RETRY_SECONDS"))
+	if err != nil || seconds < 1 {
+		seconds = defaultWebhookRetrySeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// The hosts webhooks can be sent to even though they're on this machine or a private network, i.e. a service on the same
+// docker network. Set as a comma separated list with WEBHOOK_ALLOWED_HOSTS
+func webhookAllowedHosts() []string {
+	var hosts []string
+	for _, host := range strings.Split(os.Getenv("WEBHOOK_ALLOWED_HOSTS"), ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// Starts sending the handler's events to the webhooks that have been registered, in the background until the context is cancelled
+func (h *FriendsHandler) DeliverWebhooks(ctx context.Context) {
+	dispatcher := &models.WebhookDispatcher{
+		DB:          h.DB,
+		Client:      models.NewWebhookClient(webhookTimeout, webhookAllowedHosts()),
+		MaxAttempts: webhookMaxAttempts(),
+		RetryDelay:  webhookRetryDelay(),
+	}
+	dispatcher.Start(ctx, h.Events)
+}
+
+// Works out the webhook from the URL. Responds with an error and returns false if it isn't valid
+func webhookIDParam(c *gin.Context) (int64, bool) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		respondError(c, http.StatusBadRequest, errors.New("webhook ID must be a number"))
+		return 0, false
+	}
+	return id, true
+}
+
+// GET /webhooks
+func (h *FriendsHandler) GetWebhooks(c *gin.Context) {
+	webhooks, err := models.ListWebhooks(h.DB)
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	// Secrets are only shown once, when the webhook is created
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	c.JSON(http.StatusOK, webhooks)
+}
+
+// GET /webhooks/:id
+func (h *FriendsHandler) GetWebhook(c *gin.Context) {
+	id, ok := webhookIDParam(c)
+	if !ok {
+		return
+	}
+
+	webhook, err := models.GetWebhook(h.DB, id)
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	webhook.Secret = ""
+	c.JSON(http.StatusOK, webhook)
+}
+
+// POST /webhooks
+// Registers a URL to be sent the events listed. The response includes the secret the payloads are signed with,
+// which is the only time it's shown. URLs on this machine or a private network have to be in WEBHOOK_ALLOWED_HOSTS
+func (h *FriendsHandler) PostWebhook(c *gin.Context) {
+	var webhook models.Webhook
+	if err := c.ShouldBindJSON(&webhook); err != nil {
+		respondError(c, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := models.CheckWebhookHost(c.Request.Context(), webhook.URL, webhookAllowedHosts()); err != nil {
+		respondError(c, statusForError(err), err)
+		return
+	}
+
+	webhook, err := models.AddWebhook(h.DB, webhook)
+	if err != nil {
+		respondError(c, statusForError(err), err)
+		return
+	}
+
+	c.Header("Location", routePrefix(c)+"/webhooks/"+strconv.FormatInt(webhook.ID, 10))
+	c.JSON(http.StatusCreated, webhook)
+}
+
+// DELETE /webhooks/:id
+func (h *FriendsHandler) DeleteWebhook(c *gin.Context) {
+	id, ok := webhookIDParam(c)
+	if !ok {
+		return
+	}
+
+	err := models.DeleteWebhook(h.DB, id)
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "webhook deleted successfully"})
+}
+
+// GET /webhooks/:id/deliveries?limit=
+// Lists the events sent to the webhook, newest first, with how many attempts each took and how the last one went
+func (h *FriendsHandler) GetWebhookDeliveries(c *gin.Context) {
+	id, ok := webhookIDParam(c)
+	if !ok {
+		return
+	}
+
+	limit := defaultWebhookDeliveries
+	if limitParam := c.Query("limit"); limitParam != "" {
+		var err error
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 {
+			respondError(c, http.StatusBadRequest, errors.New("limit must be a positive number"))
+			return
+		}
+	}
+
+	deliveries, err := models.ListWebhookDeliveries(h.DB, id, limit)
+	if errors.Is(err, models.ErrWebhookNotFound) {
+		respondError(c, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		respondError(c, http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
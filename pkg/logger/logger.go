@@ -80,6 +80,8 @@ func LogMessage(level int, format string, args ...interface{}) {
 	// Log to stdout
 	log.Printf("%s\t%s\t%s\n", ts, levelStr, msg)
 
-	// Log to file
-	fileLogger.Printf("%s\t%s\t%s\n", ts, levelStr, msg)
+	// Log to file. This isn't set up in tests
+	if fileLogger != nil {
+		fileLogger.Printf("%s\t%s\t%s\n", ts, levelStr, msg)
+	}
 }
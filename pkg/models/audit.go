@@ -0,0 +1,199 @@
+package models
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AuditActionCreate  = "create"
+	AuditActionUpdate  = "update"
+	AuditActionDelete  = "delete"
+	AuditActionRestore = "restore"
+	AuditActionPurge   = "purge"
+)
+
+// Actors for changes that don't come from an API request
+const (
+	ActorSystem    = "system"
+	ActorScheduler = "scheduler"
+	ActorImport    = "import"
+	ActorSeed      = "seed"
+)
+
+const createAuditTableSQL = `
+    CREATE TABLE IF NOT EXISTS audit_log (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		friendId TEXT NOT NULL,
+		action TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		changes TEXT NOT NULL,
+		timestamp TEXT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS audit_log_friend ON audit_log (friendId);`
+
+// FieldChange is the value of a field before and after a change
+type FieldChange struct {
+	Before string
+	After  string
+}
+
+// AuditEntry records a single change to a friend
+type AuditEntry struct {
+	ID        int64
+	FriendID  string
+	Action    string
+	Actor     string
+	Changes   map[string]FieldChange
+	Timestamp string
+}
+
+// AuditFilter narrows down the entries returned by GetAuditLog. Blank fields match everything
+type AuditFilter struct {
+	FriendID string
+	Actor    string
+	Action   string
+	Limit    int
+}
+
+// actorDB tags a db handle with who is making the changes so the SQL functions can record it in the audit log
+type actorDB struct {
+	DBTX
+	actor string
+}
+
+// Returns a db handle that records changes made through it against the actor provided
+func WithActor(db DBTX, actor string) DBTX {
+	if tagged, ok := db.(actorDB); ok {
+		db = tagged.DBTX
+	}
+	return actorDB{DBTX: db, actor: actor}
+}
+
+func actorOf(db DBTX) string {
+	if tagged, ok := db.(actorDB); ok {
+		return tagged.actor
+	}
+	return ActorSystem
+}
+
+// Works out which fields changed between before and after. Either can be nil for creates and purges
+func diffFriends(before *Friend, after *Friend) map[string]FieldChange {
+	var b, a Friend
+	if before != nil {
+		b = *before
+	}
+	if after != nil {
+		a = *after
+	}
+
+	changes := make(map[string]FieldChange)
+	compare := func(name string, before string, after string) {
+		if before != after {
+			changes[name] = FieldChange{Before: before, After: after}
+		}
+	}
+
+	compare("Name", b.Name, a.Name)
+	compare("Slug", b.Slug, a.Slug)
+	compare("LastContacted", b.LastContacted, a.LastContacted)
+	compare("Birthday", b.Birthday, a.Birthday)
+	compare("Notes", b.Notes, a.Notes)
+	compare("DeletedAt", b.DeletedAt, a.DeletedAt)
+	compare("Tags", strings.Join(b.Tags, ", "), strings.Join(a.Tags, ", "))
+
+	for _, name := range fieldNames(b.Fields, a.Fields) {
+		compare("Fields."+name, FormatFieldValue(b.Fields[name]), FormatFieldValue(a.Fields[name]))
+	}
+
+	return changes
+}
+
+// Checks if updating current to updated would change anything
+func friendChanged(current Friend, updated Friend) bool {
+	return len(diffFriends(&current, &updated)) > 0
+}
+
+// Appends an entry to the audit log. Nothing is recorded if no fields changed
+func recordAudit(db DBTX, friendID string, action string, before *Friend, after *Friend) error {
+	changes := diffFriends(before, after)
+	if len(changes) == 0 {
+		return nil
+	}
+
+	changesJSON, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	// The changes can contain notes so they get the same protection as the friends table
+	storedChanges, err := fieldCipher.Encrypt(string(changesJSON))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("INSERT INTO audit_log(friendId, action, actor, changes, timestamp) VALUES(?, ?, ?, ?, ?)",
+		friendID, action, actorOf(db), storedChanges, time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Returns the audit log, newest first
+func GetAuditLog(db DBTX, filter AuditFilter) ([]AuditEntry, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	if filter.FriendID != "" {
+		conditions = append(conditions, "friendId = ?")
+		args = append(args, filter.FriendID)
+	}
+	if filter.Actor != "" {
+		conditions = append(conditions, "actor = ?")
+		args = append(args, filter.Actor)
+	}
+	if filter.Action != "" {
+		conditions = append(conditions, "action = ?")
+		args = append(args, filter.Action)
+	}
+
+	query := "SELECT id, friendId, action, actor, changes, timestamp FROM audit_log"
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntry{}
+	for rows.Next() {
+		var (
+			entry   AuditEntry
+			changes string
+		)
+		if err := rows.Scan(&entry.ID, &entry.FriendID, &entry.Action, &entry.Actor, &changes, &entry.Timestamp); err != nil {
+			return nil, err
+		}
+
+		changes, err = fieldCipher.Decrypt(changes)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(changes), &entry.Changes); err != nil {
+			return nil, err
+		}
+
+		entries = append(entries, entry)
+	}
+
+	return entries, rows.Err()
+}
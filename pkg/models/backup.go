@@ -0,0 +1,233 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+
+	"howarethey/pkg/logger"
+)
+
+const (
+	backupPrefix     = "friends-"
+	backupSuffix     = ".db"
+	backupTimeLayout = "20060102-150405"
+)
+
+// Columns a database must have in the friends table before it can be restored
+var requiredFriendsColumns = []string{"id", "name", "lastContacted", "birthday", "notes"}
+
+// BackupInfo describes a backup file in the backup directory
+type BackupInfo struct {
+	Name      string
+	Size      int64
+	CreatedAt string
+}
+
+// Takes a consistent copy of the live db using VACUUM INTO and writes it to the backup directory.
+// This is safe to run while the app is serving requests
+func BackupDB(db *sql.DB, backupDir string) (BackupInfo, error) {
+	if err := os.MkdirAll(backupDir, 0755); err != nil {
+		return BackupInfo{}, err
+	}
+
+	name := backupPrefix + time.Now().Format(backupTimeLayout) + backupSuffix
+	path := filepath.Join(backupDir, name)
+
+	if _, err := os.Stat(path); err == nil {
+		return BackupInfo{}, fmt.Errorf("backup %s already exists", name)
+	}
+
+	if _, err := db.Exec("VACUUM INTO ?", path); err != nil {
+		return BackupInfo{}, err
+	}
+
+	info, err := backupInfo(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Backed up the database to %s", path)
+	return info, nil
+}
+
+// Lists the backups in the backup directory, newest first
+func ListBackups(backupDir string) ([]BackupInfo, error) {
+	backups := []BackupInfo{}
+
+	entries, err := os.ReadDir(backupDir)
+	if os.IsNotExist(err) {
+		return backups, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() || !IsBackupName(entry.Name()) {
+			continue
+		}
+
+		info, err := backupInfo(filepath.Join(backupDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		backups = append(backups, info)
+	}
+
+	// The timestamp in the name sorts chronologically
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].Name > backups[j].Name
+	})
+
+	return backups, nil
+}
+
+// Deletes all but the newest keep backups. Returns the number of backups deleted
+func PruneBackups(backupDir string, keep int) (int, error) {
+	backups, err := ListBackups(backupDir)
+	if err != nil {
+		return 0, err
+	}
+
+	if keep < 1 || len(backups) <= keep {
+		return 0, nil
+	}
+
+	deleted := 0
+	for _, backup := range backups[keep:] {
+		if err := os.Remove(filepath.Join(backupDir, backup.Name)); err != nil {
+			return deleted, err
+		}
+		logger.LogMessage(logger.LogLevelInfo, "Deleted old backup %s", backup.Name)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// Checks the name is one produced by BackupDB. Used to stop paths escaping the backup directory
+func IsBackupName(name string) bool {
+	return name == filepath.Base(name) && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupSuffix)
+}
+
+// Checks the file is a healthy SQLite database with a usable friends table
+func ValidateBackup(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+
+	db, err := sql.Open("sqlite3", "file:"+path+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var result string
+	if err := db.QueryRow("PRAGMA integrity_check").Scan(&result); err != nil {
+		return fmt.Errorf("not a valid database: %w", err)
+	}
+	if result != "ok" {
+		return fmt.Errorf("integrity check failed: %s", result)
+	}
+
+	for _, column := range requiredFriendsColumns {
+		exists, err := columnExists(db, "friends", column)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("friends table is missing the %s column", column)
+		}
+	}
+
+	return nil
+}
+
+// Validates the backup at path and copies it over the live db using SQLite's backup API.
+// Any columns added since the backup was taken are migrated in afterwards
+func RestoreDB(db *sql.DB, path string) error {
+	if err := ValidateBackup(path); err != nil {
+		return err
+	}
+
+	if err := copyDB(db, path); err != nil {
+		return err
+	}
+
+	if err := CreateTables(db); err != nil {
+		return err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Restored the database from %s", path)
+	return nil
+}
+
+// Copies every page of the SQLite file at srcPath over the db using the online backup API
+func copyDB(db *sql.DB, srcPath string) error {
+	srcDB, err := sql.Open("sqlite3", "file:"+srcPath+"?mode=ro")
+	if err != nil {
+		return err
+	}
+	defer srcDB.Close()
+
+	ctx := context.Background()
+
+	srcConn, err := srcDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+
+	destConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+
+	err = destConn.Raw(func(destDriverConn interface{}) error {
+		return srcConn.Raw(func(srcDriverConn interface{}) error {
+			dest, ok := destDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("database is not a SQLite connection")
+			}
+			src, ok := srcDriverConn.(*sqlite3.SQLiteConn)
+			if !ok {
+				return errors.New("backup is not a SQLite connection")
+			}
+
+			backup, err := dest.Backup("main", src, "main")
+			if err != nil {
+				return err
+			}
+
+			if _, err := backup.Step(-1); err != nil {
+				backup.Finish() //nolint:errcheck
+				return err
+			}
+			return backup.Finish()
+		})
+	})
+	return err
+}
+
+func backupInfo(path string) (BackupInfo, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return BackupInfo{}, err
+	}
+
+	return BackupInfo{
+		Name:      stat.Name(),
+		Size:      stat.Size(),
+		CreatedAt: stat.ModTime().Format(time.RFC3339),
+	}, nil
+}
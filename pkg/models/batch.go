@@ -0,0 +1,225 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"howarethey/pkg/logger"
+)
+
+const (
+	BatchOpCreate = "create"
+	BatchOpUpdate = "update"
+	BatchOpDelete = "delete"
+)
+
+const (
+	// Every operation is saved, or none of them are
+	BatchModeAtomic = "atomic"
+	// Operations that succeed are saved even if others fail
+	BatchModeBestEffort = "bestEffort"
+)
+
+const (
+	BatchStatusCreated = "created"
+	BatchStatusUpdated = "updated"
+	BatchStatusDeleted = "deleted"
+	BatchStatusFailed  = "failed"
+)
+
+// The most operations a single batch can contain
+const MaxBatchOperations = 100
+
+// Batch is a list of changes to friends that are made together in one transaction
+type Batch struct {
+	// BatchModeAtomic or BatchModeBestEffort. Defaults to BatchModeAtomic
+	Mode       string
+	Operations []BatchOperation
+}
+
+// BatchOperation is one change in a batch. Friend is the new friend for creates and a JSON Merge Patch
+// of the friend for updates, i.e. {"LastContacted": "2024-04-17"}. ID is the ID or slug of the friend to update or delete
+type BatchOperation struct {
+	Op     string
+	ID     string          `json:",omitempty"`
+	Friend json.RawMessage `json:",omitempty"`
+}
+
+// BatchResult is the outcome of a single operation. Index is its position in the batch, starting at 0
+type BatchResult struct {
+	Index  int
+	Op     string
+	ID     string `json:",omitempty"`
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// BatchReport summarises a batch. Committed is false if nothing was written to the db,
+// which happens in BatchModeAtomic when any operation fails
+type BatchReport struct {
+	Mode      string
+	Committed bool
+	Succeeded int
+	Failed    int
+	Results   []BatchResult
+}
+
+// Checks the batch's mode and operations before any of them are run
+func ValidateBatch(batch Batch) error {
+	if batch.Mode != "" && batch.Mode != BatchModeAtomic && batch.Mode != BatchModeBestEffort {
+		return fieldError("Mode", "mode must be one of "+BatchModeAtomic+", "+BatchModeBestEffort)
+	}
+
+	if len(batch.Operations) == 0 {
+		return fieldError("Operations", "a batch must contain at least one operation")
+	}
+	if len(batch.Operations) > MaxBatchOperations {
+		return fieldError("Operations", "a batch can't contain more than "+strconv.Itoa(MaxBatchOperations)+" operations")
+	}
+
+	return nil
+}
+
+// Runs the operations in order inside a single transaction, recording them in the audit log against the actor provided.
+// Each operation runs inside its own savepoint so one that fails part way through doesn't leave anything behind.
+// In BatchModeAtomic the transaction is rolled back if any operation fails, and the report says which ones would have worked
+func RunBatch(db *sql.DB, actor string, batch Batch) (BatchReport, error) {
+	if batch.Mode == "" {
+		batch.Mode = BatchModeAtomic
+	}
+	report := BatchReport{Mode: batch.Mode, Results: []BatchResult{}}
+
+	if err := ValidateBatch(batch); err != nil {
+		return report, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for i, operation := range batch.Operations {
+		result := BatchResult{Index: i, Op: operation.Op, ID: operation.ID}
+
+		if _, err := tx.Exec("SAVEPOINT batch_operation"); err != nil {
+			return report, err
+		}
+
+		if err := runBatchOperation(WithActor(tx, actor), operation, &result); err != nil {
+			result.Status = BatchStatusFailed
+			result.Error = err.Error()
+			if _, err := tx.Exec("ROLLBACK TO batch_operation"); err != nil {
+				return report, err
+			}
+			report.Failed++
+		} else {
+			report.Succeeded++
+		}
+
+		if _, err := tx.Exec("RELEASE batch_operation"); err != nil {
+			return report, err
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	if batch.Mode == BatchModeAtomic && report.Failed > 0 {
+		logger.LogMessage(logger.LogLevelInfo, "Batch rolled back. Failed operations: %d", report.Failed)
+		return report, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	report.Committed = true
+
+	logger.LogMessage(logger.LogLevelInfo, "Ran a batch of %d operations. Succeeded: %d, failed: %d",
+		len(batch.Operations), report.Succeeded, report.Failed)
+
+	return report, nil
+}
+
+// Runs a single operation and sets the result's ID and status. Returns an error if the operation failed
+func runBatchOperation(tx DBTX, operation BatchOperation, result *BatchResult) error {
+	switch operation.Op {
+	case BatchOpCreate:
+		var friend Friend
+		if err := json.Unmarshal(operation.Friend, &friend); err != nil {
+			return errors.New("friend is not valid: " + err.Error())
+		}
+		// IDs are always given out by the db
+		friend.ID = ""
+		if err := ValidateFriend(friend); err != nil {
+			return err
+		}
+
+		id, err := insertFriend(tx, friend, "")
+		if err != nil {
+			return err
+		}
+		result.ID = id
+		result.Status = BatchStatusCreated
+		return nil
+	case BatchOpUpdate, BatchOpDelete:
+		current, err := batchFriend(tx, operation.ID)
+		if err != nil {
+			return err
+		}
+		result.ID = current.ID
+
+		if operation.Op == BatchOpDelete {
+			if err := DeleteFriend(tx, *current); err != nil {
+				return err
+			}
+			result.Status = BatchStatusDeleted
+			return nil
+		}
+
+		patched, err := PatchFriend(*current, MergePatchContentType, operation.Friend)
+		if err != nil {
+			return err
+		}
+		if err := ValidateFriend(patched); err != nil {
+			return err
+		}
+		// Tags and custom fields the patch removed are cleared rather than left as they were
+		if patched.Tags == nil {
+			patched.Tags = []string{}
+		}
+		if patched.Fields == nil {
+			patched.Fields = map[string]interface{}{}
+		}
+
+		if err := SqlUpdateFriend(tx, current.ID, &patched); err != nil {
+			return err
+		}
+		result.Status = BatchStatusUpdated
+		return nil
+	}
+
+	return fieldError("Op", "op must be one of "+BatchOpCreate+", "+BatchOpUpdate+", "+BatchOpDelete)
+}
+
+// Finds the friend an update or delete refers to. Friends in the trash can't be changed
+func batchFriend(tx DBTX, idOrSlug string) (*Friend, error) {
+	if idOrSlug == "" {
+		return nil, fieldError("ID", "updates and deletes need the ID of the friend to change")
+	}
+
+	id, err := ResolveFriendID(tx, idOrSlug)
+	if err != nil {
+		return nil, err
+	}
+
+	friend, err := SqlGetFriend(tx, id)
+	if err != nil {
+		return nil, err
+	}
+	if friend.DeletedAt != "" {
+		return nil, ErrFriendNotFound
+	}
+	return friend, nil
+}
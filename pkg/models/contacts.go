@@ -0,0 +1,280 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"net/mail"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"howarethey/pkg/logger"
+)
+
+const (
+	ContactPhone    = "phone"
+	ContactEmail    = "email"
+	ContactSignal   = "signal"
+	ContactWhatsApp = "whatsapp"
+	ContactDiscord  = "discord"
+	ContactAddress  = "address"
+)
+
+// The contact method types that can be saved against a friend, in the order they're listed in errors
+var ContactTypes = []string{ContactPhone, ContactEmail, ContactSignal, ContactWhatsApp, ContactDiscord, ContactAddress}
+
+// The names used for each type in notifications
+var contactTypeNames = map[string]string{
+	ContactPhone:    "Phone",
+	ContactEmail:    "Email",
+	ContactSignal:   "Signal",
+	ContactWhatsApp: "WhatsApp",
+	ContactDiscord:  "Discord",
+	ContactAddress:  "Address",
+}
+
+// ErrContactMethodNotFound is returned when a contact method doesn't exist for the friend
+var ErrContactMethodNotFound = errors.New("contact method not found")
+
+const createContactMethodsTableSQL = `
+    CREATE TABLE IF NOT EXISTS contact_methods (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		friendId INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		value TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT '',
+		preferred INTEGER NOT NULL DEFAULT 0
+    );
+    CREATE INDEX IF NOT EXISTS contact_methods_friend ON contact_methods (friendId);`
+
+// ContactMethod is one way of getting in touch with a friend.
+// Link is worked out from the type and value when it's read so it isn't stored
+type ContactMethod struct {
+	ID        int64
+	FriendID  string
+	Type      string
+	Value     string
+	Label     string `json:",omitempty"`
+	Preferred bool
+	Link      string `json:",omitempty"`
+}
+
+// Checks the contact method has a known type and a value that makes sense for it
+func ValidateContactMethod(method ContactMethod) error {
+	if _, ok := contactTypeNames[method.Type]; !ok {
+		return fieldError("Type", "contact method type must be one of "+strings.Join(ContactTypes, ", "))
+	}
+
+	if strings.TrimSpace(method.Value) == "" {
+		return fieldError("Value", "contact method value must not be blank")
+	}
+
+	switch method.Type {
+	case ContactPhone, ContactSignal, ContactWhatsApp:
+		if phoneDigits(method.Value) == "" {
+			return fieldError("Value", method.Value+" is not a valid phone number")
+		}
+	case ContactEmail:
+		if _, err := mail.ParseAddress(method.Value); err != nil {
+			return fieldError("Value", method.Value+" is not a valid email address")
+		}
+	}
+
+	return nil
+}
+
+// Strips everything but the digits from a phone number, keeping a leading +.
+// Returns blank if the number has anything else in it
+func phoneDigits(number string) string {
+	var digits strings.Builder
+	for i, r := range strings.TrimSpace(number) {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '+' && i == 0:
+			digits.WriteRune(r)
+		case r == ' ' || r == '-' || r == '(' || r == ')' || r == '.':
+		default:
+			return ""
+		}
+	}
+
+	if strings.TrimPrefix(digits.String(), "+") == "" {
+		return ""
+	}
+	return digits.String()
+}
+
+// Returns a link that opens the contact method in the right app, or blank if the channel doesn't support one
+func ContactLink(method ContactMethod) string {
+	switch method.Type {
+	case ContactPhone:
+		return "tel:" + phoneDigits(method.Value)
+	case ContactEmail:
+		return "mailto:" + method.Value
+	case ContactSignal:
+		return "https://signal.me/#p/" + phoneDigits(method.Value)
+	case ContactWhatsApp:
+		return "https://wa.me/" + strings.TrimPrefix(phoneDigits(method.Value), "+")
+	case ContactDiscord:
+		// Only user IDs can be linked to, not usernames
+		if _, err := strconv.ParseUint(method.Value, 10, 64); err == nil {
+			return "https://discord.com/users/" + method.Value
+		}
+	case ContactAddress:
+		return "https://www.openstreetmap.org/search?query=" + url.QueryEscape(method.Value)
+	}
+	return ""
+}
+
+// Describes how to reach the friend for the notification, preferred method first
+func FormatContactMethods(methods []ContactMethod) string {
+	var lines []string
+	for _, method := range methods {
+		line := contactTypeNames[method.Type]
+		if method.Label != "" {
+			line += " (" + method.Label + ")"
+		}
+		line += ": " + method.Value
+		if method.Link != "" && method.Link != "mailto:"+method.Value {
+			line += " " + method.Link
+		}
+		if method.Preferred {
+			line += " (preferred)"
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Lists the friend's contact methods with the preferred method first
+func ListContactMethods(db DBTX, friendID string) ([]ContactMethod, error) {
+	rows, err := db.Query("SELECT id, friendId, type, value, label, preferred FROM contact_methods WHERE friendId = ? ORDER BY preferred DESC, id", friendID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	methods := []ContactMethod{}
+	for rows.Next() {
+		method, err := scanContactMethod(rows)
+		if err != nil {
+			return nil, err
+		}
+		methods = append(methods, method)
+	}
+
+	return methods, rows.Err()
+}
+
+// Gets a single contact method belonging to the friend
+func GetContactMethod(db DBTX, friendID string, id int64) (ContactMethod, error) {
+	row := db.QueryRow("SELECT id, friendId, type, value, label, preferred FROM contact_methods WHERE friendId = ? AND id = ?", friendID, id)
+	method, err := scanContactMethod(row)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ContactMethod{}, ErrContactMethodNotFound
+	}
+	return method, err
+}
+
+func scanContactMethod(row interface{ Scan(...interface{}) error }) (ContactMethod, error) {
+	var method ContactMethod
+	if err := row.Scan(&method.ID, &method.FriendID, &method.Type, &method.Value, &method.Label, &method.Preferred); err != nil {
+		return method, err
+	}
+
+	value, err := fieldCipher.Decrypt(method.Value)
+	if err != nil {
+		return method, err
+	}
+	method.Value = value
+	method.Link = ContactLink(method)
+
+	return method, nil
+}
+
+// Adds a contact method to the friend. If it's preferred, any other preferred method is unset.
+// Returns the saved contact method
+func AddContactMethod(db DBTX, friendID string, method ContactMethod) (ContactMethod, error) {
+	if err := ValidateContactMethod(method); err != nil {
+		return method, err
+	}
+
+	value, err := fieldCipher.Encrypt(strings.TrimSpace(method.Value))
+	if err != nil {
+		return method, err
+	}
+
+	if method.Preferred {
+		if err := clearPreferredContactMethod(db, friendID); err != nil {
+			return method, err
+		}
+	}
+
+	result, err := db.Exec("INSERT INTO contact_methods(friendId, type, value, label, preferred) VALUES(?, ?, ?, ?, ?)",
+		friendID, method.Type, value, method.Label, method.Preferred)
+	if err != nil {
+		return method, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return method, err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Added %s contact method for friend with ID %s", method.Type, friendID)
+	return GetContactMethod(db, friendID, id)
+}
+
+// Replaces the contact method with the ID provided
+func UpdateContactMethod(db DBTX, friendID string, id int64, method ContactMethod) (ContactMethod, error) {
+	if _, err := GetContactMethod(db, friendID, id); err != nil {
+		return method, err
+	}
+
+	if err := ValidateContactMethod(method); err != nil {
+		return method, err
+	}
+
+	value, err := fieldCipher.Encrypt(strings.TrimSpace(method.Value))
+	if err != nil {
+		return method, err
+	}
+
+	if method.Preferred {
+		if err := clearPreferredContactMethod(db, friendID); err != nil {
+			return method, err
+		}
+	}
+
+	_, err = db.Exec("UPDATE contact_methods SET type = ?, value = ?, label = ?, preferred = ? WHERE friendId = ? AND id = ?",
+		method.Type, value, method.Label, method.Preferred, friendID, id)
+	if err != nil {
+		return method, err
+	}
+
+	return GetContactMethod(db, friendID, id)
+}
+
+// Deletes the contact method with the ID provided
+func DeleteContactMethod(db DBTX, friendID string, id int64) error {
+	result, err := db.Exec("DELETE FROM contact_methods WHERE friendId = ? AND id = ?", friendID, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrContactMethodNotFound
+	}
+
+	return nil
+}
+
+func clearPreferredContactMethod(db DBTX, friendID string) error {
+	_, err := db.Exec("UPDATE contact_methods SET preferred = 0 WHERE friendId = ?", friendID)
+	return err
+}
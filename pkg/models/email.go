@@ -0,0 +1,104 @@
+package models
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strings"
+	"time"
+)
+
+// Sends the notification as an email over SMTP with the image attached inline.
+// Configured with SMTP_HOST, SMTP_PORT, SMTP_USERNAME, SMTP_PASSWORD, EMAIL_FROM and EMAIL_TO
+func SendEmailNotification(content string, image *Photo) error {
+	host := os.Getenv("SMTP_HOST")
+	from := os.Getenv("EMAIL_FROM")
+	to := strings.Split(os.Getenv("EMAIL_TO"), ",")
+	if host == "" || from == "" || to[0] == "" {
+		return errors.New("SMTP_HOST, EMAIL_FROM and EMAIL_TO must be set to send emails")
+	}
+
+	port := os.Getenv("SMTP_PORT")
+	if port == "" {
+		port = "587"
+	}
+
+	var auth smtp.Auth
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+
+	for i := range to {
+		to[i] = strings.TrimSpace(to[i])
+	}
+
+	message, err := buildEmail(from, to, content, image)
+	if err != nil {
+		return err
+	}
+
+	return smtp.SendMail(net.JoinHostPort(host, port), auth, from, to, message)
+}
+
+// Builds a multipart email with the content as plain text and the image as an attachment
+func buildEmail(from string, to []string, content string, image *Photo) ([]byte, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+
+	textHeader := textproto.MIMEHeader{}
+	textHeader.Set("Content-Type", "text/plain; charset=utf-8")
+	text, err := form.CreatePart(textHeader)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := text.Write([]byte(content)); err != nil {
+		return nil, err
+	}
+
+	if image != nil {
+		imageHeader := textproto.MIMEHeader{}
+		imageHeader.Set("Content-Type", image.ContentType)
+		imageHeader.Set("Content-Transfer-Encoding", "base64")
+		imageHeader.Set("Content-Disposition", `inline; filename="photo`+photoExtension(image.ContentType)+`"`)
+		part, err := form.CreatePart(imageHeader)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := part.Write([]byte(wrapBase64(image.Data))); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	var message bytes.Buffer
+	message.WriteString("From: " + from + "\r\n")
+	message.WriteString("To: " + strings.Join(to, ", ") + "\r\n")
+	message.WriteString("Subject: HowAreThey\r\n")
+	message.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: multipart/mixed; boundary=" + form.Boundary() + "\r\n\r\n")
+	message.Write(body.Bytes())
+
+	return message.Bytes(), nil
+}
+
+// Base64 encodes the data in lines of 76 characters as email requires
+func wrapBase64(data []byte) string {
+	encoded := base64.StdEncoding.EncodeToString(data)
+
+	var wrapped strings.Builder
+	for len(encoded) > 76 {
+		wrapped.WriteString(encoded[:76] + "\r\n")
+		encoded = encoded[76:]
+	}
+	wrapped.WriteString(encoded)
+	return wrapped.String()
+}
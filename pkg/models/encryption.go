@@ -0,0 +1,256 @@
+package models
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"howarethey/pkg/logger"
+)
+
+// Prefix added to encrypted values so they can be told apart from plaintext written before encryption was turned on
+const encryptedPrefix = "enc:v1:"
+
+// ErrNoEncryptionKey is returned when an encrypted value is read but no key has been set
+var ErrNoEncryptionKey = errors.New("encrypted data found but no encryption key is set")
+
+// FieldCipher encrypts individual column values with AES-GCM
+type FieldCipher struct {
+	aead cipher.AEAD
+}
+
+// The cipher used by the storage layer. Encryption is turned off while this is nil
+var fieldCipher *FieldCipher
+
+func NewFieldCipher(key []byte) (*FieldCipher, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FieldCipher{aead: aead}, nil
+}
+
+// Sets the key used to encrypt sensitive fields. Passing nil turns encryption off
+func SetEncryptionKey(key []byte) error {
+	if key == nil {
+		fieldCipher = nil
+		return nil
+	}
+
+	c, err := NewFieldCipher(key)
+	if err != nil {
+		return err
+	}
+	fieldCipher = c
+	return nil
+}
+
+// Reads a base64 encoded key from the env var provided, or from the file named in the same env var with a _FILE suffix.
+// Returns nil if neither is set
+func LoadEncryptionKey(envVar string) ([]byte, error) {
+	encoded := os.Getenv(envVar)
+
+	if keyFile := os.Getenv(envVar + "_FILE"); encoded == "" && keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(data)
+	}
+
+	encoded = strings.TrimSpace(encoded)
+	if encoded == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("%s must be base64 encoded: %w", envVar, err)
+	}
+	return key, nil
+}
+
+// Encrypts the value. Blank values are left blank
+func (c *FieldCipher) Encrypt(plaintext string) (string, error) {
+	if c == nil || plaintext == "" {
+		return plaintext, nil
+	}
+
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := c.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypts the value. Values without the encrypted prefix are returned as they are
+func (c *FieldCipher) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedPrefix) {
+		return value, nil
+	}
+	if c == nil {
+		return "", ErrNoEncryptionKey
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, encryptedPrefix))
+	if err != nil {
+		return "", err
+	}
+
+	nonceSize := c.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	plaintext, err := c.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", errors.New("failed to decrypt value, the encryption key may be wrong")
+	}
+	return string(plaintext), nil
+}
+
+// Encrypts the sensitive fields of the friend before it is written to the db
+func encryptFriend(friend Friend) (Friend, error) {
+	notes, err := fieldCipher.Encrypt(friend.Notes)
+	if err != nil {
+		return friend, err
+	}
+	friend.Notes = notes
+	return friend, nil
+}
+
+// Decrypts the sensitive fields of a friend read from the db
+func decryptFriend(friend *Friend) error {
+	notes, err := fieldCipher.Decrypt(friend.Notes)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt notes for ID %s: %w", friend.ID, err)
+	}
+	friend.Notes = notes
+	return nil
+}
+
+// Re-encrypts the sensitive fields of every friend with newKey inside a single transaction.
+// oldKey can be nil if the data hasn't been encrypted yet, and newKey can be nil to decrypt everything.
+// Missing tables and columns are created first, since the app may not have opened the db since it was upgraded
+func RotateEncryptionKey(db *sql.DB, oldKey []byte, newKey []byte) (int, error) {
+	var oldCipher, newCipher *FieldCipher
+	var err error
+
+	if err := CreateTables(db); err != nil {
+		return 0, err
+	}
+
+	if oldKey != nil {
+		if oldCipher, err = NewFieldCipher(oldKey); err != nil {
+			return 0, err
+		}
+	}
+	if newKey != nil {
+		if newCipher, err = NewFieldCipher(newKey); err != nil {
+			return 0, err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	count, err := reencryptColumn(tx, "friends", "notes", oldCipher, newCipher)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := reencryptColumn(tx, "contact_methods", "value", oldCipher, newCipher); err != nil {
+		return 0, err
+	}
+
+	if _, err := reencryptColumn(tx, "friend_fields", "value", oldCipher, newCipher); err != nil {
+		return 0, err
+	}
+
+	// The audit log keeps old copies of the notes
+	if _, err := reencryptColumn(tx, "audit_log", "changes", oldCipher, newCipher); err != nil {
+		return 0, err
+	}
+
+	// So do the responses saved for idempotency keys
+	if _, err := reencryptColumn(tx, "idempotency_keys", "body", oldCipher, newCipher); err != nil {
+		return 0, err
+	}
+
+	if _, err := reencryptColumn(tx, "webhooks", "secret", oldCipher, newCipher); err != nil {
+		return 0, err
+	}
+
+	// And the events waiting to be sent to webhooks
+	if _, err := reencryptColumn(tx, "webhook_deliveries", "payload", oldCipher, newCipher); err != nil {
+		return 0, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Re-encrypted %d friends with the new key", count)
+	return count, nil
+}
+
+// Decrypts every value in the column with oldCipher and encrypts it again with newCipher
+func reencryptColumn(tx *sql.Tx, table string, column string, oldCipher *FieldCipher, newCipher *FieldCipher) (int, error) {
+	rows, err := tx.Query("SELECT id, " + column + " FROM " + table)
+	if err != nil {
+		return 0, err
+	}
+
+	valuesByID := make(map[string]string)
+	for rows.Next() {
+		var id, value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		valuesByID[id] = value
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for id, value := range valuesByID {
+		plaintext, err := oldCipher.Decrypt(value)
+		if err != nil {
+			return 0, fmt.Errorf("failed to decrypt %s for %s ID %s: %w", column, table, id, err)
+		}
+
+		reencrypted, err := newCipher.Encrypt(plaintext)
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err := tx.Exec("UPDATE "+table+" SET "+column+" = ? WHERE id = ?", reencrypted, id); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(valuesByID), nil
+}
@@ -0,0 +1,149 @@
+package models
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	EventFriendCreated  = "friend.created"
+	EventFriendUpdated  = "friend.updated"
+	EventFriendDeleted  = "friend.deleted"
+	EventFriendRestored = "friend.restored"
+	// The friend was picked for a reminder and their LastContacted moved on to today
+	EventFriendPicked = "friend.picked"
+	EventBirthday     = "birthday"
+)
+
+// EventTypes lists every type of event that can be published
+var EventTypes = []string{EventFriendCreated, EventFriendUpdated, EventFriendDeleted, EventFriendRestored, EventFriendPicked, EventBirthday}
+
+// Checks if the type is one of EventTypes
+func IsEventType(eventType string) bool {
+	return containsString(EventTypes, eventType)
+}
+
+// How many events a subscriber can fall behind by before they're dropped
+const eventSubscriberBuffer = 64
+
+// Event is something that happened to a friend. Friend is the friend after the change, or as they were before being deleted
+type Event struct {
+	ID        int64
+	Type      string
+	Timestamp string
+	Actor     string `json:",omitempty"`
+	Friend    Friend
+}
+
+// EventBus sends events to everyone subscribed and keeps the most recent ones so subscribers that
+// lost their connection can catch up on what they missed
+type EventBus struct {
+	mu          sync.Mutex
+	lastID      int64
+	history     []Event
+	historySize int
+	subscribers map[chan Event]struct{}
+}
+
+// Creates an event bus that keeps the last historySize events
+func NewEventBus(historySize int) *EventBus {
+	return &EventBus{
+		// IDs carry on from the time the bus was created, so an ID from before a restart is always older than the new events
+		lastID:      time.Now().UnixMilli(),
+		historySize: historySize,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Gives the event an ID and timestamp and sends it to the subscribers. A nil bus drops the event.
+// Subscribers that have fallen too far behind are disconnected instead of holding up everyone else
+func (b *EventBus) Publish(event Event) Event {
+	if b == nil {
+		return event
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.lastID++
+	event.ID = b.lastID
+	event.Timestamp = time.Now().UTC().Format(time.RFC3339)
+
+	b.history = append(b.history, event)
+	if len(b.history) > b.historySize {
+		b.history = b.history[len(b.history)-b.historySize:]
+	}
+
+	for subscriber := range b.subscribers {
+		select {
+		case subscriber <- event:
+		default:
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return event
+}
+
+// Subscribes to new events. If lastEventID is set, the events after it that are still kept are returned to be sent first.
+// The channel is closed if the subscriber falls too far behind, and unsubscribe must be called when they're done
+func (b *EventBus) Subscribe(lastEventID int64) (missed []Event, events <-chan Event, unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if lastEventID > 0 {
+		for _, event := range b.history {
+			if event.ID > lastEventID {
+				missed = append(missed, event)
+			}
+		}
+	}
+
+	subscriber := make(chan Event, eventSubscriberBuffer)
+	b.subscribers[subscriber] = struct{}{}
+
+	unsubscribe = func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subscribers[subscriber]; ok {
+			delete(b.subscribers, subscriber)
+			close(subscriber)
+		}
+	}
+
+	return missed, subscriber, unsubscribe
+}
+
+// Works out the events for the friends that were added, changed or removed between two versions of the friends list
+func FriendsListEvents(before FriendsList, after FriendsList) []Event {
+	previous := make(map[string]Friend, len(before))
+	for _, friend := range before {
+		previous[friend.ID] = friend
+	}
+
+	var events []Event
+	for _, friend := range after {
+		old, ok := previous[friend.ID]
+		delete(previous, friend.ID)
+
+		switch {
+		case !ok && friend.Version > 1:
+			// Friends start at version 1, so a friend that reappears at a later one has come back from the trash
+			events = append(events, Event{Type: EventFriendRestored, Friend: friend})
+		case !ok:
+			events = append(events, Event{Type: EventFriendCreated, Friend: friend})
+		case old.Version != friend.Version || friendChanged(old, friend):
+			events = append(events, Event{Type: EventFriendUpdated, Friend: friend})
+		}
+	}
+
+	// Removed friends are kept in the order they were in
+	for _, friend := range before {
+		if _, ok := previous[friend.ID]; ok {
+			events = append(events, Event{Type: EventFriendDeleted, Friend: friend})
+		}
+	}
+
+	return events
+}
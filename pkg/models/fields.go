@@ -0,0 +1,353 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	FieldTypeText   = "text"
+	FieldTypeDate   = "date"
+	FieldTypeNumber = "number"
+	FieldTypeList   = "list"
+)
+
+// The types a custom field can be declared with
+var FieldTypes = []string{FieldTypeText, FieldTypeDate, FieldTypeNumber, FieldTypeList}
+
+// ErrCustomFieldNotFound is returned when no custom field has been declared with the name requested
+var ErrCustomFieldNotFound = errors.New("custom field not found")
+
+// ErrCustomFieldExists is returned when declaring a custom field with a name that's already taken
+var ErrCustomFieldExists = errors.New("a custom field with that name already exists")
+
+// Field names are used in notification templates so they are kept to lower case letters, numbers and underscores
+var fieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+const createCustomFieldsTablesSQL = `
+    CREATE TABLE IF NOT EXISTS custom_fields (
+		name TEXT PRIMARY KEY,
+		type TEXT NOT NULL,
+		description TEXT NOT NULL DEFAULT ''
+    );
+    CREATE TABLE IF NOT EXISTS friend_fields (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		friendId INTEGER NOT NULL,
+		name TEXT NOT NULL,
+		value TEXT NOT NULL,
+		UNIQUE (friendId, name)
+    );`
+
+// CustomField declares a field that can be stored against every friend
+type CustomField struct {
+	Name        string
+	Type        string
+	Description string `json:",omitempty"`
+}
+
+// Checks the custom field has a usable name and a known type
+func ValidateCustomField(field CustomField) error {
+	if !fieldNamePattern.MatchString(field.Name) {
+		return fieldError("Name", "field names must start with a letter and only contain lower case letters, numbers and underscores. "+field.Name+" is not valid")
+	}
+
+	for _, fieldType := range FieldTypes {
+		if field.Type == fieldType {
+			return nil
+		}
+	}
+	return fieldError("Type", "field type must be one of "+strings.Join(FieldTypes, ", "))
+}
+
+// Lists the custom fields that have been declared, in name order
+func ListCustomFields(db DBTX) ([]CustomField, error) {
+	rows, err := db.Query("SELECT name, type, description FROM custom_fields ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := []CustomField{}
+	for rows.Next() {
+		var field CustomField
+		if err := rows.Scan(&field.Name, &field.Type, &field.Description); err != nil {
+			return nil, err
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, rows.Err()
+}
+
+// Declares a new custom field
+func AddCustomField(db DBTX, field CustomField) error {
+	if err := ValidateCustomField(field); err != nil {
+		return err
+	}
+
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM custom_fields WHERE name = ?", field.Name).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrCustomFieldExists
+	}
+
+	_, err := db.Exec("INSERT INTO custom_fields(name, type, description) VALUES(?, ?, ?)", field.Name, field.Type, field.Description)
+	return err
+}
+
+// Removes the custom field along with the value every friend had for it
+func DeleteCustomField(db DBTX, name string) error {
+	result, err := db.Exec("DELETE FROM custom_fields WHERE name = ?", name)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrCustomFieldNotFound
+	}
+
+	// The friends that had a value for it have changed, so their versions move on
+	if _, err := db.Exec("UPDATE friends SET version = version + 1 WHERE id IN (SELECT friendId FROM friend_fields WHERE name = ?)", name); err != nil {
+		return err
+	}
+
+	_, err = db.Exec("DELETE FROM friend_fields WHERE name = ?", name)
+	return err
+}
+
+// Checks each value against the type its field was declared with and converts it to a standard form:
+// text and date values are strings, numbers are float64 and lists are []string.
+// Fields set to null are left out
+func NormaliseFields(db DBTX, values map[string]interface{}) (map[string]interface{}, error) {
+	if values == nil {
+		return nil, nil
+	}
+
+	definitions, err := ListCustomFields(db)
+	if err != nil {
+		return nil, err
+	}
+	types := make(map[string]string)
+	for _, definition := range definitions {
+		types[definition.Name] = definition.Type
+	}
+
+	normalised := make(map[string]interface{})
+	for name, value := range values {
+		fieldType, ok := types[name]
+		if !ok {
+			return nil, fieldError("Fields."+name, "no custom field called "+name+" has been declared")
+		}
+		if value == nil {
+			continue
+		}
+
+		if normalised[name], err = normaliseFieldValue(fieldType, value); err != nil {
+			return nil, fieldError("Fields."+name, name+" "+err.Error())
+		}
+	}
+
+	return normalised, nil
+}
+
+func normaliseFieldValue(fieldType string, value interface{}) (interface{}, error) {
+	switch fieldType {
+	case FieldTypeText:
+		if text, ok := value.(string); ok {
+			return text, nil
+		}
+		return nil, errors.New("must be text")
+
+	case FieldTypeDate:
+		if date, ok := value.(string); ok && IsValidDate(date) {
+			return date, nil
+		}
+		// Dates in the seed file are decoded as timestamps
+		if date, ok := value.(time.Time); ok {
+			return date.Format("2006-01-02"), nil
+		}
+		return nil, errors.New("must be a date in yyyy-mm-dd format")
+
+	case FieldTypeNumber:
+		switch number := value.(type) {
+		case float64:
+			return number, nil
+		case int:
+			return float64(number), nil
+		case int64:
+			return float64(number), nil
+		}
+		return nil, errors.New("must be a number")
+
+	case FieldTypeList:
+		var list []string
+		switch items := value.(type) {
+		case []string:
+			list = append(list, items...)
+		case []interface{}:
+			for _, item := range items {
+				text, ok := item.(string)
+				if !ok {
+					return nil, errors.New("must be a list of text")
+				}
+				list = append(list, text)
+			}
+		default:
+			return nil, errors.New("must be a list of text")
+		}
+		if list == nil {
+			list = []string{}
+		}
+		return list, nil
+	}
+
+	return nil, errors.New("has an unknown type " + fieldType)
+}
+
+// Formats a normalised value as text for notifications, search and the audit log
+func FormatFieldValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case []string:
+		return strings.Join(v, ", ")
+	}
+	return fmt.Sprint(value)
+}
+
+// Returns the friends with every field matching the value provided. Text matches ignore case,
+// and list fields match if any of their items match
+func FilterByFields(friends FriendsList, values map[string]string) FriendsList {
+	filtered := FriendsList{}
+	for _, friend := range friends {
+		matches := true
+		for name, want := range values {
+			if !fieldMatches(friend.Fields[name], want) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, friend)
+		}
+	}
+	return filtered
+}
+
+func fieldMatches(value interface{}, want string) bool {
+	if list, ok := value.([]string); ok {
+		for _, item := range list {
+			if strings.EqualFold(item, want) {
+				return true
+			}
+		}
+		return false
+	}
+	return value != nil && strings.EqualFold(FormatFieldValue(value), want)
+}
+
+// Lists the names of the fields set in either map, in order
+func fieldNames(a map[string]interface{}, b map[string]interface{}) []string {
+	seen := make(map[string]bool)
+	var names []string
+	for _, values := range []map[string]interface{}{a, b} {
+		for name := range values {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Replaces the friend's custom field values with the values provided. They should already be normalised
+func setFriendFields(db DBTX, friendID string, values map[string]interface{}) error {
+	if _, err := db.Exec("DELETE FROM friend_fields WHERE friendId = ?", friendID); err != nil {
+		return err
+	}
+
+	for name, value := range values {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+
+		// Values can hold personal details like partners' names so they are encrypted along with the notes
+		stored, err := fieldCipher.Encrypt(string(encoded))
+		if err != nil {
+			return err
+		}
+
+		if _, err := db.Exec("INSERT INTO friend_fields(friendId, name, value) VALUES(?, ?, ?)", friendID, name, stored); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Loads the custom field values for every friend, keyed by friend ID. Passing an ID only loads that friend's values
+func loadFriendFields(db DBTX, friendID string) (map[string]map[string]interface{}, error) {
+	query := "SELECT friendId, name, value FROM friend_fields"
+	var args []interface{}
+	if friendID != "" {
+		query += " WHERE friendId = ?"
+		args = append(args, friendID)
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fieldsByFriend := make(map[string]map[string]interface{})
+	for rows.Next() {
+		var id, name, stored string
+		if err := rows.Scan(&id, &name, &stored); err != nil {
+			return nil, err
+		}
+
+		encoded, err := fieldCipher.Decrypt(stored)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt field %s for ID %s: %w", name, id, err)
+		}
+
+		var value interface{}
+		if err := json.Unmarshal([]byte(encoded), &value); err != nil {
+			return nil, err
+		}
+		if items, ok := value.([]interface{}); ok {
+			list := []string{}
+			for _, item := range items {
+				list = append(list, fmt.Sprint(item))
+			}
+			value = list
+		}
+
+		if fieldsByFriend[id] == nil {
+			fieldsByFriend[id] = make(map[string]interface{})
+		}
+		fieldsByFriend[id][name] = value
+	}
+
+	return fieldsByFriend, rows.Err()
+}
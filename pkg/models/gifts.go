@@ -0,0 +1,250 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	GiftStatusIdea   = "idea"
+	GiftStatusBought = "bought"
+	GiftStatusGiven  = "given"
+)
+
+// The statuses a gift idea moves through
+var GiftStatuses = []string{GiftStatusIdea, GiftStatusBought, GiftStatusGiven}
+
+// ErrGiftIdeaNotFound is returned when a gift idea doesn't exist for the friend
+var ErrGiftIdeaNotFound = errors.New("gift idea not found")
+
+// ErrGiftAlreadyGiven is returned when saving a gift idea that has already been given to the friend
+var ErrGiftAlreadyGiven = errors.New("this gift has already been given to them")
+
+const createGiftIdeasTableSQL = `
+    CREATE TABLE IF NOT EXISTS gift_ideas (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		friendId INTEGER NOT NULL,
+		idea TEXT NOT NULL,
+		link TEXT NOT NULL DEFAULT '',
+		price REAL NOT NULL DEFAULT 0,
+		status TEXT NOT NULL,
+		yearGiven INTEGER NOT NULL DEFAULT 0
+    );
+    CREATE INDEX IF NOT EXISTS gift_ideas_friend ON gift_ideas (friendId);`
+
+// GiftIdea is a present for a friend. YearGiven is only set once the status is given
+type GiftIdea struct {
+	ID        int64
+	FriendID  string
+	Idea      string
+	Link      string  `json:",omitempty"`
+	Price     float64 `json:",omitempty"`
+	Status    string
+	YearGiven int `json:",omitempty"`
+}
+
+// Checks the gift idea is complete. Status defaults to idea, and YearGiven to this year once it's been given
+func ValidateGiftIdea(gift GiftIdea) (GiftIdea, error) {
+	gift.Idea = strings.TrimSpace(gift.Idea)
+	if gift.Idea == "" {
+		return gift, fieldError("Idea", "idea must not be blank")
+	}
+
+	if gift.Link != "" {
+		if link, err := url.Parse(gift.Link); err != nil || link.Host == "" {
+			return gift, fieldError("Link", gift.Link+" is not a valid link")
+		}
+	}
+
+	if gift.Price < 0 {
+		return gift, fieldError("Price", "price must not be negative")
+	}
+
+	if gift.Status == "" {
+		gift.Status = GiftStatusIdea
+	}
+
+	switch gift.Status {
+	case GiftStatusIdea, GiftStatusBought:
+		if gift.YearGiven != 0 {
+			return gift, fieldError("YearGiven", "year given can only be set once the gift has been given")
+		}
+	case GiftStatusGiven:
+		if gift.YearGiven == 0 {
+			gift.YearGiven = time.Now().Year()
+		}
+	default:
+		return gift, fieldError("Status", "status must be one of "+strings.Join(GiftStatuses, ", "))
+	}
+
+	return gift, nil
+}
+
+const giftIdeaColumns = "id, friendId, idea, link, price, status, yearGiven"
+
+func scanGiftIdea(row interface{ Scan(...interface{}) error }) (GiftIdea, error) {
+	var gift GiftIdea
+	err := row.Scan(&gift.ID, &gift.FriendID, &gift.Idea, &gift.Link, &gift.Price, &gift.Status, &gift.YearGiven)
+	return gift, err
+}
+
+// Lists the friend's gift ideas in the order they were added
+func ListGiftIdeas(db DBTX, friendID string) ([]GiftIdea, error) {
+	rows, err := db.Query("SELECT "+giftIdeaColumns+" FROM gift_ideas WHERE friendId = ? ORDER BY id", friendID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	gifts := []GiftIdea{}
+	for rows.Next() {
+		gift, err := scanGiftIdea(rows)
+		if err != nil {
+			return nil, err
+		}
+		gifts = append(gifts, gift)
+	}
+
+	return gifts, rows.Err()
+}
+
+// Loads the gift ideas that haven't been given yet for every friend, keyed by friend ID
+func OutstandingGiftIdeas(db DBTX) (map[string][]GiftIdea, error) {
+	rows, err := db.Query("SELECT "+giftIdeaColumns+" FROM gift_ideas WHERE status != ? ORDER BY id", GiftStatusGiven)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	giftsByFriend := make(map[string][]GiftIdea)
+	for rows.Next() {
+		gift, err := scanGiftIdea(rows)
+		if err != nil {
+			return nil, err
+		}
+		giftsByFriend[gift.FriendID] = append(giftsByFriend[gift.FriendID], gift)
+	}
+
+	return giftsByFriend, rows.Err()
+}
+
+// Gets a single gift idea belonging to the friend
+func GetGiftIdea(db DBTX, friendID string, id int64) (GiftIdea, error) {
+	gift, err := scanGiftIdea(db.QueryRow("SELECT "+giftIdeaColumns+" FROM gift_ideas WHERE friendId = ? AND id = ?", friendID, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return gift, ErrGiftIdeaNotFound
+	}
+	return gift, err
+}
+
+// Adds a gift idea for the friend. Returns ErrGiftAlreadyGiven if they've already been given the same gift
+func AddGiftIdea(db DBTX, friendID string, gift GiftIdea) (GiftIdea, error) {
+	gift, err := ValidateGiftIdea(gift)
+	if err != nil {
+		return gift, err
+	}
+
+	if err := checkNotAlreadyGiven(db, friendID, 0, gift.Idea); err != nil {
+		return gift, err
+	}
+
+	result, err := db.Exec("INSERT INTO gift_ideas(friendId, idea, link, price, status, yearGiven) VALUES(?, ?, ?, ?, ?, ?)",
+		friendID, gift.Idea, gift.Link, gift.Price, gift.Status, gift.YearGiven)
+	if err != nil {
+		return gift, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return gift, err
+	}
+	return GetGiftIdea(db, friendID, id)
+}
+
+// Replaces the gift idea with the ID provided
+func UpdateGiftIdea(db DBTX, friendID string, id int64, gift GiftIdea) (GiftIdea, error) {
+	if _, err := GetGiftIdea(db, friendID, id); err != nil {
+		return gift, err
+	}
+
+	gift, err := ValidateGiftIdea(gift)
+	if err != nil {
+		return gift, err
+	}
+
+	if err := checkNotAlreadyGiven(db, friendID, id, gift.Idea); err != nil {
+		return gift, err
+	}
+
+	_, err = db.Exec("UPDATE gift_ideas SET idea = ?, link = ?, price = ?, status = ?, yearGiven = ? WHERE friendId = ? AND id = ?",
+		gift.Idea, gift.Link, gift.Price, gift.Status, gift.YearGiven, friendID, id)
+	if err != nil {
+		return gift, err
+	}
+	return GetGiftIdea(db, friendID, id)
+}
+
+// Deletes the gift idea with the ID provided
+func DeleteGiftIdea(db DBTX, friendID string, id int64) error {
+	result, err := db.Exec("DELETE FROM gift_ideas WHERE friendId = ? AND id = ?", friendID, id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrGiftIdeaNotFound
+	}
+	return nil
+}
+
+// Checks the friend hasn't already been given the gift, ignoring the gift idea being updated
+func checkNotAlreadyGiven(db DBTX, friendID string, excludeID int64, idea string) error {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM gift_ideas WHERE friendId = ? AND id != ? AND status = ? AND idea = ? COLLATE NOCASE",
+		friendID, excludeID, GiftStatusGiven, idea).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrGiftAlreadyGiven
+	}
+	return nil
+}
+
+// Describes the gift ideas for the birthday notification, i.e. "Lego (40) https://example.com"
+func FormatGiftIdeas(gifts []GiftIdea) string {
+	descriptions := make([]string, len(gifts))
+	for i, gift := range gifts {
+		description := gift.Idea
+		if gift.Price > 0 {
+			description += " (" + strconv.FormatFloat(gift.Price, 'f', -1, 64) + ")"
+		}
+		if gift.Link != "" {
+			description += " " + gift.Link
+		}
+		if gift.Status == GiftStatusBought {
+			description += " [already bought]"
+		}
+		descriptions[i] = description
+	}
+	return strings.Join(descriptions, ", ")
+}
+
+// Lists the gift ideas for each friend with a birthday, one friend per line
+func giftIdeasContent(friends FriendsList, giftIdeas map[string][]GiftIdea) string {
+	var content string
+	for _, friend := range friends {
+		if gifts := giftIdeas[friend.ID]; len(gifts) > 0 {
+			content += "\nGift ideas for " + friend.Name + ": " + FormatGiftIdeas(gifts)
+		}
+	}
+	return content
+}
@@ -0,0 +1,108 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const createIdempotencyKeysTableSQL = `
+    CREATE TABLE IF NOT EXISTS idempotency_keys (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		key TEXT NOT NULL,
+		actor TEXT NOT NULL,
+		fingerprint TEXT NOT NULL,
+		status INTEGER NOT NULL DEFAULT 0,
+		header TEXT NOT NULL DEFAULT '',
+		body TEXT NOT NULL DEFAULT '',
+		createdAt TEXT NOT NULL
+    );
+    CREATE UNIQUE INDEX IF NOT EXISTS idempotency_keys_key ON idempotency_keys (actor, key);`
+
+// ErrIdempotencyKeyInUse is returned when the first request with a key hasn't finished yet
+var ErrIdempotencyKeyInUse = errors.New("a request with this Idempotency-Key is still being processed")
+
+// ErrIdempotencyKeyReused is returned when a key is sent again with a different request
+var ErrIdempotencyKeyReused = errors.New("this Idempotency-Key was already used for a different request")
+
+// StoredResponse is the response sent the first time a request was made with an idempotency key
+type StoredResponse struct {
+	Status int
+	Header map[string]string
+	Body   []byte
+}
+
+// Claims the key for a request so it can be run. Keys belong to the actor that sent them, and fingerprint identifies the request
+// so a key can't be reused for something else. If the key was already used for the same request after since, the response
+// that was sent then is returned instead and the request shouldn't be run again. Claims made before claimedSince that never
+// saved a response are treated as abandoned, i.e. the app stopped part way through the request, so the key can be claimed again
+func ClaimIdempotencyKey(db DBTX, key string, actor string, fingerprint string, since time.Time, claimedSince time.Time) (*StoredResponse, error) {
+	// Keys older than the window can be used again
+	if _, err := db.Exec("DELETE FROM idempotency_keys WHERE createdAt < ? OR (status = 0 AND createdAt < ?)",
+		since.UTC().Format(time.RFC3339), claimedSince.UTC().Format(time.RFC3339)); err != nil {
+		return nil, err
+	}
+
+	result, err := db.Exec("INSERT OR IGNORE INTO idempotency_keys(key, actor, fingerprint, createdAt) VALUES(?, ?, ?, ?)",
+		key, actor, fingerprint, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return nil, err
+	}
+	if count, err := result.RowsAffected(); err != nil || count == 1 {
+		return nil, err
+	}
+
+	var (
+		storedFingerprint string
+		header            string
+		body              string
+		response          StoredResponse
+	)
+	err = db.QueryRow("SELECT fingerprint, status, header, body FROM idempotency_keys WHERE actor = ? AND key = ?", actor, key).
+		Scan(&storedFingerprint, &response.Status, &header, &body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.Status == 0 {
+		return nil, ErrIdempotencyKeyInUse
+	}
+	if storedFingerprint != fingerprint {
+		return nil, ErrIdempotencyKeyReused
+	}
+
+	if err := json.Unmarshal([]byte(header), &response.Header); err != nil {
+		return nil, err
+	}
+	body, err = fieldCipher.Decrypt(body)
+	if err != nil {
+		return nil, err
+	}
+	response.Body = []byte(body)
+
+	return &response, nil
+}
+
+// Saves the response to the request that claimed the key so it can be sent again to retries
+func SaveIdempotentResponse(db DBTX, key string, actor string, response StoredResponse) error {
+	header, err := json.Marshal(response.Header)
+	if err != nil {
+		return err
+	}
+
+	// Responses can contain notes so they get the same protection as the friends table
+	body, err := fieldCipher.Encrypt(string(response.Body))
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec("UPDATE idempotency_keys SET status = ?, header = ?, body = ? WHERE actor = ? AND key = ?",
+		response.Status, string(header), body, actor, key)
+	return err
+}
+
+// Lets go of a key without saving a response, i.e. when the request failed on the server, so it can be retried
+func ReleaseIdempotencyKey(db DBTX, key string, actor string) error {
+	_, err := db.Exec("DELETE FROM idempotency_keys WHERE actor = ? AND key = ?", actor, key)
+	return err
+}
@@ -8,31 +8,104 @@ import (
 	"fmt"
 	"howarethey/pkg/logger"
 	"math/rand"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"os"
+	"strconv"
 	"strings"
 	"time"
 )
 
 // DiscordWebhookPayload defines the JSON structure for the webhook payload
 type DiscordWebhookPayload struct {
-	Username *string `json:"username,omitempty"`
-	Content  *string `json:"content"`
+	Username *string        `json:"username,omitempty"`
+	Content  *string        `json:"content"`
+	Embeds   []DiscordEmbed `json:"embeds,omitempty"`
 }
 
+// DiscordEmbed is used to show the friend's photo under the message
+type DiscordEmbed struct {
+	Image *DiscordEmbedImage `json:"image,omitempty"`
+}
+
+type DiscordEmbedImage struct {
+	URL string `json:"url"`
+}
+
+// Friend is someone to keep in touch with. Slug is a unique, URL-safe name for them that can be used anywhere an ID can, i.e. sam-smith.
+// Version goes up every time the friend is changed and is sent as the friend's ETag rather than in the JSON
 type Friend struct {
 	ID            string
 	Name          string
+	Slug          string `json:",omitempty"`
 	LastContacted string
 	Birthday      string
 	Notes         string
+	DeletedAt     string                 `json:",omitempty"`
+	Tags          []string               `json:",omitempty"`
+	Fields        map[string]interface{} `json:",omitempty"`
+	Version       int                    `json:"-"`
 }
 
 type FriendsList []Friend
 
-// Builds the list from the yaml file specified
-func BuildFriendsList(db *sql.DB) (FriendsList, error) {
-	rows, err := db.Query("SELECT id, name, lastContacted, birthday, notes FROM friends")
+// ErrFriendNotFound is returned when no friend matches the ID requested
+var ErrFriendNotFound = errors.New("friend not found")
+
+// ErrVersionMismatch is returned when a friend was changed by someone else after the version the change was based on
+var ErrVersionMismatch = errors.New("friend has been changed since it was fetched")
+
+// DBTX is satisfied by both *sql.DB and *sql.Tx so the SQL functions can run inside a transaction
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Runs fn inside a transaction so either all of its changes are made or none are. If db is already a transaction,
+// i.e. in a batch, fn runs inside a savepoint instead. Changes are still recorded against db's actor
+func withTransaction(db DBTX, fn func(tx DBTX) error) error {
+	base := db
+	tagged, hasActor := db.(actorDB)
+	if hasActor {
+		base = tagged.DBTX
+	}
+
+	conn, ok := base.(*sql.DB)
+	if !ok {
+		if _, err := base.Exec("SAVEPOINT friend_change"); err != nil {
+			return err
+		}
+		if err := fn(db); err != nil {
+			base.Exec("ROLLBACK TO friend_change") //nolint:errcheck
+			base.Exec("RELEASE friend_change")     //nolint:errcheck
+			return err
+		}
+		_, err := base.Exec("RELEASE friend_change")
+		return err
+	}
+
+	tx, err := conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	var txDB DBTX = tx
+	if hasActor {
+		txDB = WithActor(tx, tagged.actor)
+	}
+	if err := fn(txDB); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Builds the list from the friends table in the db. Friends in the trash are left out
+func BuildFriendsList(db DBTX) (FriendsList, error) {
+	rows, err := db.Query("SELECT " + friendColumns + " FROM friends WHERE deletedAt = ''")
 	if err != nil {
 		logger.LogMessage(logger.LogLevelFatal, "Failed to select from db: %v", err)
 		return nil, err
@@ -41,8 +114,8 @@ func BuildFriendsList(db *sql.DB) (FriendsList, error) {
 
 	var friends FriendsList
 	for rows.Next() {
-		var f Friend
-		if err := rows.Scan(&f.ID, &f.Name, &f.LastContacted, &f.Birthday, &f.Notes); err != nil {
+		f, err := scanFriend(rows)
+		if err != nil {
 			logger.LogMessage(logger.LogLevelFatal, "Failed to scan: %v", err)
 			return nil, err
 		}
@@ -54,6 +127,22 @@ func BuildFriendsList(db *sql.DB) (FriendsList, error) {
 		return nil, err
 	}
 
+	tagsByFriend, err := loadFriendTags(db)
+	if err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "Failed to load tags: %v", err)
+		return nil, err
+	}
+	fieldsByFriend, err := loadFriendFields(db, "")
+	if err != nil {
+		logger.LogMessage(logger.LogLevelFatal, "Failed to load custom fields: %v", err)
+		return nil, err
+	}
+
+	for i := range friends {
+		friends[i].Tags = tagsByFriend[friends[i].ID]
+		friends[i].Fields = fieldsByFriend[friends[i].ID]
+	}
+
 	return friends, nil
 }
 
@@ -81,8 +170,9 @@ func CalculateWeight(lastContacted string, currDate time.Time) (int, error) {
 	return days, nil
 }
 
-// Check all the friends birthdays to see if it's today
-func CheckBirthdays(friends FriendsList, todaysDate time.Time) FriendsList {
+// Check all the friends birthdays to see if it's today.
+// Any gift ideas that haven't been given yet are added to the notification, keyed by friend ID. giftIdeas can be nil
+func CheckBirthdays(friends FriendsList, todaysDate time.Time, giftIdeas map[string][]GiftIdea) FriendsList {
 	var (
 		bdayList     FriendsList
 		friendsNames string
@@ -120,7 +210,7 @@ func CheckBirthdays(friends FriendsList, todaysDate time.Time) FriendsList {
 
 		logger.LogMessage(logger.LogLevelInfo, content)
 
-		SendNotification(content)
+		SendNotification(content + giftIdeasContent(bdayList, giftIdeas))
 
 		return bdayList
 	} else {
@@ -132,42 +222,95 @@ func CheckBirthdays(friends FriendsList, todaysDate time.Time) FriendsList {
 
 		logger.LogMessage(logger.LogLevelInfo, content)
 
-		SendNotification(content)
+		SendNotification(content + giftIdeasContent(bdayList, giftIdeas))
 
 		return bdayList
 	}
 }
 
-// Delete a friend from the db based on the ID provided
-func DeleteFriend(db *sql.DB, friend Friend) error {
-	stmt, err := db.Prepare("DELETE FROM friends WHERE id = ?")
+// Moves a friend to the trash based on the ID provided.
+// They can be restored with RestoreFriend until they are purged
+func DeleteFriend(db DBTX, friend Friend) error {
+	return DeleteFriendAtVersion(db, friend, 0)
+}
+
+// Moves a friend to the trash like DeleteFriend, but only if they are still at the version provided.
+// Returns ErrVersionMismatch if they have been changed since. A version of 0 deletes them whatever their version
+func DeleteFriendAtVersion(db DBTX, friend Friend, version int) error {
+	stmt, err := db.Prepare("UPDATE friends SET deletedAt = ?, version = version + 1 WHERE id = ? AND deletedAt = '' AND (? = 0 OR version = ?)")
 	if err != nil {
 		return err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(friend.ID)
+	deletedAt := time.Now().UTC().Format(time.RFC3339)
+
+	res, err := stmt.Exec(deletedAt, friend.ID, version, version)
 	if err != nil {
 		return err
 	}
 
-	logger.LogMessage(logger.LogLevelInfo, friend.Name+" (ID:"+friend.ID+") deleted successfully")
+	if count, err := res.RowsAffected(); err == nil && count == 0 {
+		return missingOrChanged(db, friend.ID, version)
+	}
+
+	deleted := friend
+	deleted.DeletedAt = deletedAt
+	if err := recordAudit(db, friend.ID, AuditActionDelete, &friend, &deleted); err != nil {
+		return err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, friend.Name+" (ID:"+friend.ID+") moved to the trash")
 	return nil
 }
 
-// Returns the friend based on the ID provided
+// Checks the date is in the yyyy-mm-dd format
+func IsValidDate(dateStr string) bool {
+	layout := "2006-01-02"
+	_, err := time.Parse(layout, dateStr)
+	return err == nil
+}
+
+// Validates the fields of a friend before it gets written to the db.
+// LastContacted and Birthday are optional but must be valid dates if they are set
+func ValidateFriend(friend Friend) error {
+	if friend.Name == "" {
+		return fieldError("Name", "name must not be blank")
+	}
+
+	if friend.LastContacted != "" && !IsValidDate(friend.LastContacted) {
+		return fieldError("LastContacted", "last Contacted date must be in yyyy-mm-dd format. "+friend.LastContacted+" does not match")
+	}
+
+	if friend.Birthday != "" && !IsValidDate(friend.Birthday) {
+		return fieldError("Birthday", "birthday must be in yyyy-mm-dd format. "+friend.Birthday+" does not match")
+	}
+
+	if _, err := NormaliseTags(friend.Tags); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// Returns the friend based on the ID or slug provided
 func GetFriendByID(id string, friends FriendsList) (*Friend, error) {
 	for _, friend := range friends {
-		if friend.ID == id {
+		if friend.ID == id || (friend.Slug != "" && friend.Slug == id) {
 			return &friend, nil
 		}
 	}
 	return nil, errors.New("friend not found")
 }
 
-// Returns the friend based on the name provided
-// This function replaces whitespace with hyphens and makes it lower case
+// Returns the friend based on the slug provided.
+// Names with whitespace replaced with hyphens and made lower case are still matched so older links keep working
 func GetFriendByName(name string, friends FriendsList) (*Friend, error) {
+	for _, friend := range friends {
+		if friend.Slug != "" && friend.Slug == name {
+			return &friend, nil
+		}
+	}
 	for _, friend := range friends {
 		lowercased := strings.ToLower(friend.Name)
 		hyphenated := strings.ReplaceAll(lowercased, " ", "-")
@@ -227,17 +370,31 @@ func PickRandomFriend(friends FriendsList) (Friend, error) {
 // Notifications
 
 func SendNotification(content string) {
+	SendNotificationWithImage(content, nil)
+}
+
+// Sends the notification with an image attached, i.e. the friend's photo. image can be nil.
+// Services that don't support images just get the content
+func SendNotificationWithImage(content string, image *Photo) {
 	notification_svc := os.Getenv("NOTIFICATION_SERVICE")
 	url := os.Getenv("WEBHOOK_URL")
 
+	// Emails are sent over SMTP so they don't need a webhook
+	if notification_svc == "EMAIL" {
+		if err := SendEmailNotification(content, image); err != nil {
+			logger.LogMessage(logger.LogLevelWarn, "Failed to send the email: %s", err)
+		}
+		return
+	}
+
 	if url != "" {
 		switch notification_svc {
 		case "DISCORD":
-			SendDiscordNotification(url, content)
+			SendDiscordNotification(url, content, image)
 		case "TELEGRAM":
 			// Logic for Telegram notifications
 		case "NTFY":
-			SendNtfyNotification(url, content)
+			SendNtfyNotification(url, content, image)
 		default:
 			// Default logic or error handling
 		}
@@ -246,7 +403,7 @@ func SendNotification(content string) {
 	}
 }
 
-func SendDiscordNotification(url string, content string) {
+func SendDiscordNotification(url string, content string, image *Photo) {
 	var username = "HowAreThey"
 
 	// Create the payload
@@ -255,25 +412,85 @@ func SendDiscordNotification(url string, content string) {
 		Username: &username,
 	}
 
-	// Marshal the payload to JSON
+	if image == nil {
+		// Marshal the payload to JSON
+		payloadBytes, err := json.Marshal(payload)
+		if err != nil {
+			logger.LogMessage(logger.LogLevelWarn, "Failed to marshal the payload: %s", err)
+		}
+
+		// Send the POST request
+		resp, err := http.Post(url, "application/json", bytes.NewBuffer(payloadBytes))
+		if err != nil {
+			logger.LogMessage(logger.LogLevelWarn, "Failed to send the request: %s", err)
+			return
+		}
+		defer resp.Body.Close()
+		return
+	}
+
+	// The image is uploaded with the message and shown in an embed
+	fileName := "photo" + photoExtension(image.ContentType)
+	payload.Embeds = []DiscordEmbed{{Image: &DiscordEmbedImage{URL: "attachment://" + fileName}}}
+
 	payloadBytes, err := json.Marshal(payload)
 	if err != nil {
 		logger.LogMessage(logger.LogLevelWarn, "Failed to marshal the payload: %s", err)
+		return
 	}
 
-	// Send the POST request
-	resp, err := http.Post(url, "application/json", bytes.NewBuffer(payloadBytes))
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	if err := form.WriteField("payload_json", string(payloadBytes)); err != nil {
+		logger.LogMessage(logger.LogLevelWarn, "Failed to build the request: %s", err)
+		return
+	}
+
+	header := textproto.MIMEHeader{}
+	header.Set("Content-Disposition", `form-data; name="files[0]"; filename="`+fileName+`"`)
+	header.Set("Content-Type", image.ContentType)
+	part, err := form.CreatePart(header)
+	if err == nil {
+		_, err = part.Write(image.Data)
+	}
+	if err == nil {
+		err = form.Close()
+	}
+	if err != nil {
+		logger.LogMessage(logger.LogLevelWarn, "Failed to build the request: %s", err)
+		return
+	}
+
+	resp, err := http.Post(url, form.FormDataContentType(), &body)
 	if err != nil {
 		logger.LogMessage(logger.LogLevelWarn, "Failed to send the request: %s", err)
+		return
 	}
 	defer resp.Body.Close()
 }
 
-func SendNtfyNotification(url string, content string) {
-	// Send the POST request
-	resp, err := http.Post(url, "text/plain", bytes.NewBufferString(content))
+func SendNtfyNotification(url string, content string, image *Photo) {
+	var (
+		resp *http.Response
+		err  error
+	)
+
+	if image == nil {
+		// Send the POST request
+		resp, err = http.Post(url, "text/plain", bytes.NewBufferString(content))
+	} else {
+		// Ntfy takes attachments as the body, so the message goes in a header with its new lines escaped
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPut, url, bytes.NewReader(image.Data))
+		if err == nil {
+			req.Header.Set("Filename", "photo"+photoExtension(image.ContentType))
+			req.Header.Set("Message", strings.ReplaceAll(content, "\n", "\\n"))
+			resp, err = http.DefaultClient.Do(req)
+		}
+	}
 	if err != nil {
 		logger.LogMessage(logger.LogLevelWarn, "Failed to send the request: %s", err)
+		return
 	}
 	defer resp.Body.Close()
 
@@ -282,6 +499,13 @@ func SendNtfyNotification(url string, content string) {
 	}
 }
 
+func photoExtension(contentType string) string {
+	if contentType == "image/png" {
+		return ".png"
+	}
+	return ".jpg"
+}
+
 func UpdateFriend(friendList FriendsList, newFriend *Friend) (FriendsList, error) {
 	for i, friend := range friendList {
 		logger.LogMessage(logger.LogLevelDebug, "Checking %s", friend.Name)
@@ -300,38 +524,227 @@ func UpdateLastContacted(friend Friend, todaysDate time.Time) *Friend {
 
 // SQL Functions
 
-// addFriend inserts a new friend into the database
-func AddFriend(db *sql.DB, newFriend Friend) error {
-	stmt, err := db.Prepare("INSERT INTO friends(name, lastContacted, birthday, notes) VALUES(?, ?, ?, ?)")
+// addFriend inserts a new friend into the database and returns them as they were saved,
+// with the ID, slug, tags and custom fields they were given
+func AddFriend(db DBTX, newFriend Friend) (*Friend, error) {
+	id, err := insertFriend(db, newFriend, "")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer stmt.Close()
 
-	_, err = stmt.Exec(newFriend.Name, newFriend.LastContacted, newFriend.Birthday, newFriend.Notes)
+	created, err := SqlGetFriend(db, id)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	successMsg := newFriend.Name + " added successfully"
 
 	logger.LogMessage(logger.LogLevelInfo, successMsg)
-	return nil
+	return created, nil
 }
 
-// Updates a friend with new details
-func SqlUpdateFriend(db *sql.DB, id string, updatedFriend *Friend) error {
-	stmt, err := db.Prepare("UPDATE friends SET name = ?, lastContacted = ?, birthday = ?, notes = ? WHERE id = ?")
+// Inserts the friend and returns the ID it was saved with. If the friend already has an ID it is kept.
+// seedKey links the friend to an entry in the seed file and is blank for friends added any other way
+func insertFriend(db DBTX, newFriend Friend, seedKey string) (string, error) {
+	stored, err := encryptFriend(newFriend)
 	if err != nil {
-		return err
+		return "", err
+	}
+
+	var id interface{}
+	if stored.ID != "" {
+		id = stored.ID
+	}
+
+	slug, err := slugForFriend(db, newFriend)
+	if err != nil {
+		return "", err
+	}
+
+	stmt, err := db.Prepare("INSERT INTO friends(id, name, slug, lastContacted, birthday, notes, seedKey) VALUES(?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return "", err
 	}
 	defer stmt.Close()
 
-	_, err = stmt.Exec(updatedFriend.Name, updatedFriend.LastContacted, updatedFriend.Birthday, updatedFriend.Notes, id)
+	res, err := stmt.Exec(id, stored.Name, slug, stored.LastContacted, stored.Birthday, stored.Notes, seedKey)
+	if err != nil {
+		return "", err
+	}
+
+	insertedID, err := res.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+
+	created := newFriend
+	created.ID = strconv.FormatInt(insertedID, 10)
+	created.Slug = slug
+
+	if created.Tags, err = NormaliseTags(created.Tags); err != nil {
+		return "", err
+	}
+	if err := setFriendTags(db, created.ID, created.Tags); err != nil {
+		return "", err
+	}
+
+	if created.Fields, err = NormaliseFields(db, created.Fields); err != nil {
+		return "", err
+	}
+	if err := setFriendFields(db, created.ID, created.Fields); err != nil {
+		return "", err
+	}
+
+	if err := recordAudit(db, created.ID, AuditActionCreate, nil, &created); err != nil {
+		return "", err
+	}
+
+	return created.ID, nil
+}
+
+// The columns scanFriend expects, in order
+const friendColumns = "id, name, slug, lastContacted, birthday, notes, deletedAt, version"
+
+// Scans a row selected with friendColumns and decrypts any encrypted fields
+func scanFriend(row interface {
+	Scan(dest ...interface{}) error
+}) (Friend, error) {
+	var f Friend
+	if err := row.Scan(&f.ID, &f.Name, &f.Slug, &f.LastContacted, &f.Birthday, &f.Notes, &f.DeletedAt, &f.Version); err != nil {
+		return f, err
+	}
+	if err := decryptFriend(&f); err != nil {
+		return f, err
+	}
+	return f, nil
+}
+
+// Gets a single friend straight from the db rather than the cached friends list.
+// This includes friends in the trash, which have DeletedAt set
+func SqlGetFriend(db DBTX, id string) (*Friend, error) {
+	f, err := scanFriend(db.QueryRow("SELECT "+friendColumns+" FROM friends WHERE id = ?", id))
+	if err == sql.ErrNoRows {
+		return nil, ErrFriendNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if f.Tags, err = loadTagsForFriend(db, id); err != nil {
+		return nil, err
+	}
+
+	fieldsByFriend, err := loadFriendFields(db, id)
+	if err != nil {
+		return nil, err
+	}
+	f.Fields = fieldsByFriend[id]
+
+	return &f, nil
+}
+
+// Updates a friend with new details. Tags and custom fields are only replaced if they aren't nil, and the slug if it isn't blank.
+// updatedFriend's Version is moved on to the version they were saved at. Returns ErrSlugTaken if another friend already has the slug
+func SqlUpdateFriend(db DBTX, id string, updatedFriend *Friend) error {
+	return SqlUpdateFriendAtVersion(db, id, updatedFriend, 0)
+}
+
+// Updates a friend like SqlUpdateFriend, but only if they are still at the version provided so changes made in the
+// meantime aren't overwritten. Returns ErrVersionMismatch if they have been changed since, or ErrFriendNotFound if they don't exist.
+// A version of 0 updates them whatever their version. The friend, their tags and fields and the audit entry are saved together
+func SqlUpdateFriendAtVersion(db DBTX, id string, updatedFriend *Friend, version int) error {
+	stored, err := encryptFriend(*updatedFriend)
 	if err != nil {
 		return err
 	}
 
+	var savedVersion int
+	err = withTransaction(db, func(tx DBTX) error {
+		// Kept for the audit log
+		before, err := SqlGetFriend(tx, id)
+		if err != nil {
+			return err
+		}
+
+		// Slugs stay the same when the name changes so links to the friend keep working
+		slug := updatedFriend.Slug
+		if slug == "" {
+			slug = before.Slug
+		} else {
+			if err := ValidateSlug(slug); err != nil {
+				return err
+			}
+			if err := checkSlugAvailable(tx, slug, id); err != nil {
+				return err
+			}
+		}
+
+		err = tx.QueryRow("UPDATE friends SET name = ?, slug = ?, lastContacted = ?, birthday = ?, notes = ?, version = version + 1 WHERE id = ? AND (? = 0 OR version = ?) RETURNING version",
+			stored.Name, slug, stored.LastContacted, stored.Birthday, stored.Notes, id, version, version).Scan(&savedVersion)
+		if errors.Is(err, sql.ErrNoRows) {
+			return missingOrChanged(tx, id, version)
+		}
+		if err != nil {
+			return err
+		}
+
+		tags, err := NormaliseTags(updatedFriend.Tags)
+		if err != nil {
+			return err
+		}
+		if tags != nil {
+			if err := setFriendTags(tx, id, tags); err != nil {
+				return err
+			}
+		}
+
+		fields, err := NormaliseFields(tx, updatedFriend.Fields)
+		if err != nil {
+			return err
+		}
+		if fields != nil {
+			if err := setFriendFields(tx, id, fields); err != nil {
+				return err
+			}
+		}
+
+		after := *before
+		after.Name = updatedFriend.Name
+		after.Slug = slug
+		after.LastContacted = updatedFriend.LastContacted
+		after.Birthday = updatedFriend.Birthday
+		after.Notes = updatedFriend.Notes
+		if tags != nil {
+			after.Tags = tags
+		}
+		if fields != nil {
+			after.Fields = fields
+		}
+		return recordAudit(tx, id, AuditActionUpdate, before, &after)
+	})
+	if err != nil {
+		return err
+	}
+
+	// Saving them bumped the version, so callers that cache the friend hand out an ETag that still matches
+	updatedFriend.Version = savedVersion
+
 	logger.LogMessage(logger.LogLevelInfo, "Friend with ID %s updated successfully", updatedFriend.ID)
 	return nil
 }
+
+// Works out why a change to a friend didn't match any rows. If a version was expected and the friend is still there
+// then someone else changed them first
+func missingOrChanged(db DBTX, id string, version int) error {
+	if version == 0 {
+		return ErrFriendNotFound
+	}
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM friends WHERE id = ? AND deletedAt = ''", id).Scan(&count); err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrFriendNotFound
+	}
+	return ErrVersionMismatch
+}
@@ -0,0 +1,335 @@
+package models
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const (
+	// RFC 7396. Keys in the patch replace the friend's, and null clears them
+	MergePatchContentType = "application/merge-patch+json"
+	// RFC 6902. A list of add, remove, replace, move, copy and test operations
+	JSONPatchContentType = "application/json-patch+json"
+)
+
+// ErrUnsupportedPatch is returned when a patch isn't a JSON Merge Patch or JSON Patch
+var ErrUnsupportedPatch = errors.New("patches must be sent as " + MergePatchContentType + " or " + JSONPatchContentType)
+
+// ErrMalformedPatch is returned when a patch isn't valid JSON, or a JSON Patch isn't a list of operations
+var ErrMalformedPatch = errors.New("patch is not valid")
+
+// ErrPatchTestFailed is returned when a test operation in a JSON Patch doesn't match, so nothing was changed
+var ErrPatchTestFailed = errors.New("a test operation in the patch did not match")
+
+// PatchOperation is one step of a JSON Patch. Value is left as raw JSON so a null value can be told apart from a missing one
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// Applies a patch to the friend. application/json is treated as a JSON Merge Patch.
+// The patch can change anything apart from the ID, and the result still needs validating before it's saved
+func PatchFriend(friend Friend, contentType string, patch []byte) (Friend, error) {
+	data, err := json.Marshal(friend)
+	if err != nil {
+		return friend, err
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return friend, err
+	}
+	// Empty tags and custom fields are left out of the JSON, but a JSON Patch needs them there to add to
+	if _, ok := fields["Tags"]; !ok {
+		fields["Tags"] = []interface{}{}
+	}
+	if _, ok := fields["Fields"]; !ok {
+		fields["Fields"] = map[string]interface{}{}
+	}
+	var document interface{} = fields
+
+	switch contentType {
+	case MergePatchContentType, "application/json":
+		var mergePatch interface{}
+		if err := json.Unmarshal(patch, &mergePatch); err != nil {
+			return friend, fmt.Errorf("%w: %v", ErrMalformedPatch, err)
+		}
+		document = MergePatch(document, mergePatch)
+	case JSONPatchContentType:
+		var operations []PatchOperation
+		if err := json.Unmarshal(patch, &operations); err != nil {
+			return friend, fmt.Errorf("%w: %v", ErrMalformedPatch, err)
+		}
+		if document, err = ApplyJSONPatch(document, operations); err != nil {
+			return friend, err
+		}
+	default:
+		return friend, ErrUnsupportedPatch
+	}
+
+	if data, err = json.Marshal(document); err != nil {
+		return friend, err
+	}
+	var patched Friend
+	if err := json.Unmarshal(data, &patched); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field != "" {
+			return friend, fieldError(typeErr.Field, typeErr.Field+" can't be a "+typeErr.Value)
+		}
+		return friend, fieldError("", "the patched friend must be an object")
+	}
+
+	if patched.ID != friend.ID {
+		return friend, fieldError("ID", "ID can't be changed")
+	}
+	patched.DeletedAt = friend.DeletedAt
+	if len(patched.Tags) == 0 {
+		patched.Tags = nil
+	}
+	if len(patched.Fields) == 0 {
+		patched.Fields = nil
+	}
+	return patched, nil
+}
+
+// Applies a JSON Merge Patch to a decoded JSON document. Objects are merged, null removes a key and anything else replaces it
+func MergePatch(target interface{}, patch interface{}) interface{} {
+	patchObject, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+
+	targetObject, ok := target.(map[string]interface{})
+	if !ok {
+		targetObject = map[string]interface{}{}
+	}
+	for key, value := range patchObject {
+		if value == nil {
+			delete(targetObject, key)
+			continue
+		}
+		targetObject[key] = MergePatch(targetObject[key], value)
+	}
+	return targetObject
+}
+
+// Applies the operations of a JSON Patch to a decoded JSON document in order. If any of them fail the error is returned
+// and the document should be thrown away, since earlier operations may have changed it
+func ApplyJSONPatch(document interface{}, operations []PatchOperation) (interface{}, error) {
+	for _, operation := range operations {
+		path, err := parsePointer(operation.Path)
+		if err != nil {
+			return nil, err
+		}
+
+		switch operation.Op {
+		case "add", "replace", "test":
+			if operation.Value == nil {
+				return nil, fieldError(pointerField(path), operation.Op+" operations need a value")
+			}
+			var value interface{}
+			if err := json.Unmarshal(operation.Value, &value); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrMalformedPatch, err)
+			}
+
+			switch operation.Op {
+			case "add":
+				document, err = addAt(document, path, value)
+			case "replace":
+				document, err = replaceAt(document, path, value)
+			case "test":
+				var current interface{}
+				if current, err = valueAt(document, path); err == nil && !reflect.DeepEqual(current, value) {
+					err = ErrPatchTestFailed
+				}
+			}
+		case "remove":
+			document, _, err = removeAt(document, path)
+		case "move", "copy":
+			var from []string
+			if from, err = parsePointer(operation.From); err != nil {
+				return nil, err
+			}
+
+			var value interface{}
+			if operation.Op == "move" {
+				if len(from) < len(path) && reflect.DeepEqual(from, path[:len(from)]) {
+					return nil, fieldError(pointerField(path), "a value can't be moved inside itself")
+				}
+				document, value, err = removeAt(document, from)
+			} else if value, err = valueAt(document, from); err == nil {
+				value, err = copyValue(value)
+			}
+			if err == nil {
+				document, err = addAt(document, path, value)
+			}
+		default:
+			return nil, fieldError(pointerField(path), "op must be one of add, remove, replace, move, copy or test")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	return document, nil
+}
+
+// Splits a JSON Pointer like /Fields/partner into its keys, undoing the ~0 and ~1 escapes
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fieldError(pointer, "paths must be JSON Pointers starting with /. "+pointer+" is not valid")
+	}
+
+	keys := strings.Split(pointer[1:], "/")
+	for i, key := range keys {
+		keys[i] = strings.ReplaceAll(strings.ReplaceAll(key, "~1", "/"), "~0", "~")
+	}
+	return keys, nil
+}
+
+// The path written the same way as the fields in validation errors, i.e. Fields.partner
+func pointerField(path []string) string {
+	return strings.Join(path, ".")
+}
+
+func valueAt(document interface{}, path []string) (interface{}, error) {
+	current := document
+	for i, key := range path {
+		switch container := current.(type) {
+		case map[string]interface{}:
+			value, ok := container[key]
+			if !ok {
+				return nil, fieldError(pointerField(path[:i+1]), pointerField(path[:i+1])+" does not exist")
+			}
+			current = value
+		case []interface{}:
+			index, err := arrayIndex(container, key, path[:i+1], false)
+			if err != nil {
+				return nil, err
+			}
+			current = container[index]
+		default:
+			return nil, fieldError(pointerField(path[:i+1]), pointerField(path[:i])+" does not contain other values")
+		}
+	}
+	return current, nil
+}
+
+// Works out which item of the array a key refers to. "-" is the end of the array, which can only be added to
+func arrayIndex(array []interface{}, key string, path []string, adding bool) (int, error) {
+	if key == "-" && adding {
+		return len(array), nil
+	}
+	index, err := strconv.Atoi(key)
+	if err != nil || index < 0 || (key != "0" && strings.HasPrefix(key, "0")) {
+		return 0, fieldError(pointerField(path), key+" is not a valid index")
+	}
+	if index > len(array) || (index == len(array) && !adding) {
+		return 0, fieldError(pointerField(path), pointerField(path)+" does not exist")
+	}
+	return index, nil
+}
+
+// Calls change with the container holding the last key of the path and puts whatever it returns back into the document
+func changeAt(document interface{}, path []string, change func(container interface{}, key string) (interface{}, error)) (interface{}, error) {
+	parent, err := valueAt(document, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+
+	changed, err := change(parent, path[len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	if len(path) == 1 {
+		return changed, nil
+	}
+	// Adding to or removing from an array makes a new slice, so it has to be put back where the old one was
+	return replaceAt(document, path[:len(path)-1], changed)
+}
+
+func addAt(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return changeAt(document, path, func(container interface{}, key string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			container[key] = value
+			return container, nil
+		case []interface{}:
+			index, err := arrayIndex(container, key, path, true)
+			if err != nil {
+				return nil, err
+			}
+			container = append(container, nil)
+			copy(container[index+1:], container[index:])
+			container[index] = value
+			return container, nil
+		}
+		return nil, fieldError(pointerField(path), pointerField(path[:len(path)-1])+" does not contain other values")
+	})
+}
+
+func replaceAt(document interface{}, path []string, value interface{}) (interface{}, error) {
+	if _, err := valueAt(document, path); err != nil {
+		return nil, err
+	}
+	if len(path) == 0 {
+		return value, nil
+	}
+
+	parent, _ := valueAt(document, path[:len(path)-1])
+	key := path[len(path)-1]
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		parent[key] = value
+	case []interface{}:
+		index, _ := strconv.Atoi(key)
+		parent[index] = value
+	}
+	return document, nil
+}
+
+// Removes the value at the path, returning it so it can be moved
+func removeAt(document interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fieldError("", "the whole document can't be removed")
+	}
+	removed, err := valueAt(document, path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	document, err = changeAt(document, path, func(container interface{}, key string) (interface{}, error) {
+		switch container := container.(type) {
+		case map[string]interface{}:
+			delete(container, key)
+			return container, nil
+		case []interface{}:
+			index, _ := strconv.Atoi(key)
+			return append(container[:index:index], container[index+1:]...), nil
+		}
+		return container, nil
+	})
+	return document, removed, err
+}
+
+// Copies are made by going through JSON so the copy doesn't share any maps or slices with the original
+func copyValue(value interface{}) (interface{}, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var copied interface{}
+	err = json.Unmarshal(data, &copied)
+	return copied, err
+}
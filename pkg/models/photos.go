@@ -0,0 +1,163 @@
+package models
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"time"
+)
+
+// Thumbnails are scaled down to fit in a square of this many pixels
+const thumbnailSize = 256
+
+// Photos with more pixels than this are rejected so decoding them can't use up all the memory
+const maxPhotoPixels = 25_000_000
+
+// ErrPhotoNotFound is returned when the friend doesn't have a photo
+var ErrPhotoNotFound = errors.New("photo not found")
+
+// ErrUnsupportedPhoto is returned when an upload isn't a JPEG or PNG image
+var ErrUnsupportedPhoto = errors.New("photos must be JPEG or PNG images")
+
+// ErrPhotoTooLarge is returned when an upload has more than maxPhotoPixels pixels
+var ErrPhotoTooLarge = errors.New("photos must be 25 megapixels or less")
+
+// Photos are kept in the db rather than on disk so they're included in backups
+const createPhotosTableSQL = `
+    CREATE TABLE IF NOT EXISTS friend_photos (
+		friendId INTEGER PRIMARY KEY,
+		contentType TEXT NOT NULL,
+		photo BLOB NOT NULL,
+		thumbnail BLOB NOT NULL,
+		updatedAt TEXT NOT NULL
+    );`
+
+// Photo is an image file along with its MIME type
+type Photo struct {
+	ContentType string
+	Data        []byte
+}
+
+// Saves the photo for the friend, replacing any photo they already had, and generates a thumbnail for it.
+// The thumbnail is saved in the same format as the photo
+func SavePhoto(db DBTX, friendID string, data []byte) error {
+	contentType := http.DetectContentType(data)
+	if contentType != "image/jpeg" && contentType != "image/png" {
+		return ErrUnsupportedPhoto
+	}
+
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return ErrUnsupportedPhoto
+	}
+	if config.Width*config.Height > maxPhotoPixels {
+		return ErrPhotoTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return ErrUnsupportedPhoto
+	}
+
+	var thumbnail bytes.Buffer
+	if contentType == "image/png" {
+		err = png.Encode(&thumbnail, MakeThumbnail(img, thumbnailSize))
+	} else {
+		err = jpeg.Encode(&thumbnail, MakeThumbnail(img, thumbnailSize), &jpeg.Options{Quality: 85})
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(`INSERT INTO friend_photos(friendId, contentType, photo, thumbnail, updatedAt) VALUES(?, ?, ?, ?, ?)
+		ON CONFLICT(friendId) DO UPDATE SET contentType = excluded.contentType, photo = excluded.photo,
+		thumbnail = excluded.thumbnail, updatedAt = excluded.updatedAt`,
+		friendID, contentType, data, thumbnail.Bytes(), time.Now().UTC().Format(time.RFC3339))
+	return err
+}
+
+// Gets the friend's photo, or its thumbnail
+func GetPhoto(db DBTX, friendID string, thumbnail bool) (Photo, error) {
+	column := "photo"
+	if thumbnail {
+		column = "thumbnail"
+	}
+
+	var photo Photo
+	err := db.QueryRow("SELECT contentType, "+column+" FROM friend_photos WHERE friendId = ?", friendID).Scan(&photo.ContentType, &photo.Data)
+	if errors.Is(err, sql.ErrNoRows) {
+		return photo, ErrPhotoNotFound
+	}
+	return photo, err
+}
+
+// Deletes the friend's photo
+func DeletePhoto(db DBTX, friendID string) error {
+	result, err := db.Exec("DELETE FROM friend_photos WHERE friendId = ?", friendID)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrPhotoNotFound
+	}
+	return nil
+}
+
+// Scales the image down to fit within maxSize x maxSize, keeping its aspect ratio.
+// Each pixel is the average of the pixels it covers in the original. Images that already fit are returned as they are
+func MakeThumbnail(img image.Image, maxSize int) image.Image {
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width <= maxSize && height <= maxSize {
+		return img
+	}
+
+	thumbWidth, thumbHeight := maxSize, maxSize
+	if width > height {
+		thumbHeight = max(1, height*maxSize/width)
+	} else {
+		thumbWidth = max(1, width*maxSize/height)
+	}
+
+	src := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+
+	thumb := image.NewRGBA(image.Rect(0, 0, thumbWidth, thumbHeight))
+	for y := 0; y < thumbHeight; y++ {
+		y0, y1 := y*height/thumbHeight, (y+1)*height/thumbHeight
+		for x := 0; x < thumbWidth; x++ {
+			x0, x1 := x*width/thumbWidth, (x+1)*width/thumbWidth
+
+			var r, g, b, a, count int
+			for sy := y0; sy < y1; sy++ {
+				offset := src.PixOffset(x0, sy)
+				for sx := x0; sx < x1; sx++ {
+					r += int(src.Pix[offset])
+					g += int(src.Pix[offset+1])
+					b += int(src.Pix[offset+2])
+					a += int(src.Pix[offset+3])
+					offset += 4
+					count++
+				}
+			}
+
+			offset := thumb.PixOffset(x, y)
+			thumb.Pix[offset] = uint8(r / count)
+			thumb.Pix[offset+1] = uint8(g / count)
+			thumb.Pix[offset+2] = uint8(b / count)
+			thumb.Pix[offset+3] = uint8(a / count)
+		}
+	}
+
+	return thumb
+}
@@ -0,0 +1,268 @@
+package models
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SortByName          = "name"
+	SortByLastContacted = "lastContacted"
+	SortByOverdue       = "overdue"
+	SortByBirthday      = "birthday"
+)
+
+// The ways the friends list can be sorted. Prefix with - to reverse the order, i.e. -name
+var FriendSorts = []string{SortByName, SortByLastContacted, SortByOverdue, SortByBirthday}
+
+// ErrInvalidCursor is returned when a cursor can't be decoded or was made for a different sort
+var ErrInvalidCursor = errors.New("cursor is not valid for this query")
+
+// FriendsQuery filters, sorts and pages through the friends list. The zero value returns every friend in ID order
+type FriendsQuery struct {
+	// Only friends with all of these tags
+	Tags []string
+	// Only friends with these custom field values
+	Fields map[string]string
+	// Only friends last contacted before this date, including friends that have never been contacted
+	ContactedBefore string
+	// Only friends with, or without, a birthday set
+	HasBirthday *bool
+	// One of FriendSorts, optionally prefixed with -. Ties are broken by ID
+	Sort string
+	// The most friends to return. 0 returns them all
+	Limit int
+	// Where the previous page finished, from FriendsPage.NextCursor
+	Cursor string
+}
+
+// FriendsPage is one page of the results of a FriendsQuery
+type FriendsPage struct {
+	Friends FriendsList
+	// How many friends matched the filters across every page
+	Total int
+	// Pass this as the Cursor to get the next page. Blank on the last page
+	NextCursor string
+}
+
+// The value friends are sorted on. Only one of text and number is used, depending on the sort
+type friendSortKey struct {
+	Missing bool   `json:"m,omitempty"`
+	Text    string `json:"t,omitempty"`
+	Number  int    `json:"n,omitempty"`
+	ID      string `json:"id"`
+}
+
+// Cursors are the sort and key of the last friend on the page, so pages don't shift if friends are added or removed
+type friendsCursor struct {
+	Sort string        `json:"s"`
+	Key  friendSortKey `json:"k"`
+}
+
+// Checks the query's filters, sort and limit are valid
+func ValidateFriendsQuery(query FriendsQuery) error {
+	if query.ContactedBefore != "" && !IsValidDate(query.ContactedBefore) {
+		return fieldError("contactedBefore", "contactedBefore must be in yyyy-mm-dd format. "+query.ContactedBefore+" does not match")
+	}
+
+	if query.Sort != "" {
+		valid := false
+		for _, s := range FriendSorts {
+			if strings.TrimPrefix(query.Sort, "-") == s {
+				valid = true
+			}
+		}
+		if !valid {
+			return fieldError("sort", "sort must be one of "+strings.Join(FriendSorts, ", ")+", optionally prefixed with -")
+		}
+	}
+
+	if query.Limit < 0 {
+		return fieldError("limit", "limit must not be negative")
+	}
+
+	return nil
+}
+
+// Filters and sorts the friends, then returns the page after the cursor.
+// today is used to work out how overdue friends are and how soon their birthdays are
+func QueryFriends(friends FriendsList, query FriendsQuery, today time.Time) (FriendsPage, error) {
+	if err := ValidateFriendsQuery(query); err != nil {
+		return FriendsPage{}, err
+	}
+
+	filtered := friends
+	if len(query.Tags) > 0 {
+		filtered = FilterByTags(filtered, query.Tags)
+	}
+	if len(query.Fields) > 0 {
+		filtered = FilterByFields(filtered, query.Fields)
+	}
+
+	matched := FriendsList{}
+	for _, friend := range filtered {
+		if query.ContactedBefore != "" && friend.LastContacted != "" && friend.LastContacted >= query.ContactedBefore {
+			continue
+		}
+		if query.HasBirthday != nil && (friend.Birthday != "") != *query.HasBirthday {
+			continue
+		}
+		matched = append(matched, friend)
+	}
+
+	sortName := strings.TrimPrefix(query.Sort, "-")
+	descending := strings.HasPrefix(query.Sort, "-")
+
+	keys := make([]friendSortKey, len(matched))
+	for i, friend := range matched {
+		keys[i] = sortKeyFor(friend, sortName, today)
+	}
+	sort.Sort(friendsByKey{friends: matched, keys: keys, descending: descending})
+
+	start := 0
+	if query.Cursor != "" {
+		cursor, err := decodeCursor(query.Cursor)
+		if err != nil || cursor.Sort != query.Sort {
+			return FriendsPage{}, ErrInvalidCursor
+		}
+		start = sort.Search(len(keys), func(i int) bool {
+			return compareSortKeys(keys[i], cursor.Key, descending) > 0
+		})
+	}
+
+	end := len(matched)
+	if query.Limit > 0 && start+query.Limit < end {
+		end = start + query.Limit
+	}
+
+	page := FriendsPage{Friends: matched[start:end], Total: len(matched)}
+	if end < len(matched) {
+		page.NextCursor = encodeCursor(friendsCursor{Sort: query.Sort, Key: keys[end-1]})
+	}
+	return page, nil
+}
+
+// Works out the value the friend is sorted on. Friends without a date to sort on go last in either direction,
+// apart from when sorting by overdue where friends that have never been contacted are the most overdue
+func sortKeyFor(friend Friend, sortName string, today time.Time) friendSortKey {
+	key := friendSortKey{ID: friend.ID}
+	switch sortName {
+	case SortByName:
+		key.Text = strings.ToLower(friend.Name)
+	case SortByLastContacted:
+		key.Text = friend.LastContacted
+		key.Missing = friend.LastContacted == ""
+	case SortByOverdue:
+		// Most overdue first
+		key.Number = -math.MaxInt32
+		if friend.LastContacted != "" {
+			days, err := CalculateWeight(friend.LastContacted, today)
+			if err != nil {
+				days = 0
+			}
+			key.Number = -days
+		}
+	case SortByBirthday:
+		key.Number = DaysUntilBirthday(friend.Birthday, today)
+		key.Missing = key.Number == math.MaxInt32
+	}
+	return key
+}
+
+// Counts the days until the friend's next birthday, 0 if it's today.
+// Birthdays on the 29th of February are on the 1st of March in other years. Returns math.MaxInt32 if they have no birthday set
+func DaysUntilBirthday(birthday string, today time.Time) int {
+	date, err := time.Parse("2006-01-02", birthday)
+	if err != nil {
+		return math.MaxInt32
+	}
+
+	todayUTC := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, time.UTC)
+	next := time.Date(today.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	if next.Before(todayUTC) {
+		next = time.Date(today.Year()+1, date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	return int(next.Sub(todayUTC).Hours() / 24)
+}
+
+// Orders friends by their sort keys, keeping the keys in step with the friends
+type friendsByKey struct {
+	friends    FriendsList
+	keys       []friendSortKey
+	descending bool
+}
+
+func (s friendsByKey) Len() int { return len(s.friends) }
+
+func (s friendsByKey) Less(i, j int) bool {
+	return compareSortKeys(s.keys[i], s.keys[j], s.descending) < 0
+}
+
+func (s friendsByKey) Swap(i, j int) {
+	s.friends[i], s.friends[j] = s.friends[j], s.friends[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// Compares two keys in the order they should be listed. Missing values always go last and IDs always ascend,
+// so ties come out the same way every time
+func compareSortKeys(a, b friendSortKey, descending bool) int {
+	if a.Missing != b.Missing {
+		if a.Missing {
+			return 1
+		}
+		return -1
+	}
+
+	result := strings.Compare(a.Text, b.Text)
+	if result == 0 {
+		result = compareInts(a.Number, b.Number)
+	}
+	if descending {
+		result = -result
+	}
+	if result == 0 {
+		result = compareIDs(a.ID, b.ID)
+	}
+	return result
+}
+
+func compareInts(a, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// IDs are numbers stored as text, so compare them as numbers
+func compareIDs(a, b string) int {
+	aNumber, aErr := strconv.Atoi(a)
+	bNumber, bErr := strconv.Atoi(b)
+	if aErr != nil || bErr != nil {
+		return strings.Compare(a, b)
+	}
+	return compareInts(aNumber, bNumber)
+}
+
+func encodeCursor(cursor friendsCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor(encoded string) (friendsCursor, error) {
+	var cursor friendsCursor
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return cursor, err
+	}
+	err = json.Unmarshal(data, &cursor)
+	return cursor, err
+}
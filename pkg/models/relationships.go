@@ -0,0 +1,197 @@
+package models
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	RelationshipPartner = "partner"
+	RelationshipSibling = "sibling"
+	RelationshipGroup   = "group"
+)
+
+// The types of relationship that can link two friends
+var RelationshipTypes = []string{RelationshipPartner, RelationshipSibling, RelationshipGroup}
+
+// ErrRelationshipNotFound is returned when a relationship doesn't exist for the friend
+var ErrRelationshipNotFound = errors.New("relationship not found")
+
+// ErrRelationshipExists is returned when two friends are already linked with the same type of relationship
+var ErrRelationshipExists = errors.New("these friends are already linked with that relationship")
+
+const createRelationshipsTableSQL = `
+    CREATE TABLE IF NOT EXISTS relationships (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		friendId INTEGER NOT NULL,
+		relatedId INTEGER NOT NULL,
+		type TEXT NOT NULL,
+		label TEXT NOT NULL DEFAULT ''
+    );
+    CREATE INDEX IF NOT EXISTS relationships_friend ON relationships (friendId);
+    CREATE INDEX IF NOT EXISTS relationships_related ON relationships (relatedId);`
+
+// Relationship links two friends. Relationships go both ways, so when one is read for a friend,
+// FriendID is always that friend and RelatedID is the other one.
+// Label can name the group, i.e. "climbing club"
+type Relationship struct {
+	ID        int64
+	FriendID  string
+	RelatedID string
+	Type      string
+	Label     string `json:",omitempty"`
+}
+
+// RelatedFriend is a friend along with how they are linked to the friend being looked at
+type RelatedFriend struct {
+	Relationship Relationship
+	Friend       Friend
+}
+
+// Checks the relationship has a known type and links two different friends
+func ValidateRelationship(relationship Relationship) error {
+	if relationship.RelatedID == "" {
+		return fieldError("RelatedID", "related ID must not be blank")
+	}
+	if relationship.FriendID == relationship.RelatedID {
+		return fieldError("RelatedID", "a friend can't be related to themselves")
+	}
+
+	for _, relationshipType := range RelationshipTypes {
+		if relationship.Type == relationshipType {
+			return nil
+		}
+	}
+	return fieldError("Type", "relationship type must be one of "+strings.Join(RelationshipTypes, ", "))
+}
+
+// Lists the friend's relationships in the order they were added
+func ListRelationships(db DBTX, friendID string) ([]Relationship, error) {
+	rows, err := db.Query(`SELECT id, friendId, relatedId, type, label FROM relationships
+		WHERE friendId = ? OR relatedId = ? ORDER BY id`, friendID, friendID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	relationships := []Relationship{}
+	for rows.Next() {
+		var relationship Relationship
+		if err := rows.Scan(&relationship.ID, &relationship.FriendID, &relationship.RelatedID, &relationship.Type, &relationship.Label); err != nil {
+			return nil, err
+		}
+
+		// Flip the relationship round so it's from the point of view of the friend asked for
+		if relationship.RelatedID == friendID {
+			relationship.FriendID, relationship.RelatedID = relationship.RelatedID, relationship.FriendID
+		}
+		relationships = append(relationships, relationship)
+	}
+
+	return relationships, rows.Err()
+}
+
+// Links two friends. Returns the saved relationship
+func AddRelationship(db DBTX, relationship Relationship) (Relationship, error) {
+	if err := ValidateRelationship(relationship); err != nil {
+		return relationship, err
+	}
+
+	var count int
+	err := db.QueryRow(`SELECT COUNT(*) FROM relationships WHERE type = ?
+		AND ((friendId = ? AND relatedId = ?) OR (friendId = ? AND relatedId = ?))`,
+		relationship.Type, relationship.FriendID, relationship.RelatedID, relationship.RelatedID, relationship.FriendID).Scan(&count)
+	if err != nil {
+		return relationship, err
+	}
+	if count > 0 {
+		return relationship, ErrRelationshipExists
+	}
+
+	result, err := db.Exec("INSERT INTO relationships(friendId, relatedId, type, label) VALUES(?, ?, ?, ?)",
+		relationship.FriendID, relationship.RelatedID, relationship.Type, relationship.Label)
+	if err != nil {
+		return relationship, err
+	}
+
+	if relationship.ID, err = result.LastInsertId(); err != nil {
+		return relationship, err
+	}
+	return relationship, nil
+}
+
+// Deletes the relationship with the ID provided, as long as it involves the friend
+func DeleteRelationship(db DBTX, friendID string, id int64) error {
+	result, err := db.Exec("DELETE FROM relationships WHERE id = ? AND (friendId = ? OR relatedId = ?)", id, friendID, friendID)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrRelationshipNotFound
+	}
+	return nil
+}
+
+// Matches the friend's relationships up with the friends in the list.
+// Relationships with friends that aren't in the list, i.e. because they're in the trash, are left out
+func RelatedFriends(db DBTX, friendID string, friends FriendsList) ([]RelatedFriend, error) {
+	relationships, err := ListRelationships(db, friendID)
+	if err != nil {
+		return nil, err
+	}
+
+	related := []RelatedFriend{}
+	for _, relationship := range relationships {
+		friend, err := GetFriendByID(relationship.RelatedID, friends)
+		if err != nil {
+			continue
+		}
+		related = append(related, RelatedFriend{Relationship: relationship, Friend: *friend})
+	}
+
+	return related, nil
+}
+
+// Returns the friends linked to the friend that haven't been contacted since before the cutoff.
+// Each friend is only returned once even if they are linked in more than one way
+func OverdueRelatedFriends(db DBTX, friendID string, friends FriendsList, cutoff time.Time) (FriendsList, error) {
+	related, err := RelatedFriends(db, friendID, friends)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	overdue := FriendsList{}
+	for _, r := range related {
+		if seen[r.Friend.ID] {
+			continue
+		}
+		seen[r.Friend.ID] = true
+
+		lastContacted, err := time.Parse("2006-01-02", r.Friend.LastContacted)
+		if err != nil || lastContacted.Before(cutoff) {
+			overdue = append(overdue, r.Friend)
+		}
+	}
+
+	return overdue, nil
+}
+
+// Joins names into a list that reads naturally, i.e. "Alice, Bob and Carol"
+func JoinNames(friends FriendsList) string {
+	names := make([]string, len(friends))
+	for i, friend := range friends {
+		names[i] = friend.Name
+	}
+
+	if len(names) < 2 {
+		return strings.Join(names, "")
+	}
+	return strings.Join(names[:len(names)-1], ", ") + " and " + names[len(names)-1]
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"os"
+	"strings"
+	"text/template"
+
+	"howarethey/pkg/logger"
+)
+
+// The message sent when a friend is picked, unless NOTIFICATION_TEMPLATE is set
+const defaultReminderTemplate = `You should get in touch with {{.Name}}. You haven't spoken to them since {{.LastContacted}}. ` +
+	`{{if .Notes}}Here's what you've got written down for them: {{.Notes}}{{end}}` +
+	`{{if .ContactMethods}}
+You can reach them on:
+{{.ContactMethods}}{{end}}` +
+	`{{if .GroupMeetUp}}
+You could catch up with {{.GroupMeetUp}} together.{{end}}`
+
+// ReminderData is what notification templates are rendered with.
+// The friend's details can be used directly, i.e. {{.Name}}, and custom fields with {{field . "partner"}}
+type ReminderData struct {
+	Friend
+	ContactMethods string
+	// The names of the friend and the friends linked to them that are also overdue, i.e. "Alice, Bob and Carol".
+	// Blank if there's no one to suggest
+	GroupMeetUp string
+}
+
+var reminderFuncs = template.FuncMap{
+	// Formats a custom field as text, or blank if the friend doesn't have it. i.e. {{field . "kids"}}
+	"field": func(data ReminderData, name string) string {
+		return FormatFieldValue(data.Fields[name])
+	},
+}
+
+// Renders the reminder sent when a friend is picked. meetUp is any related friends that are also overdue.
+// A custom template can be set with NOTIFICATION_TEMPLATE. If it fails to render, the default message is used instead
+func RenderReminder(friend Friend, contactMethods []ContactMethod, meetUp FriendsList) string {
+	data := ReminderData{Friend: friend, ContactMethods: FormatContactMethods(contactMethods)}
+	if len(meetUp) > 0 {
+		data.GroupMeetUp = JoinNames(append(FriendsList{friend}, meetUp...))
+	}
+
+	if custom := os.Getenv("NOTIFICATION_TEMPLATE"); custom != "" {
+		content, err := renderTemplate(custom, data)
+		if err == nil {
+			return content
+		}
+		logger.LogMessage(logger.LogLevelError, "Failed to render NOTIFICATION_TEMPLATE, using the default message instead: %v", err)
+	}
+
+	content, _ := renderTemplate(defaultReminderTemplate, data)
+	return content
+}
+
+// Checks a notification template parses so mistakes are caught on startup
+func ValidateReminderTemplate(text string) error {
+	_, err := template.New("reminder").Funcs(reminderFuncs).Parse(text)
+	return err
+}
+
+func renderTemplate(text string, data ReminderData) (string, error) {
+	tmpl, err := template.New("reminder").Funcs(reminderFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var content strings.Builder
+	if err := tmpl.Execute(&content, data); err != nil {
+		return "", err
+	}
+	return content.String(), nil
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"database/sql"
+
+	"howarethey/pkg/logger"
+)
+
+const createFriendsTableSQL = `
+    CREATE TABLE IF NOT EXISTS friends (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		lastContacted TEXT NOT NULL,
+		birthday TEXT NOT NULL,
+		notes TEXT NOT NULL
+    );`
+
+// Columns added after the friends table was first released.
+// Existing databases get these added on startup so they don't need to be recreated
+var friendsColumnMigrations = []struct {
+	name       string
+	definition string
+}{
+	{"seedKey", "TEXT NOT NULL DEFAULT ''"},
+	{"deletedAt", "TEXT NOT NULL DEFAULT ''"},
+	{"slug", "TEXT NOT NULL DEFAULT ''"},
+	{"version", "INTEGER NOT NULL DEFAULT 1"},
+}
+
+const createFriendsSlugIndexSQL = `CREATE UNIQUE INDEX IF NOT EXISTS friends_slug ON friends (slug) WHERE slug != '';`
+
+// CreateTables creates any missing tables and columns in the SQLite database
+func CreateTables(db DBTX) error {
+	if _, err := db.Exec(createFriendsTableSQL); err != nil {
+		return err
+	}
+
+	for _, column := range friendsColumnMigrations {
+		if err := addColumnIfMissing(db, "friends", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	if err := backfillSlugs(db); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createFriendsSlugIndexSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createAuditTableSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createTagsTablesSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createContactMethodsTableSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createCustomFieldsTablesSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createRelationshipsTableSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createGiftIdeasTableSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createPhotosTableSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createIdempotencyKeysTableSQL); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(createWebhooksTablesSQL); err != nil {
+		return err
+	}
+
+	for _, column := range webhookDeliveriesColumnMigrations {
+		if err := addColumnIfMissing(db, "webhook_deliveries", column.name, column.definition); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func addColumnIfMissing(db DBTX, table string, column string, definition string) error {
+	exists, err := columnExists(db, table, column)
+	if err != nil || exists {
+		return err
+	}
+
+	if _, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " " + definition); err != nil {
+		return err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Added column %s to the %s table", column, table)
+	return nil
+}
+
+func columnExists(db DBTX, table string, column string) (bool, error) {
+	rows, err := db.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			columnType string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &columnType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+
+	return false, rows.Err()
+}
@@ -0,0 +1,369 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+
+	"howarethey/pkg/logger"
+)
+
+// ErrBlankSearch is returned when a search query doesn't contain any words
+var ErrBlankSearch = errors.New("search query must not be blank")
+
+var warnNoFTS5 sync.Once
+
+// The index lives in an in-memory db so decrypted notes are never written to disk.
+// Name matches count for the most, then tags, custom fields and finally notes
+const createSearchTableSQL = `
+    CREATE VIRTUAL TABLE search USING fts5(
+		friendId UNINDEXED,
+		name,
+		tags,
+		notes,
+		fields,
+		tokenize = 'unicode61 remove_diacritics 2'
+    );`
+
+const searchRankSQL = "bm25(search, 0, 10, 5, 1, 2)"
+
+// SearchResult is a friend that matched a search. Higher scores are better matches
+type SearchResult struct {
+	Friend Friend
+	Score  float64
+	// Set when the friend only matched because a word was spelt nearly the same, i.e. "carrell" for "carell"
+	Fuzzy bool `json:",omitempty"`
+}
+
+// SearchIndex keeps friends indexed with FTS5 between searches, so only the friends that changed since the last search
+// or sync are indexed again. The zero value isn't usable, use NewSearchIndex
+type SearchIndex struct {
+	mu sync.Mutex
+	db *sql.DB
+	// What each friend was indexed as, to tell which ones have changed
+	indexed map[string]searchDocument
+	// Set when sqlite was built without FTS5, in which case every search is scored without the index
+	noFTS5 bool
+}
+
+// The text a friend is indexed by
+type searchDocument struct {
+	name   string
+	tags   string
+	notes  string
+	fields string
+}
+
+func newSearchDocument(friend Friend) searchDocument {
+	return searchDocument{
+		name:   friend.Name,
+		tags:   strings.Join(friend.Tags, " "),
+		notes:  friend.Notes,
+		fields: searchableFields(friend),
+	}
+}
+
+// Creates an empty search index. Close it when it's no longer needed
+func NewSearchIndex() (*SearchIndex, error) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+
+	// Every connection to :memory: gets its own db, so only ever use one and never let it close
+	db.SetMaxOpenConns(1)
+	db.SetMaxIdleConns(1)
+
+	index := &SearchIndex{db: db, indexed: make(map[string]searchDocument)}
+	if _, err := db.Exec(createSearchTableSQL); err != nil {
+		if !strings.Contains(err.Error(), "no such module: fts5") {
+			db.Close()
+			return nil, err
+		}
+		warnNoFTS5.Do(func() {
+			logger.LogMessage(logger.LogLevelWarn, "sqlite was built without FTS5 so search results will be ranked more simply. Build with -tags sqlite_fts5 to enable it")
+		})
+		index.noFTS5 = true
+	}
+
+	return index, nil
+}
+
+// Closes the in-memory db the index is kept in
+func (i *SearchIndex) Close() error {
+	return i.db.Close()
+}
+
+// Brings the index in line with the friends, indexing the ones that were added or changed and removing the ones that have gone.
+// A nil index does nothing
+func (i *SearchIndex) Sync(friends FriendsList) error {
+	if i == nil {
+		return nil
+	}
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.sync(friends)
+}
+
+func (i *SearchIndex) sync(friends FriendsList) error {
+	if i.noFTS5 {
+		return nil
+	}
+
+	changed := make(map[string]searchDocument)
+	current := make(map[string]bool, len(friends))
+	for _, friend := range friends {
+		current[friend.ID] = true
+		document := newSearchDocument(friend)
+		if indexed, ok := i.indexed[friend.ID]; !ok || indexed != document {
+			changed[friend.ID] = document
+		}
+	}
+
+	var removed []string
+	for id := range i.indexed {
+		if !current[id] {
+			removed = append(removed, id)
+		}
+	}
+
+	if len(changed) == 0 && len(removed) == 0 {
+		return nil
+	}
+
+	tx, err := i.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	for id, document := range changed {
+		if _, err := tx.Exec("DELETE FROM search WHERE friendId = ?", id); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("INSERT INTO search(friendId, name, tags, notes, fields) VALUES(?, ?, ?, ?, ?)",
+			id, document.name, document.tags, document.notes, document.fields); err != nil {
+			return err
+		}
+	}
+	for _, id := range removed {
+		if _, err := tx.Exec("DELETE FROM search WHERE friendId = ?", id); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for id, document := range changed {
+		i.indexed[id] = document
+	}
+	for _, id := range removed {
+		delete(i.indexed, id)
+	}
+	return nil
+}
+
+// Searches the friends' names, tags, notes and custom fields. Every word in the query has to match,
+// and words match the start of a word so "ste" finds "Steve". Results are ranked by how well they match.
+// Friends that only match once small spelling mistakes are allowed for come after the rest.
+// The index is synced with the friends first, so it's never out of date. A nil index searches with a throwaway one.
+// Only what's on the friends themselves is searched, not their contact methods, gift ideas or audit history
+func (i *SearchIndex) Search(friends FriendsList, query string) ([]SearchResult, error) {
+	if i == nil {
+		return SearchFriends(friends, query)
+	}
+
+	terms := searchTerms(query)
+	if len(terms) == 0 {
+		return nil, ErrBlankSearch
+	}
+
+	var results []SearchResult
+	if i.noFTS5 {
+		results = scoredSearch(friends, terms, false)
+	} else {
+		var err error
+		if results, err = i.ftsSearch(friends, terms); err != nil {
+			return nil, err
+		}
+	}
+
+	matched := make(map[string]bool)
+	for _, result := range results {
+		matched[result.Friend.ID] = true
+	}
+
+	unmatched := FriendsList{}
+	for _, friend := range friends {
+		if !matched[friend.ID] {
+			unmatched = append(unmatched, friend)
+		}
+	}
+
+	return append(results, scoredSearch(unmatched, terms, true)...), nil
+}
+
+// Searches the friends with a throwaway index. Use a SearchIndex to search the same friends more than once
+func SearchFriends(friends FriendsList, query string) ([]SearchResult, error) {
+	index, err := NewSearchIndex()
+	if err != nil {
+		return nil, err
+	}
+	defer index.Close()
+
+	return index.Search(friends, query)
+}
+
+// Returns the friends that match every term as a prefix in the index, best match first
+func (i *SearchIndex) ftsSearch(friends FriendsList, terms []string) ([]SearchResult, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if err := i.sync(friends); err != nil {
+		return nil, err
+	}
+
+	byID := make(map[string]Friend, len(friends))
+	for _, friend := range friends {
+		byID[friend.ID] = friend
+	}
+
+	// Terms only contain letters and digits so they can be quoted as they are
+	match := make([]string, len(terms))
+	for j, term := range terms {
+		match[j] = `"` + term + `"*`
+	}
+
+	rows, err := i.db.Query("SELECT friendId, -"+searchRankSQL+" FROM search WHERE search MATCH ? ORDER BY "+searchRankSQL,
+		strings.Join(match, " "))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var id string
+		var score float64
+		if err := rows.Scan(&id, &score); err != nil {
+			return nil, err
+		}
+		results = append(results, SearchResult{Friend: byID[id], Score: score})
+	}
+
+	return results, rows.Err()
+}
+
+// Scores the friends without FTS5 and returns the ones that match every term, best match first.
+// With fuzzy set, words within a couple of edits of a term also match but count for less
+func scoredSearch(friends FriendsList, terms []string, fuzzy bool) []SearchResult {
+	results := []SearchResult{}
+	for _, friend := range friends {
+		if score, ok := scoreFriend(friend, terms, fuzzy); ok {
+			results = append(results, SearchResult{Friend: friend, Score: score, Fuzzy: fuzzy})
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Friend.Name < results[j].Friend.Name
+	})
+	return results
+}
+
+// Adds up how well each term matches the friend, using the best match for each term.
+// Returns false if any of the terms don't match at all
+func scoreFriend(friend Friend, terms []string, fuzzy bool) (float64, bool) {
+	columns := []struct {
+		words  []string
+		weight float64
+	}{
+		{searchTerms(friend.Name), 10},
+		{searchTerms(strings.Join(friend.Tags, " ")), 5},
+		{searchTerms(friend.Notes), 1},
+		{searchTerms(searchableFields(friend)), 2},
+	}
+
+	var score float64
+	for _, term := range terms {
+		var best float64
+		for _, column := range columns {
+			for _, word := range column.words {
+				if strings.HasPrefix(word, term) {
+					best = max(best, column.weight)
+				} else if fuzzy {
+					if edits := editDistance(term, word); edits <= allowedEdits(term) {
+						best = max(best, column.weight/float64(1+edits))
+					}
+				}
+			}
+		}
+
+		if best == 0 {
+			return 0, false
+		}
+		score += best
+	}
+
+	return score, true
+}
+
+// Splits text into lower case words, ignoring punctuation
+func searchTerms(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+// Joins the friend's custom field values into text that can be searched
+func searchableFields(friend Friend) string {
+	values := make([]string, 0, len(friend.Fields))
+	for _, name := range fieldNames(friend.Fields, nil) {
+		values = append(values, FormatFieldValue(friend.Fields[name]))
+	}
+	return strings.Join(values, " ")
+}
+
+// How many spelling mistakes a term can have and still fuzzy match. Short terms have to be spelt right
+func allowedEdits(term string) int {
+	switch length := len([]rune(term)); {
+	case length < 4:
+		return 0
+	case length < 8:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// Counts the insertions, deletions and substitutions needed to turn one word into the other
+func editDistance(a, b string) int {
+	source, target := []rune(a), []rune(b)
+	previous := make([]int, len(target)+1)
+	current := make([]int, len(target)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(source); i++ {
+		current[0] = i
+		for j := 1; j <= len(target); j++ {
+			cost := 1
+			if source[i-1] == target[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+
+	return previous[len(target)]
+}
@@ -0,0 +1,233 @@
+package models
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"howarethey/pkg/logger"
+)
+
+// SeedFile is the declarative list of friends kept in friends.yaml
+type SeedFile struct {
+	Friends []SeedFriend `yaml:"friends"`
+}
+
+// SeedFriend is a single entry in the seed file. Key is what ties the entry to a row in the db
+// so it must stay the same when the name changes. It defaults to the hyphenated name if it's not set
+type SeedFriend struct {
+	Key           string                 `yaml:"key"`
+	Name          string                 `yaml:"name"`
+	LastContacted string                 `yaml:"lastContacted"`
+	Birthday      string                 `yaml:"birthday"`
+	Notes         string                 `yaml:"notes"`
+	Tags          []string               `yaml:"tags"`
+	Fields        map[string]interface{} `yaml:"fields"`
+}
+
+// SeedReport counts what happened to the db when the seed file was synced
+type SeedReport struct {
+	Created   int
+	Updated   int
+	Unchanged int
+	Pruned    int
+}
+
+// Reads and validates the seed file at the path provided
+func LoadSeedFile(path string) (SeedFile, error) {
+	var seed SeedFile
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return seed, err
+	}
+
+	if err := yaml.Unmarshal(data, &seed); err != nil {
+		return seed, err
+	}
+
+	keys := make(map[string]bool)
+	for i, entry := range seed.Friends {
+		if entry.Key == "" {
+			entry.Key = seedKeyFromName(entry.Name)
+			seed.Friends[i].Key = entry.Key
+		}
+
+		if err := ValidateFriend(entry.toFriend()); err != nil {
+			return seed, fmt.Errorf("entry %d (%s): %w", i+1, entry.Key, err)
+		}
+
+		if keys[entry.Key] {
+			return seed, fmt.Errorf("entry %d: key %s is used more than once", i+1, entry.Key)
+		}
+		keys[entry.Key] = true
+	}
+
+	return seed, nil
+}
+
+// Reconciles the friends in the seed file into the db inside a single transaction.
+// Entries are matched to rows by their key. Name, Birthday and Notes are kept in line with the file
+// but LastContacted is only used when the friend is created, as the app updates it as you get in touch.
+// If a friend with the same name already exists but didn't come from the seed file, it is adopted
+// rather than duplicated. If prune is set, friends that came from the seed file but are no longer in it are moved to the trash
+func SyncSeed(db *sql.DB, seed SeedFile, prune bool) (SeedReport, error) {
+	var report SeedReport
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	keys := make(map[string]bool)
+	for _, entry := range seed.Friends {
+		keys[entry.Key] = true
+
+		status, err := syncSeedFriend(WithActor(tx, ActorSeed), entry)
+		if err != nil {
+			return report, fmt.Errorf("failed to sync %s: %w", entry.Key, err)
+		}
+
+		switch status {
+		case ImportStatusCreated:
+			report.Created++
+		case ImportStatusUpdated:
+			report.Updated++
+		default:
+			report.Unchanged++
+		}
+	}
+
+	if prune {
+		rows, err := tx.Query("SELECT id, name, seedKey FROM friends WHERE seedKey != '' AND deletedAt = ''")
+		if err != nil {
+			return report, err
+		}
+
+		var removed FriendsList
+		for rows.Next() {
+			var (
+				friend Friend
+				key    string
+			)
+			if err := rows.Scan(&friend.ID, &friend.Name, &key); err != nil {
+				rows.Close()
+				return report, err
+			}
+			if !keys[key] {
+				removed = append(removed, friend)
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return report, err
+		}
+
+		for _, friend := range removed {
+			if err := DeleteFriend(WithActor(tx, ActorSeed), friend); err != nil {
+				return report, err
+			}
+			report.Pruned++
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Synced seed file. Created: %d, updated: %d, unchanged: %d, pruned: %d",
+		report.Created, report.Updated, report.Unchanged, report.Pruned)
+
+	return report, nil
+}
+
+func syncSeedFriend(tx DBTX, entry SeedFriend) (string, error) {
+	current, err := scanFriend(tx.QueryRow("SELECT "+friendColumns+" FROM friends WHERE seedKey = ?", entry.Key))
+	if err == sql.ErrNoRows {
+		// Adopt a friend that was added through the API before the seed file existed
+		current, err = scanFriend(tx.QueryRow("SELECT "+friendColumns+" FROM friends WHERE seedKey = '' AND deletedAt = '' AND name = ? ORDER BY id LIMIT 1", entry.Name))
+		if err == nil {
+			if _, err := tx.Exec("UPDATE friends SET seedKey = ? WHERE id = ?", entry.Key, current.ID); err != nil {
+				return "", err
+			}
+			logger.LogMessage(logger.LogLevelDebug, "Adopted %s (ID:%s) into the seed file as %s", current.Name, current.ID, entry.Key)
+		}
+	}
+
+	if err == sql.ErrNoRows {
+		if _, err := insertFriend(tx, entry.toFriend(), entry.Key); err != nil {
+			return "", err
+		}
+		logger.LogMessage(logger.LogLevelInfo, entry.Name+" added from the seed file")
+		return ImportStatusCreated, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	if current.Tags, err = loadTagsForFriend(tx, current.ID); err != nil {
+		return "", err
+	}
+
+	fieldsByFriend, err := loadFriendFields(tx, current.ID)
+	if err != nil {
+		return "", err
+	}
+	current.Fields = fieldsByFriend[current.ID]
+
+	// The file is the source of truth so anyone still in it comes back out of the trash
+	restored := false
+	if current.DeletedAt != "" {
+		if err := RestoreFriend(tx, current.ID); err != nil {
+			return "", err
+		}
+		current.DeletedAt = ""
+		restored = true
+	}
+
+	updated := current
+	updated.Name = entry.Name
+	updated.Birthday = entry.Birthday
+	updated.Notes = entry.Notes
+	if entry.Tags != nil {
+		if updated.Tags, err = NormaliseTags(entry.Tags); err != nil {
+			return "", err
+		}
+	}
+	if entry.Fields != nil {
+		if updated.Fields, err = NormaliseFields(tx, entry.Fields); err != nil {
+			return "", err
+		}
+	}
+
+	if !friendChanged(current, updated) {
+		if restored {
+			return ImportStatusUpdated, nil
+		}
+		return ImportStatusSkipped, nil
+	}
+
+	if err := SqlUpdateFriend(tx, current.ID, &updated); err != nil {
+		return "", err
+	}
+	return ImportStatusUpdated, nil
+}
+
+func (entry SeedFriend) toFriend() Friend {
+	return Friend{
+		Name:          entry.Name,
+		LastContacted: entry.LastContacted,
+		Birthday:      entry.Birthday,
+		Notes:         entry.Notes,
+		Tags:          entry.Tags,
+		Fields:        entry.Fields,
+	}
+}
+
+func seedKeyFromName(name string) string {
+	return strings.ReplaceAll(strings.ToLower(strings.TrimSpace(name)), " ", "-")
+}
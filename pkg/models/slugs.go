@@ -0,0 +1,165 @@
+package models
+
+import (
+	"database/sql"
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// ErrSlugTaken is returned when saving a slug another friend already has
+var ErrSlugTaken = errors.New("slug is already used by another friend")
+
+// Slugs are lower case letters and numbers separated by single hyphens, i.e. sam-smith-2
+var slugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+const maxSlugLength = 80
+
+// Letters that don't break down into a plain letter and an accent
+var transliterations = map[rune]string{
+	'ß': "ss", 'æ': "ae", 'Æ': "ae", 'œ': "oe", 'Œ': "oe", 'ø': "o", 'Ø': "o", 'ł': "l", 'Ł': "l",
+	'đ': "d", 'Đ': "d", 'ð': "d", 'Ð': "d", 'þ': "th", 'Þ': "th", 'ı': "i",
+}
+
+// Turns a name into a URL-safe slug, i.e. "Zoë O'Brien" becomes "zoe-o-brien".
+// Accents are dropped and anything that can't be written with a-z or 0-9 is left out.
+// Slugs always contain a letter so they can't be mistaken for an ID
+func Slugify(name string) string {
+	var slug strings.Builder
+	hyphen := false
+	for _, r := range norm.NFD.String(name) {
+		if unicode.Is(unicode.Mn, r) {
+			continue
+		}
+
+		text, ok := transliterations[r]
+		if !ok {
+			text = string(unicode.ToLower(r))
+		}
+
+		for _, c := range text {
+			if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') {
+				if hyphen && slug.Len() > 0 {
+					slug.WriteByte('-')
+				}
+				slug.WriteRune(c)
+				hyphen = false
+			} else {
+				hyphen = true
+			}
+		}
+	}
+
+	result := slug.String()
+	if len(result) > maxSlugLength-10 {
+		result = strings.TrimRight(result[:maxSlugLength-10], "-")
+	}
+	if !strings.ContainsFunc(result, unicode.IsLetter) {
+		result = strings.Trim("friend-"+result, "-")
+	}
+	return result
+}
+
+// Checks a slug someone has chosen is URL-safe and can't be mistaken for an ID
+func ValidateSlug(slug string) error {
+	if len(slug) > maxSlugLength {
+		return fieldError("Slug", "slug must be "+strconv.Itoa(maxSlugLength)+" characters or less")
+	}
+	if !slugPattern.MatchString(slug) {
+		return fieldError("Slug", "slug must only contain lower case letters and numbers separated by hyphens. "+slug+" does not match")
+	}
+	if !strings.ContainsFunc(slug, unicode.IsLetter) {
+		return fieldError("Slug", "slug must contain at least one letter")
+	}
+	return nil
+}
+
+// Checks no other friend has the slug, including friends in the trash
+func checkSlugAvailable(db DBTX, slug string, friendID string) error {
+	var count int
+	if err := db.QueryRow("SELECT COUNT(*) FROM friends WHERE slug = ? AND id != ?", slug, friendID).Scan(&count); err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrSlugTaken
+	}
+	return nil
+}
+
+// Generates a slug for the name that no other friend has by adding a number to the end if needed, i.e. sam-smith-2
+func uniqueSlug(db DBTX, name string, friendID string) (string, error) {
+	base := Slugify(name)
+	slug := base
+	for i := 2; ; i++ {
+		err := checkSlugAvailable(db, slug, friendID)
+		if err == nil {
+			return slug, nil
+		}
+		if !errors.Is(err, ErrSlugTaken) {
+			return "", err
+		}
+		slug = base + "-" + strconv.Itoa(i)
+	}
+}
+
+// Works out the slug to save for the friend. A slug they've chosen is checked, otherwise one is generated from their name
+func slugForFriend(db DBTX, friend Friend) (string, error) {
+	if friend.Slug == "" {
+		return uniqueSlug(db, friend.Name, friend.ID)
+	}
+
+	if err := ValidateSlug(friend.Slug); err != nil {
+		return "", err
+	}
+	if err := checkSlugAvailable(db, friend.Slug, friend.ID); err != nil {
+		return "", err
+	}
+	return friend.Slug, nil
+}
+
+// Generates slugs for friends saved before slugs were added
+func backfillSlugs(db DBTX) error {
+	rows, err := db.Query("SELECT id, name FROM friends WHERE slug = '' ORDER BY id")
+	if err != nil {
+		return err
+	}
+
+	var friends []Friend
+	for rows.Next() {
+		var friend Friend
+		if err := rows.Scan(&friend.ID, &friend.Name); err != nil {
+			rows.Close()
+			return err
+		}
+		friends = append(friends, friend)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, friend := range friends {
+		slug, err := uniqueSlug(db, friend.Name, friend.ID)
+		if err != nil {
+			return err
+		}
+		if _, err := db.Exec("UPDATE friends SET slug = ? WHERE id = ?", slug, friend.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Looks up the ID of the friend with the ID or slug provided, including friends in the trash
+func ResolveFriendID(db DBTX, idOrSlug string) (string, error) {
+	var id string
+	err := db.QueryRow("SELECT id FROM friends WHERE id = ? OR slug = ?", idOrSlug, idOrSlug).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrFriendNotFound
+	}
+	return id, err
+}
@@ -0,0 +1,191 @@
+package models
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+const createTagsTablesSQL = `
+    CREATE TABLE IF NOT EXISTS tags (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL UNIQUE
+    );
+    CREATE TABLE IF NOT EXISTS friend_tags (
+		friendId INTEGER NOT NULL,
+		tagId INTEGER NOT NULL,
+		PRIMARY KEY (friendId, tagId)
+    );`
+
+// TagCount is a tag and how many friends have it
+type TagCount struct {
+	Name  string
+	Count int
+}
+
+// Tags are stored in lower case without surrounding whitespace so "Family" and "family " are the same tag
+func NormaliseTag(tag string) string {
+	return strings.ToLower(strings.TrimSpace(tag))
+}
+
+// Normalises, de-duplicates and sorts the tags. Returns an error if any are blank or too long
+func NormaliseTags(tags []string) ([]string, error) {
+	if tags == nil {
+		return nil, nil
+	}
+
+	seen := make(map[string]bool)
+	normalised := []string{}
+	for _, tag := range tags {
+		tag = NormaliseTag(tag)
+		if tag == "" {
+			return nil, fieldError("Tags", "tags must not be blank")
+		}
+		if len(tag) > 50 {
+			return nil, fieldError("Tags", "tags must be 50 characters or less. "+tag+" is too long")
+		}
+		if !seen[tag] {
+			seen[tag] = true
+			normalised = append(normalised, tag)
+		}
+	}
+
+	sort.Strings(normalised)
+	return normalised, nil
+}
+
+// Checks if the friend has the tag
+func (f Friend) HasTag(tag string) bool {
+	tag = NormaliseTag(tag)
+	for _, t := range f.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the friends that have all of the tags provided
+func FilterByTags(friends FriendsList, tags []string) FriendsList {
+	filtered := FriendsList{}
+	for _, friend := range friends {
+		matches := true
+		for _, tag := range tags {
+			if !friend.HasTag(tag) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			filtered = append(filtered, friend)
+		}
+	}
+	return filtered
+}
+
+// Replaces the friend's tags with the tags provided. Tags that don't exist yet are created
+func setFriendTags(db DBTX, friendID string, tags []string) error {
+	if _, err := db.Exec("DELETE FROM friend_tags WHERE friendId = ?", friendID); err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		if _, err := db.Exec("INSERT OR IGNORE INTO tags(name) VALUES(?)", tag); err != nil {
+			return err
+		}
+		if _, err := db.Exec("INSERT INTO friend_tags(friendId, tagId) SELECT ?, id FROM tags WHERE name = ?", friendID, tag); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Loads the tags for every friend, keyed by friend ID
+func loadFriendTags(db DBTX) (map[string][]string, error) {
+	rows, err := db.Query("SELECT ft.friendId, t.name FROM friend_tags ft JOIN tags t ON t.id = ft.tagId ORDER BY t.name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tagsByFriend := make(map[string][]string)
+	for rows.Next() {
+		var friendID, tag string
+		if err := rows.Scan(&friendID, &tag); err != nil {
+			return nil, err
+		}
+		tagsByFriend[friendID] = append(tagsByFriend[friendID], tag)
+	}
+
+	return tagsByFriend, rows.Err()
+}
+
+// Loads the tags for a single friend
+func loadTagsForFriend(db DBTX, friendID string) ([]string, error) {
+	rows, err := db.Query("SELECT t.name FROM friend_tags ft JOIN tags t ON t.id = ft.tagId WHERE ft.friendId = ? ORDER BY t.name", friendID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tags []string
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// Lists every tag in use along with how many friends have it. Friends in the trash aren't counted
+func ListTags(db DBTX) ([]TagCount, error) {
+	rows, err := db.Query(`SELECT t.name, COUNT(f.id) FROM tags t
+		JOIN friend_tags ft ON ft.tagId = t.id
+		JOIN friends f ON f.id = ft.friendId AND f.deletedAt = ''
+		GROUP BY t.name ORDER BY t.name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tags := []TagCount{}
+	for rows.Next() {
+		var tag TagCount
+		if err := rows.Scan(&tag.Name, &tag.Count); err != nil {
+			return nil, err
+		}
+		tags = append(tags, tag)
+	}
+
+	return tags, rows.Err()
+}
+
+// TagSchedule is a cron schedule for picking a friend with a particular tag
+type TagSchedule struct {
+	Tag      string
+	Schedule string
+}
+
+// Parses tag schedules in the form "family=0 7 * * 1;work=0 7 1 * *"
+func ParseTagSchedules(value string) ([]TagSchedule, error) {
+	schedules := []TagSchedule{}
+	for _, entry := range strings.Split(value, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+
+		tag, schedule, found := strings.Cut(entry, "=")
+		tag = NormaliseTag(tag)
+		schedule = strings.TrimSpace(schedule)
+		if !found || tag == "" || schedule == "" {
+			return nil, errors.New("tag schedules must be in the form tag=schedule. " + entry + " is not valid")
+		}
+
+		schedules = append(schedules, TagSchedule{Tag: tag, Schedule: schedule})
+	}
+	return schedules, nil
+}
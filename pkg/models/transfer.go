@@ -0,0 +1,277 @@
+package models
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"howarethey/pkg/logger"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	ImportStatusCreated = "created"
+	ImportStatusUpdated = "updated"
+	ImportStatusSkipped = "skipped"
+	ImportStatusFailed  = "failed"
+)
+
+// Column order used for CSV imports and exports
+var csvHeader = []string{"ID", "Name", "LastContacted", "Birthday", "Notes", "Tags"}
+
+// Tags are kept in a single CSV column separated by this
+const csvTagSeparator = ";"
+
+// ImportResult is the outcome of importing a single row
+type ImportResult struct {
+	Row    int
+	ID     string
+	Name   string
+	Status string
+	Error  string `json:",omitempty"`
+}
+
+// ImportReport summarises an import. Committed is false if it was a dry run
+// or if any of the rows failed, in which case nothing was written to the db
+type ImportReport struct {
+	DryRun    bool
+	Committed bool
+	Created   int
+	Updated   int
+	Skipped   int
+	Failed    int
+	Results   []ImportResult
+}
+
+// Writes the friends list out as CSV, including a header row
+func WriteFriendsCSV(w io.Writer, friends FriendsList) error {
+	writer := csv.NewWriter(w)
+
+	if err := writer.Write(csvHeader); err != nil {
+		return err
+	}
+
+	for _, friend := range friends {
+		record := []string{friend.ID, friend.Name, friend.LastContacted, friend.Birthday, friend.Notes,
+			strings.Join(friend.Tags, csvTagSeparator)}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// Reads a friends list from CSV. The first row must be a header containing at least a Name column.
+// Columns are matched by header name so they can be in any order and unknown columns are ignored
+func ParseFriendsCSV(r io.Reader) (FriendsList, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return FriendsList{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	columns := make(map[string]int)
+	for i, column := range header {
+		for _, known := range csvHeader {
+			if strings.EqualFold(strings.TrimSpace(column), known) {
+				columns[known] = i
+			}
+		}
+	}
+
+	if _, ok := columns["Name"]; !ok {
+		return nil, errors.New("csv header must contain a Name column")
+	}
+
+	field := func(record []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	friends := FriendsList{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		friend := Friend{
+			ID:            field(record, "ID"),
+			Name:          field(record, "Name"),
+			LastContacted: field(record, "LastContacted"),
+			Birthday:      field(record, "Birthday"),
+			Notes:         field(record, "Notes"),
+		}
+
+		// Without a Tags column the friend's tags are left alone
+		if _, ok := columns["Tags"]; ok {
+			friend.Tags = []string{}
+			if tags := field(record, "Tags"); tags != "" {
+				friend.Tags = strings.Split(tags, csvTagSeparator)
+			}
+		}
+
+		friends = append(friends, friend)
+	}
+
+	return friends, nil
+}
+
+// Reads a friends list from a JSON array in the same format returned by GET /friends
+func ParseFriendsJSON(r io.Reader) (FriendsList, error) {
+	var friends FriendsList
+	if err := json.NewDecoder(r).Decode(&friends); err != nil {
+		return nil, err
+	}
+	return friends, nil
+}
+
+// Imports the friends into the db inside a single transaction.
+// Rows with an ID that exists are updated, rows that are identical to an existing friend are skipped
+// and everything else is created. If any row fails validation, or dryRun is set, the transaction
+// is rolled back and the report describes what would have happened
+func ImportFriends(db *sql.DB, friends FriendsList, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Results: []ImportResult{}}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return report, err
+	}
+	defer tx.Rollback() //nolint:errcheck
+
+	existing, err := BuildFriendsList(tx)
+	if err != nil {
+		return report, err
+	}
+
+	for i, friend := range friends {
+		result := ImportResult{Row: i + 1, ID: friend.ID, Name: friend.Name}
+
+		if err := importFriend(WithActor(tx, ActorImport), friend, existing, &result); err != nil {
+			result.Status = ImportStatusFailed
+			result.Error = err.Error()
+		}
+
+		switch result.Status {
+		case ImportStatusCreated:
+			report.Created++
+		case ImportStatusUpdated:
+			report.Updated++
+		case ImportStatusSkipped:
+			report.Skipped++
+		case ImportStatusFailed:
+			report.Failed++
+		}
+
+		report.Results = append(report.Results, result)
+	}
+
+	if dryRun || report.Failed > 0 {
+		logger.LogMessage(logger.LogLevelInfo, "Import rolled back. Dry run: %t, failed rows: %d", dryRun, report.Failed)
+		return report, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return report, err
+	}
+	report.Committed = true
+
+	logger.LogMessage(logger.LogLevelInfo, "Imported friends. Created: %d, updated: %d, skipped: %d",
+		report.Created, report.Updated, report.Skipped)
+
+	return report, nil
+}
+
+// Imports a single row and sets the result status. Returns an error if the row failed
+func importFriend(tx DBTX, friend Friend, existing FriendsList, result *ImportResult) error {
+	if err := ValidateFriend(friend); err != nil {
+		return err
+	}
+
+	if friend.ID == "" {
+		for _, current := range existing {
+			candidate := friend
+			candidate.ID = current.ID
+			if candidate.Tags == nil {
+				candidate.Tags = current.Tags
+			}
+			if candidate.Fields == nil {
+				candidate.Fields = current.Fields
+			}
+			if candidate.Slug == "" {
+				candidate.Slug = current.Slug
+			}
+			if !friendChanged(current, candidate) {
+				result.ID = current.ID
+				result.Status = ImportStatusSkipped
+				return nil
+			}
+		}
+
+		id, err := insertFriend(tx, friend, "")
+		if err != nil {
+			return err
+		}
+
+		result.ID = id
+		result.Status = ImportStatusCreated
+		return nil
+	}
+
+	if _, err := strconv.Atoi(friend.ID); err != nil {
+		return fmt.Errorf("id must be a number. %s does not match", friend.ID)
+	}
+
+	current, err := SqlGetFriend(tx, friend.ID)
+	if errors.Is(err, ErrFriendNotFound) {
+		if _, err := insertFriend(tx, friend, ""); err != nil {
+			return err
+		}
+		result.Status = ImportStatusCreated
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if current.DeletedAt != "" {
+		return fmt.Errorf("friend with ID %s is in the trash and must be restored first", friend.ID)
+	}
+
+	if friend.Tags == nil {
+		friend.Tags = current.Tags
+	}
+	if friend.Fields == nil {
+		friend.Fields = current.Fields
+	}
+	if friend.Slug == "" {
+		friend.Slug = current.Slug
+	}
+	if !friendChanged(*current, friend) {
+		result.Status = ImportStatusSkipped
+		return nil
+	}
+
+	if err := SqlUpdateFriend(tx, friend.ID, &friend); err != nil {
+		return err
+	}
+	result.Status = ImportStatusUpdated
+	return nil
+}
@@ -0,0 +1,115 @@
+package models
+
+import (
+	"time"
+
+	"howarethey/pkg/logger"
+)
+
+// Tables and columns holding data that belongs to a friend. Rows in these are deleted when the friend is purged
+var friendDataColumns = []struct {
+	table  string
+	column string
+}{
+	{"friend_tags", "friendId"},
+	{"contact_methods", "friendId"},
+	{"friend_fields", "friendId"},
+	{"relationships", "friendId"},
+	{"relationships", "relatedId"},
+	{"gift_ideas", "friendId"},
+	{"friend_photos", "friendId"},
+}
+
+// Builds the list of friends in the trash, most recently deleted first
+func BuildTrashList(db DBTX) (FriendsList, error) {
+	rows, err := db.Query("SELECT " + friendColumns + " FROM friends WHERE deletedAt != '' ORDER BY deletedAt DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	trash := FriendsList{}
+	for rows.Next() {
+		f, err := scanFriend(rows)
+		if err != nil {
+			return nil, err
+		}
+		trash = append(trash, f)
+	}
+
+	return trash, rows.Err()
+}
+
+// Takes a friend back out of the trash
+func RestoreFriend(db DBTX, id string) error {
+	before, err := SqlGetFriend(db, id)
+	if err != nil {
+		return err
+	}
+	if before.DeletedAt == "" {
+		return ErrFriendNotFound
+	}
+
+	if _, err := db.Exec("UPDATE friends SET deletedAt = '', version = version + 1 WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	after := *before
+	after.DeletedAt = ""
+	if err := recordAudit(db, id, AuditActionRestore, before, &after); err != nil {
+		return err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Friend with ID %s restored from the trash", id)
+	return nil
+}
+
+// Permanently deletes the friends that were moved to the trash before the cutoff, all in one transaction.
+// Returns how many were deleted
+func PurgeDeletedFriends(db DBTX, cutoff time.Time) (int, error) {
+	var expired FriendsList
+	err := withTransaction(db, func(tx DBTX) error {
+		rows, err := tx.Query("SELECT "+friendColumns+" FROM friends WHERE deletedAt != '' AND deletedAt < ?", cutoff.UTC().Format(time.RFC3339))
+		if err != nil {
+			return err
+		}
+
+		for rows.Next() {
+			f, err := scanFriend(rows)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			expired = append(expired, f)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		for _, friend := range expired {
+			if _, err := tx.Exec("DELETE FROM friends WHERE id = ?", friend.ID); err != nil {
+				return err
+			}
+			for _, data := range friendDataColumns {
+				if _, err := tx.Exec("DELETE FROM "+data.table+" WHERE "+data.column+" = ?", friend.ID); err != nil {
+					return err
+				}
+			}
+
+			friend := friend
+			if err := recordAudit(tx, friend.ID, AuditActionPurge, &friend, nil); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if len(expired) > 0 {
+		logger.LogMessage(logger.LogLevelInfo, "Purged %d friends from the trash", len(expired))
+	}
+	return len(expired), nil
+}
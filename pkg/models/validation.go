@@ -0,0 +1,16 @@
+package models
+
+// ValidationError is returned when a value sent for a field isn't valid. Field is the name of the field as it's sent,
+// i.e. Birthday, or Fields.partner for a custom field
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func fieldError(field string, message string) error {
+	return &ValidationError{Field: field, Message: message}
+}
@@ -0,0 +1,698 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"howarethey/pkg/logger"
+)
+
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// Secrets shorter than this are too easy to guess
+const minWebhookSecretLength = 16
+
+// How many finished deliveries are kept in each webhook's log. Pending deliveries are always kept until they finish
+const webhookDeliveryHistory = 100
+
+// ErrWebhookNotFound is returned when a webhook doesn't exist
+var ErrWebhookNotFound = errors.New("webhook not found")
+
+// ErrPrivateWebhookAddress is returned when a webhook would be sent to this machine or a private network
+var ErrPrivateWebhookAddress = errors.New("webhooks can't be sent to private or local addresses")
+
+const createWebhooksTablesSQL = `
+    CREATE TABLE IF NOT EXISTS webhooks (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		url TEXT NOT NULL,
+		events TEXT NOT NULL DEFAULT '',
+		secret TEXT NOT NULL,
+		createdAt TEXT NOT NULL
+    );
+    CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		webhookId INTEGER NOT NULL,
+		eventId INTEGER NOT NULL,
+		eventType TEXT NOT NULL,
+		status TEXT NOT NULL,
+		attempts INTEGER NOT NULL DEFAULT 0,
+		responseStatus INTEGER NOT NULL DEFAULT 0,
+		error TEXT NOT NULL DEFAULT '',
+		createdAt TEXT NOT NULL,
+		updatedAt TEXT NOT NULL
+    );
+    CREATE INDEX IF NOT EXISTS webhook_deliveries_webhook ON webhook_deliveries (webhookId);`
+
+// Columns added to webhook_deliveries so retries are kept in the db and carry on after a restart
+var webhookDeliveriesColumnMigrations = []struct {
+	name       string
+	definition string
+}{
+	{"payload", "TEXT NOT NULL DEFAULT ''"},
+	{"nextAttemptAt", "TEXT NOT NULL DEFAULT ''"},
+}
+
+// Webhook is a URL that events are sent to. Events lists the types of event it wants, or every type if it's empty.
+// Secret is used to sign the payloads and is only returned when the webhook is created
+type Webhook struct {
+	ID        int64
+	URL       string
+	Events    []string
+	Secret    string `json:",omitempty"`
+	CreatedAt string
+}
+
+// WebhookDelivery is an event sent, or being sent, to a webhook. Error and ResponseStatus are from the last attempt,
+// and NextAttemptAt is when a pending delivery will be tried next
+type WebhookDelivery struct {
+	ID             int64
+	WebhookID      int64
+	EventID        int64
+	EventType      string
+	Status         string
+	Attempts       int
+	ResponseStatus int    `json:",omitempty"`
+	Error          string `json:",omitempty"`
+	NextAttemptAt  string `json:",omitempty"`
+	CreatedAt      string
+	UpdatedAt      string
+	// The event as it's sent to the webhook
+	Payload string `json:"-"`
+}
+
+// Checks the webhook's URL and event types. A secret is made up if one isn't provided
+func ValidateWebhook(webhook Webhook) (Webhook, error) {
+	webhook.URL = strings.TrimSpace(webhook.URL)
+	if link, err := url.Parse(webhook.URL); err != nil || link.Host == "" || (link.Scheme != "http" && link.Scheme != "https") {
+		return webhook, fieldError("URL", "url must be an http or https link")
+	}
+
+	var eventTypes []string
+	for _, eventType := range webhook.Events {
+		if !IsEventType(eventType) {
+			return webhook, fieldError("Events", "events must be one of "+strings.Join(EventTypes, ", "))
+		}
+		if !containsString(eventTypes, eventType) {
+			eventTypes = append(eventTypes, eventType)
+		}
+	}
+	webhook.Events = eventTypes
+
+	if webhook.Secret == "" {
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return webhook, err
+		}
+		webhook.Secret = hex.EncodeToString(secret)
+	} else if len(webhook.Secret) < minWebhookSecretLength {
+		return webhook, fieldError("Secret", "secret must be at least "+strconv.Itoa(minWebhookSecretLength)+" characters")
+	}
+
+	return webhook, nil
+}
+
+// Checks if the address is on this machine or a private network, like the cloud metadata service at 169.254.169.254
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// Checks if the host is one of the allowed hosts, which can be private or local
+func isAllowedWebhookHost(host string, allowedHosts []string) bool {
+	for _, allowed := range allowedHosts {
+		if strings.EqualFold(strings.TrimSpace(allowed), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks the webhook's URL doesn't point at this machine or a private network, unless its host is allowed.
+// Hosts that can't be looked up are let through, since they're checked again every time a payload is sent
+func CheckWebhookHost(ctx context.Context, rawURL string, allowedHosts []string) error {
+	link, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return fieldError("URL", "url must be an http or https link")
+	}
+	host := link.Hostname()
+	if isAllowedWebhookHost(host, allowedHosts) {
+		return nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil
+	}
+	for _, address := range addresses {
+		if isPrivateAddress(address.IP) {
+			return fieldError("URL", "url must not point at a private or local address")
+		}
+	}
+	return nil
+}
+
+// Creates the client payloads are sent with. It refuses to connect to private or local addresses, checking the address
+// it's actually connecting to so a host can't be changed to point somewhere else after the webhook is added.
+// Hosts in allowedHosts can be private or local
+func NewWebhookClient(timeout time.Duration, allowedHosts []string) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	guardedDialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateAddress(ip) {
+				return ErrPrivateWebhookAddress
+			}
+			return nil
+		},
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// Proxies would be connected to instead of the webhook, so they're not used
+	transport.Proxy = nil
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		host, _, err := net.SplitHostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		if isAllowedWebhookHost(host, allowedHosts) {
+			return dialer.DialContext(ctx, network, address)
+		}
+		return guardedDialer.DialContext(ctx, network, address)
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+		// Redirects could point anywhere, so the webhook has to respond itself
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Checks if the webhook wants events of this type
+func (w Webhook) Wants(eventType string) bool {
+	return len(w.Events) == 0 || containsString(w.Events, eventType)
+}
+
+const webhookColumns = "id, url, events, secret, createdAt"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var (
+		webhook Webhook
+		events  string
+	)
+	if err := row.Scan(&webhook.ID, &webhook.URL, &events, &webhook.Secret, &webhook.CreatedAt); err != nil {
+		return webhook, err
+	}
+
+	webhook.Events = []string{}
+	if events != "" {
+		webhook.Events = strings.Split(events, ",")
+	}
+
+	secret, err := fieldCipher.Decrypt(webhook.Secret)
+	if err != nil {
+		return webhook, err
+	}
+	webhook.Secret = secret
+
+	return webhook, nil
+}
+
+// Adds a webhook and returns it with its secret
+func AddWebhook(db DBTX, webhook Webhook) (Webhook, error) {
+	webhook, err := ValidateWebhook(webhook)
+	if err != nil {
+		return webhook, err
+	}
+
+	// The secret is needed to sign payloads so it's encrypted rather than hashed
+	secret, err := fieldCipher.Encrypt(webhook.Secret)
+	if err != nil {
+		return webhook, err
+	}
+
+	result, err := db.Exec("INSERT INTO webhooks(url, events, secret, createdAt) VALUES(?, ?, ?, ?)",
+		webhook.URL, strings.Join(webhook.Events, ","), secret, time.Now().UTC().Format(time.RFC3339))
+	if err != nil {
+		return webhook, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return webhook, err
+	}
+
+	logger.LogMessage(logger.LogLevelInfo, "Added a webhook for %s", webhook.URL)
+	return GetWebhook(db, id)
+}
+
+// Gets a single webhook, including its secret
+func GetWebhook(db DBTX, id int64) (Webhook, error) {
+	webhook, err := scanWebhook(db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return webhook, ErrWebhookNotFound
+	}
+	return webhook, err
+}
+
+// Lists the webhooks in the order they were added, including their secrets
+func ListWebhooks(db DBTX) ([]Webhook, error) {
+	rows, err := db.Query("SELECT " + webhookColumns + " FROM webhooks ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+
+	return webhooks, rows.Err()
+}
+
+// Deletes the webhook and its delivery log, including deliveries that are still being retried
+func DeleteWebhook(db DBTX, id int64) error {
+	result, err := db.Exec("DELETE FROM webhooks WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	count, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrWebhookNotFound
+	}
+
+	_, err = db.Exec("DELETE FROM webhook_deliveries WHERE webhookId = ?", id)
+	return err
+}
+
+const webhookDeliveryColumns = "id, webhookId, eventId, eventType, status, attempts, responseStatus, error, nextAttemptAt, createdAt, updatedAt, payload"
+
+func scanWebhookDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	err := row.Scan(&delivery.ID, &delivery.WebhookID, &delivery.EventID, &delivery.EventType, &delivery.Status, &delivery.Attempts,
+		&delivery.ResponseStatus, &delivery.Error, &delivery.NextAttemptAt, &delivery.CreatedAt, &delivery.UpdatedAt, &delivery.Payload)
+	if err != nil {
+		return delivery, err
+	}
+
+	delivery.Payload, err = fieldCipher.Decrypt(delivery.Payload)
+	return delivery, err
+}
+
+// Lists the webhook's deliveries, newest first
+func ListWebhookDeliveries(db DBTX, webhookID int64, limit int) ([]WebhookDelivery, error) {
+	if _, err := GetWebhook(db, webhookID); err != nil {
+		return nil, err
+	}
+
+	query := "SELECT " + webhookDeliveryColumns + " FROM webhook_deliveries WHERE webhookId = ? ORDER BY id DESC"
+	if limit > 0 {
+		query += " LIMIT " + strconv.Itoa(limit)
+	}
+
+	rows, err := db.Query(query, webhookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Starts a delivery in the webhook's log, due to be sent straight away. Only the most recent finished deliveries are kept
+func addWebhookDelivery(db DBTX, webhookID int64, event Event) (WebhookDelivery, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	// The payload has a copy of the friend's notes and custom fields, so it's encrypted like they are
+	storedPayload, err := fieldCipher.Encrypt(string(payload))
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	now := time.Now().UTC()
+	result, err := db.Exec("INSERT INTO webhook_deliveries(webhookId, eventId, eventType, status, payload, nextAttemptAt, createdAt, updatedAt) VALUES(?, ?, ?, ?, ?, ?, ?, ?)",
+		webhookID, event.ID, event.Type, WebhookDeliveryPending, storedPayload, now.Format(time.RFC3339Nano), now.Format(time.RFC3339), now.Format(time.RFC3339))
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	id, err := result.LastInsertId()
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	// Only finished deliveries are trimmed, so retries aren't lost while a webhook is down
+	_, err = db.Exec(`DELETE FROM webhook_deliveries WHERE webhookId = ? AND status != ? AND id NOT IN
+		(SELECT id FROM webhook_deliveries WHERE webhookId = ? AND status != ? ORDER BY id DESC LIMIT ?)`,
+		webhookID, WebhookDeliveryPending, webhookID, WebhookDeliveryPending, webhookDeliveryHistory)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	return scanWebhookDelivery(db.QueryRow("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE id = ?", id))
+}
+
+func updateWebhookDelivery(db DBTX, delivery WebhookDelivery) error {
+	_, err := db.Exec("UPDATE webhook_deliveries SET status = ?, attempts = ?, responseStatus = ?, error = ?, nextAttemptAt = ?, updatedAt = ? WHERE id = ?",
+		delivery.Status, delivery.Attempts, delivery.ResponseStatus, delivery.Error, delivery.NextAttemptAt, delivery.UpdatedAt, delivery.ID)
+	return err
+}
+
+// Lists the deliveries that still need to be sent, oldest first
+func pendingWebhookDeliveries(db DBTX) ([]WebhookDelivery, error) {
+	rows, err := db.Query("SELECT "+webhookDeliveryColumns+" FROM webhook_deliveries WHERE status = ? ORDER BY id", WebhookDeliveryPending)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		delivery, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+
+	return deliveries, rows.Err()
+}
+
+// Signs the payload so the receiver can check it came from here and wasn't changed on the way.
+// The timestamp is signed along with the body, i.e. "1713355200.{...}", so old payloads can't be replayed
+func SignWebhookPayload(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// WebhookDispatcher sends the events published on the bus to the webhooks that want them. Deliveries are kept in the db
+// until they succeed or run out of attempts, so retries carry on after a restart
+type WebhookDispatcher struct {
+	DB *sql.DB
+	// Defaults to a client from NewWebhookClient that doesn't allow any private or local hosts
+	Client *http.Client
+	// How many times a delivery is tried before it's marked as failed
+	MaxAttempts int
+	// How long to wait before the first retry. It doubles after every attempt that fails
+	RetryDelay time.Duration
+
+	// Wakes up the delivery loop when new deliveries are queued
+	queued chan struct{}
+}
+
+// Subscribes to the bus and sends events published from now on to the webhooks in the background until the context is cancelled.
+// Deliveries left pending from before, i.e. when the app was last running, are picked up again
+func (d *WebhookDispatcher) Start(ctx context.Context, bus *EventBus) {
+	d.queued = make(chan struct{}, 1)
+	_, events, unsubscribe := bus.Subscribe(0)
+	go d.run(ctx, bus, events, unsubscribe)
+	go d.deliver(ctx)
+}
+
+func (d *WebhookDispatcher) run(ctx context.Context, bus *EventBus, events <-chan Event, unsubscribe func()) {
+	var (
+		lastEventID int64
+		missed      []Event
+	)
+	for {
+		for _, event := range missed {
+			lastEventID = event.ID
+			d.dispatch(event)
+		}
+
+		for open := true; open; {
+			select {
+			case <-ctx.Done():
+				unsubscribe()
+				return
+			case event, ok := <-events:
+				if !ok {
+					// The bus dropped us for falling behind, so subscribe again and catch up on what was missed
+					open = false
+					continue
+				}
+				lastEventID = event.ID
+				d.dispatch(event)
+			}
+		}
+		unsubscribe()
+
+		missed, events, unsubscribe = bus.Subscribe(lastEventID)
+	}
+}
+
+// Queues the event for every webhook that wants it and wakes up the delivery loop
+func (d *WebhookDispatcher) dispatch(event Event) {
+	webhooks, err := ListWebhooks(d.DB)
+	if err != nil {
+		logger.LogMessage(logger.LogLevelError, "Failed to load webhooks: %v", err)
+		return
+	}
+
+	for _, webhook := range webhooks {
+		if !webhook.Wants(event.Type) {
+			continue
+		}
+		if _, err := d.Queue(webhook, event); err != nil {
+			logger.LogMessage(logger.LogLevelError, "Failed to queue event %d for webhook %d: %v", event.ID, webhook.ID, err)
+		}
+	}
+
+	select {
+	case d.queued <- struct{}{}:
+	default:
+	}
+}
+
+// Sends the deliveries as they fall due until the context is cancelled
+func (d *WebhookDispatcher) deliver(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.queued:
+		case <-timer.C:
+		}
+
+		next, err := d.DeliverDue(ctx)
+		if err != nil && ctx.Err() == nil {
+			logger.LogMessage(logger.LogLevelError, "Failed to send webhook deliveries: %v", err)
+		}
+
+		// Wait for the next retry, or until more deliveries are queued
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		if !next.IsZero() {
+			timer.Reset(time.Until(next))
+		}
+	}
+}
+
+// Adds a delivery of the event to the webhook's log, due to be sent by the next DeliverDue
+func (d *WebhookDispatcher) Queue(webhook Webhook, event Event) (WebhookDelivery, error) {
+	return addWebhookDelivery(d.DB, webhook.ID, event)
+}
+
+// Makes an attempt at every pending delivery that's due. Returns when the next one that's still pending is due,
+// or the zero time if none are
+func (d *WebhookDispatcher) DeliverDue(ctx context.Context) (time.Time, error) {
+	deliveries, err := pendingWebhookDeliveries(d.DB)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		next time.Time
+	)
+	// Keeps track of the soonest delivery that's still pending
+	waitFor := func(delivery WebhookDelivery) {
+		if delivery.Status != WebhookDeliveryPending {
+			return
+		}
+		due, err := time.Parse(time.RFC3339Nano, delivery.NextAttemptAt)
+		if err != nil {
+			return
+		}
+		mu.Lock()
+		if next.IsZero() || due.Before(next) {
+			next = due
+		}
+		mu.Unlock()
+	}
+
+	now := time.Now()
+	for _, delivery := range deliveries {
+		if due, err := time.Parse(time.RFC3339Nano, delivery.NextAttemptAt); err == nil && due.After(now) {
+			waitFor(delivery)
+			continue
+		}
+
+		// Webhooks that are slow to respond don't hold up the others
+		wg.Add(1)
+		go func(delivery WebhookDelivery) {
+			defer wg.Done()
+			delivery, err := d.attempt(ctx, delivery)
+			if err != nil {
+				// Webhooks deleted since the deliveries were listed have nothing left to send
+				if ctx.Err() == nil && !errors.Is(err, ErrWebhookNotFound) {
+					logger.LogMessage(logger.LogLevelError, "Failed to deliver event %d to webhook %d: %v", delivery.EventID, delivery.WebhookID, err)
+				}
+				return
+			}
+			waitFor(delivery)
+		}(delivery)
+	}
+	wg.Wait()
+
+	return next, ctx.Err()
+}
+
+// Makes one attempt at sending the delivery and records how it went. If it fails and there are attempts left,
+// the next one is due after the retry delay, which doubles every attempt
+func (d *WebhookDispatcher) attempt(ctx context.Context, delivery WebhookDelivery) (WebhookDelivery, error) {
+	webhook, err := GetWebhook(d.DB, delivery.WebhookID)
+	if err != nil {
+		return delivery, err
+	}
+
+	maxAttempts := d.MaxAttempts
+	if maxAttempts < 1 {
+		maxAttempts = 1
+	}
+
+	if delivery.Payload == "" {
+		// Deliveries queued before payloads were kept can't be sent again
+		err = errors.New("the event was lost when the app restarted")
+	} else {
+		delivery.ResponseStatus, err = d.send(ctx, webhook, delivery.ID, delivery.EventType, []byte(delivery.Payload))
+		if ctx.Err() != nil {
+			// The app is stopping, so the attempt is left to be made again when it starts
+			return delivery, ctx.Err()
+		}
+	}
+	delivery.Attempts++
+	delivery.Error = ""
+	if err != nil {
+		delivery.Error = err.Error()
+	}
+
+	now := time.Now().UTC()
+	delivery.NextAttemptAt = ""
+	switch {
+	case err == nil:
+		delivery.Status = WebhookDeliverySucceeded
+	case delivery.Attempts < maxAttempts && delivery.Payload != "":
+		delivery.Status = WebhookDeliveryPending
+		delivery.NextAttemptAt = now.Add(d.RetryDelay << (delivery.Attempts - 1)).Format(time.RFC3339Nano)
+	default:
+		delivery.Status = WebhookDeliveryFailed
+	}
+	delivery.UpdatedAt = now.Format(time.RFC3339)
+
+	if err := updateWebhookDelivery(d.DB, delivery); err != nil {
+		return delivery, err
+	}
+
+	if delivery.Status == WebhookDeliveryFailed {
+		logger.LogMessage(logger.LogLevelWarn, "Gave up delivering event %d to %s after %d attempts: %s", delivery.EventID, webhook.URL, delivery.Attempts, delivery.Error)
+	}
+	return delivery, nil
+}
+
+// Makes a single attempt at sending the payload. Returns the status the webhook responded with, if it did
+func (d *WebhookDispatcher) send(ctx context.Context, webhook Webhook, deliveryID int64, eventType string, body []byte) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "HowAreThey-Webhooks")
+	req.Header.Set("X-HowAreThey-Event", eventType)
+	req.Header.Set("X-HowAreThey-Delivery", strconv.FormatInt(deliveryID, 10))
+	req.Header.Set("X-HowAreThey-Timestamp", timestamp)
+	req.Header.Set("X-HowAreThey-Signature", SignWebhookPayload(webhook.Secret, timestamp, body))
+
+	client := d.Client
+	if client == nil {
+		client = NewWebhookClient(0, nil)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, errors.New("webhook responded with " + resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,345 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: friends.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	FriendsService_ListFriends_FullMethodName  = "/howarethey.v1.FriendsService/ListFriends"
+	FriendsService_GetFriend_FullMethodName    = "/howarethey.v1.FriendsService/GetFriend"
+	FriendsService_CreateFriend_FullMethodName = "/howarethey.v1.FriendsService/CreateFriend"
+	FriendsService_UpdateFriend_FullMethodName = "/howarethey.v1.FriendsService/UpdateFriend"
+	FriendsService_DeleteFriend_FullMethodName = "/howarethey.v1.FriendsService/DeleteFriend"
+	FriendsService_PickFriend_FullMethodName   = "/howarethey.v1.FriendsService/PickFriend"
+	FriendsService_GetBirthdays_FullMethodName = "/howarethey.v1.FriendsService/GetBirthdays"
+)
+
+// FriendsServiceClient is the client API for FriendsService service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type FriendsServiceClient interface {
+	// Lists friends, filtered and sorted the same way as GET /friends
+	ListFriends(ctx context.Context, in *ListFriendsRequest, opts ...grpc.CallOption) (*ListFriendsResponse, error)
+	// Gets a friend by their ID or slug
+	GetFriend(ctx context.Context, in *GetFriendRequest, opts ...grpc.CallOption) (*Friend, error)
+	// Adds a friend and returns them as they were saved
+	CreateFriend(ctx context.Context, in *CreateFriendRequest, opts ...grpc.CallOption) (*Friend, error)
+	// Replaces a friend, the same as PUT /friends/:id. Anything not sent is cleared, apart from the slug
+	UpdateFriend(ctx context.Context, in *UpdateFriendRequest, opts ...grpc.CallOption) (*Friend, error)
+	// Moves a friend to the trash
+	DeleteFriend(ctx context.Context, in *DeleteFriendRequest, opts ...grpc.CallOption) (*DeleteFriendResponse, error)
+	// Picks a friend to get in touch with and sends the reminder, the same as GET /friends/random
+	PickFriend(ctx context.Context, in *PickFriendRequest, opts ...grpc.CallOption) (*Friend, error)
+	// Checks for birthdays today and sends the notification, the same as GET /birthdays
+	GetBirthdays(ctx context.Context, in *GetBirthdaysRequest, opts ...grpc.CallOption) (*GetBirthdaysResponse, error)
+}
+
+type friendsServiceClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewFriendsServiceClient(cc grpc.ClientConnInterface) FriendsServiceClient {
+	return &friendsServiceClient{cc}
+}
+
+func (c *friendsServiceClient) ListFriends(ctx context.Context, in *ListFriendsRequest, opts ...grpc.CallOption) (*ListFriendsResponse, error) {
+	out := new(ListFriendsResponse)
+	err := c.cc.Invoke(ctx, FriendsService_ListFriends_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) GetFriend(ctx context.Context, in *GetFriendRequest, opts ...grpc.CallOption) (*Friend, error) {
+	out := new(Friend)
+	err := c.cc.Invoke(ctx, FriendsService_GetFriend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) CreateFriend(ctx context.Context, in *CreateFriendRequest, opts ...grpc.CallOption) (*Friend, error) {
+	out := new(Friend)
+	err := c.cc.Invoke(ctx, FriendsService_CreateFriend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) UpdateFriend(ctx context.Context, in *UpdateFriendRequest, opts ...grpc.CallOption) (*Friend, error) {
+	out := new(Friend)
+	err := c.cc.Invoke(ctx, FriendsService_UpdateFriend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) DeleteFriend(ctx context.Context, in *DeleteFriendRequest, opts ...grpc.CallOption) (*DeleteFriendResponse, error) {
+	out := new(DeleteFriendResponse)
+	err := c.cc.Invoke(ctx, FriendsService_DeleteFriend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) PickFriend(ctx context.Context, in *PickFriendRequest, opts ...grpc.CallOption) (*Friend, error) {
+	out := new(Friend)
+	err := c.cc.Invoke(ctx, FriendsService_PickFriend_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *friendsServiceClient) GetBirthdays(ctx context.Context, in *GetBirthdaysRequest, opts ...grpc.CallOption) (*GetBirthdaysResponse, error) {
+	out := new(GetBirthdaysResponse)
+	err := c.cc.Invoke(ctx, FriendsService_GetBirthdays_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FriendsServiceServer is the server API for FriendsService service.
+// All implementations must embed UnimplementedFriendsServiceServer
+// for forward compatibility
+type FriendsServiceServer interface {
+	// Lists friends, filtered and sorted the same way as GET /friends
+	ListFriends(context.Context, *ListFriendsRequest) (*ListFriendsResponse, error)
+	// Gets a friend by their ID or slug
+	GetFriend(context.Context, *GetFriendRequest) (*Friend, error)
+	// Adds a friend and returns them as they were saved
+	CreateFriend(context.Context, *CreateFriendRequest) (*Friend, error)
+	// Replaces a friend, the same as PUT /friends/:id. Anything not sent is cleared, apart from the slug
+	UpdateFriend(context.Context, *UpdateFriendRequest) (*Friend, error)
+	// Moves a friend to the trash
+	DeleteFriend(context.Context, *DeleteFriendRequest) (*DeleteFriendResponse, error)
+	// Picks a friend to get in touch with and sends the reminder, the same as GET /friends/random
+	PickFriend(context.Context, *PickFriendRequest) (*Friend, error)
+	// Checks for birthdays today and sends the notification, the same as GET /birthdays
+	GetBirthdays(context.Context, *GetBirthdaysRequest) (*GetBirthdaysResponse, error)
+	mustEmbedUnimplementedFriendsServiceServer()
+}
+
+// UnimplementedFriendsServiceServer must be embedded to have forward compatible implementations.
+type UnimplementedFriendsServiceServer struct {
+}
+
+func (UnimplementedFriendsServiceServer) ListFriends(context.Context, *ListFriendsRequest) (*ListFriendsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFriends not implemented")
+}
+func (UnimplementedFriendsServiceServer) GetFriend(context.Context, *GetFriendRequest) (*Friend, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFriend not implemented")
+}
+func (UnimplementedFriendsServiceServer) CreateFriend(context.Context, *CreateFriendRequest) (*Friend, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateFriend not implemented")
+}
+func (UnimplementedFriendsServiceServer) UpdateFriend(context.Context, *UpdateFriendRequest) (*Friend, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFriend not implemented")
+}
+func (UnimplementedFriendsServiceServer) DeleteFriend(context.Context, *DeleteFriendRequest) (*DeleteFriendResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteFriend not implemented")
+}
+func (UnimplementedFriendsServiceServer) PickFriend(context.Context, *PickFriendRequest) (*Friend, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method PickFriend not implemented")
+}
+func (UnimplementedFriendsServiceServer) GetBirthdays(context.Context, *GetBirthdaysRequest) (*GetBirthdaysResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBirthdays not implemented")
+}
+func (UnimplementedFriendsServiceServer) mustEmbedUnimplementedFriendsServiceServer() {}
+
+// UnsafeFriendsServiceServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to FriendsServiceServer will
+// result in compilation errors.
+type UnsafeFriendsServiceServer interface {
+	mustEmbedUnimplementedFriendsServiceServer()
+}
+
+func RegisterFriendsServiceServer(s grpc.ServiceRegistrar, srv FriendsServiceServer) {
+	s.RegisterService(&FriendsService_ServiceDesc, srv)
+}
+
+func _FriendsService_ListFriends_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFriendsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).ListFriends(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_ListFriends_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).ListFriends(ctx, req.(*ListFriendsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_GetFriend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetFriendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).GetFriend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_GetFriend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).GetFriend(ctx, req.(*GetFriendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_CreateFriend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateFriendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).CreateFriend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_CreateFriend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).CreateFriend(ctx, req.(*CreateFriendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_UpdateFriend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateFriendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).UpdateFriend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_UpdateFriend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).UpdateFriend(ctx, req.(*UpdateFriendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_DeleteFriend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(DeleteFriendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).DeleteFriend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_DeleteFriend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).DeleteFriend(ctx, req.(*DeleteFriendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_PickFriend_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(PickFriendRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).PickFriend(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_PickFriend_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).PickFriend(ctx, req.(*PickFriendRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _FriendsService_GetBirthdays_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBirthdaysRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(FriendsServiceServer).GetBirthdays(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: FriendsService_GetBirthdays_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(FriendsServiceServer).GetBirthdays(ctx, req.(*GetBirthdaysRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// FriendsService_ServiceDesc is the grpc.ServiceDesc for FriendsService service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var FriendsService_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "howarethey.v1.FriendsService",
+	HandlerType: (*FriendsServiceServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "ListFriends",
+			Handler:    _FriendsService_ListFriends_Handler,
+		},
+		{
+			MethodName: "GetFriend",
+			Handler:    _FriendsService_GetFriend_Handler,
+		},
+		{
+			MethodName: "CreateFriend",
+			Handler:    _FriendsService_CreateFriend_Handler,
+		},
+		{
+			MethodName: "UpdateFriend",
+			Handler:    _FriendsService_UpdateFriend_Handler,
+		},
+		{
+			MethodName: "DeleteFriend",
+			Handler:    _FriendsService_DeleteFriend_Handler,
+		},
+		{
+			MethodName: "PickFriend",
+			Handler:    _FriendsService_PickFriend_Handler,
+		},
+		{
+			MethodName: "GetBirthdays",
+			Handler:    _FriendsService_GetBirthdays_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "friends.proto",
+}
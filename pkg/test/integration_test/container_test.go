@@ -48,9 +48,11 @@ func TestContainerAddFriend(t *testing.T) {
 	respStatus, respBody, err := addFriend(mockFriendsList[0])
 	assert.NoError(t, err)
 
-	expectedResponse := "{\"message\":\"John Wick added successfully\"}"
-
-	assert.Equal(t, expectedResponse, string(respBody))
+	var created models.Friend
+	err = json.Unmarshal(respBody, &created)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, created.ID)
+	assert.Equal(t, mockFriendsList[0].Name, created.Name)
 
 	assert.Equal(t, http.StatusCreated, respStatus)
 }
@@ -1,16 +1,24 @@
 package integration
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"howarethey/pkg/handler"
 	"howarethey/pkg/logger"
 	"howarethey/pkg/models"
+	"howarethey/pkg/pb"
+	"image"
+	"image/jpeg"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -18,6 +26,16 @@ import (
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/reflection/grpc_reflection_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 func insertMockFriend(db *sql.DB, id string, name string, lastContacted string, birthday string, notes string) error {
@@ -37,13 +55,7 @@ func setupTestDB() (*sql.DB, error) {
 		return nil, err
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS friends (
-		id INTEGER PRIMARY KEY,
-		name TEXT NOT NULL,
-		lastContacted TEXT NOT NULL,
-		birthday TEXT NOT NULL,
-		notes TEXT NOT NULL
-	);`)
+	err = models.CreateTables(db)
 	if err != nil {
 		return nil, err
 	}
@@ -60,6 +72,17 @@ func performHandlerRequest(r http.Handler, method, path string, body []byte) *ht
 	return recorder
 }
 
+// Same as performHandlerRequest, with the admin token the tests set in ADMIN_TOKEN
+func performAdminRequest(r http.Handler, method, path string, body []byte) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest(method, path, bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+
+	recorder := httptest.NewRecorder()
+	r.ServeHTTP(recorder, req)
+	return recorder
+}
+
 func setupMockHandler(mockFriendsList models.FriendsList) *handler.FriendsHandler {
 	// TODO: The test DB doesn't actually contain the above friends
 	// At the moment, that's not an issue but probably worth adding them to the DB as well
@@ -68,6 +91,7 @@ func setupMockHandler(mockFriendsList models.FriendsList) *handler.FriendsHandle
 	mockFriendsHandler := &handler.FriendsHandler{
 		FriendsList: mockFriendsList,
 		DB:          mockDb,
+		Events:      models.NewEventBus(100),
 	}
 
 	return mockFriendsHandler
@@ -213,6 +237,11 @@ func TestGetRandomFriend(t *testing.T) {
 	mockRouter, mockFriendsHandler, err := setupTestEnvironment(true)
 	assert.NoError(t, err)
 
+	// Picking a friend saves them, so they need to be in the DB
+	for _, friend := range mockFriendsHandler.FriendsList {
+		assert.NoError(t, insertMockFriend(mockFriendsHandler.DB, friend.ID, friend.Name, friend.LastContacted, friend.Birthday, friend.Notes))
+	}
+
 	response := performHandlerRequest(mockRouter, "GET", "/friends/random", nil)
 
 	assert.Equal(t, http.StatusOK, response.Code)
@@ -250,15 +279,29 @@ func TestAddFriendRoute(t *testing.T) {
 	mockRouter, _, err := setupTestEnvironment(true)
 	assert.NoError(t, err)
 
-	response := performHandlerRequest(mockRouter, "POST", "/friends", jsonValue)
+	response := performHandlerRequest(mockRouter, "POST", "/api/v1/friends", jsonValue)
 
 	assert.Equal(t, http.StatusCreated, response.Code)
 
-	var resp map[string]string
-	err = json.Unmarshal(response.Body.Bytes(), &resp)
+	var created models.Friend
+	err = json.Unmarshal(response.Body.Bytes(), &created)
 	assert.NoError(t, err)
-	assert.Equal(t, "Jane Doe added successfully", resp["message"])
+	assert.NotEmpty(t, created.ID)
+	assert.Equal(t, "Jane Doe", created.Name)
+	assert.Equal(t, "jane-doe", created.Slug)
+	assert.Equal(t, "2024-01-15", created.LastContacted)
+	assert.Equal(t, "I don't think she's a real person", created.Notes)
+	assert.Equal(t, "/api/v1/friends/id/"+created.ID, response.Header().Get("Location"))
+	assert.Equal(t, `"`+created.ID+`-1"`, response.Header().Get("ETag"))
+
+	// The friend can be fetched from the Location that was returned
+	response = performHandlerRequest(mockRouter, "GET", response.Header().Get("Location"), nil)
+	assert.Equal(t, http.StatusOK, response.Code)
 
+	var fetched models.Friend
+	err = json.Unmarshal(response.Body.Bytes(), &fetched)
+	assert.NoError(t, err)
+	assert.Equal(t, created, fetched)
 }
 
 // Test POST /friends
@@ -275,7 +318,7 @@ func TestAddFriendRouteNoData(t *testing.T) {
 
 	response := performHandlerRequest(mockRouter, "POST", "/friends", jsonValue)
 
-	assert.Equal(t, http.StatusInternalServerError, response.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
 
 	var resp map[string]string
 	err = json.Unmarshal(response.Body.Bytes(), &resp)
@@ -302,7 +345,7 @@ func TestAddFriendRouteBadLastContactedData(t *testing.T) {
 
 	response := performHandlerRequest(mockRouter, "POST", "/friends", jsonValue)
 
-	assert.Equal(t, http.StatusInternalServerError, response.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
 
 	var resp map[string]string
 	err = json.Unmarshal(response.Body.Bytes(), &resp)
@@ -330,7 +373,7 @@ func TestAddFriendRouteBadBirthdayData(t *testing.T) {
 
 	response := performHandlerRequest(mockRouter, "POST", "/friends", jsonValue)
 
-	assert.Equal(t, http.StatusInternalServerError, response.Code)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
 
 	var resp map[string]string
 	err = json.Unmarshal(response.Body.Bytes(), &resp)
@@ -360,7 +403,7 @@ func TestDeleteFriendRoute(t *testing.T) {
 	assert.Equal(t, "John Wick removed successfully", resp["message"])
 
 	var count int
-	err = mockFriendsHandler.DB.QueryRow("SELECT COUNT(*) FROM friends WHERE id = ?", "1").Scan(&count)
+	err = mockFriendsHandler.DB.QueryRow("SELECT COUNT(*) FROM friends WHERE id = ? AND deletedAt = ''", "1").Scan(&count)
 	assert.NoError(t, err)
 	assert.Equal(t, 0, count)
 }
@@ -410,9 +453,9 @@ func TestPutFriend(t *testing.T) {
 	assert.Equal(t, updatedFriend.Notes, friend.Notes)
 }
 
-// Tests PUT /friends/:id
+// Tests PATCH /friends/:id
 // Tests the endpoint when only Notes field is provided
-func TestPutNotesOnly(t *testing.T) {
+func TestPatchNotesOnly(t *testing.T) {
 	os.Setenv("TEST_ENV", "true")
 	logger.SetupLogger()
 
@@ -433,9 +476,9 @@ func TestPutNotesOnly(t *testing.T) {
 	updatedFriend := models.Friend{
 		Notes: "Bro is Chuck Norris",
 	}
-	jsonValue, _ := json.Marshal(updatedFriend)
+	jsonValue, _ := json.Marshal(map[string]string{"Notes": updatedFriend.Notes})
 
-	response := performHandlerRequest(mockRouter, "PUT", "/friends/1", jsonValue)
+	response := performHandlerRequest(mockRouter, "PATCH", "/friends/1", jsonValue)
 
 	assert.Equal(t, http.StatusOK, response.Code)
 
@@ -452,9 +495,9 @@ func TestPutNotesOnly(t *testing.T) {
 	assert.Equal(t, updatedFriend.Notes, friend.Notes)
 }
 
-// Tests PUT /friends/:id
+// Tests PATCH /friends/:id
 // Tests the endpoint when only Name field is provided
-func TestPutNameOnly(t *testing.T) {
+func TestPatchNameOnly(t *testing.T) {
 	os.Setenv("TEST_ENV", "true")
 	logger.SetupLogger()
 
@@ -475,9 +518,9 @@ func TestPutNameOnly(t *testing.T) {
 	updatedFriend := models.Friend{
 		Name: "Winnie the Pooh",
 	}
-	jsonValue, _ := json.Marshal(updatedFriend)
+	jsonValue, _ := json.Marshal(map[string]string{"Name": updatedFriend.Name})
 
-	response := performHandlerRequest(mockRouter, "PUT", "/friends/1", jsonValue)
+	response := performHandlerRequest(mockRouter, "PATCH", "/friends/1", jsonValue)
 
 	assert.Equal(t, http.StatusOK, response.Code)
 
@@ -495,9 +538,9 @@ func TestPutNameOnly(t *testing.T) {
 	assert.Equal(t, mockFriend.Notes, friend.Notes)
 }
 
-// Tests PUT /friends/:id
+// Tests PATCH /friends/:id
 // Tests the endpoint when only Last Contacted field is provided
-func TestPutLastContactedOnly(t *testing.T) {
+func TestPatchLastContactedOnly(t *testing.T) {
 	os.Setenv("TEST_ENV", "true")
 	logger.SetupLogger()
 
@@ -519,9 +562,9 @@ func TestPutLastContactedOnly(t *testing.T) {
 	updatedFriend := models.Friend{
 		LastContacted: todaysDate,
 	}
-	jsonValue, _ := json.Marshal(updatedFriend)
+	jsonValue, _ := json.Marshal(map[string]string{"LastContacted": updatedFriend.LastContacted})
 
-	response := performHandlerRequest(mockRouter, "PUT", "/friends/1", jsonValue)
+	response := performHandlerRequest(mockRouter, "PATCH", "/friends/1", jsonValue)
 
 	assert.Equal(t, http.StatusOK, response.Code)
 
@@ -539,9 +582,9 @@ func TestPutLastContactedOnly(t *testing.T) {
 	assert.Equal(t, mockFriend.Notes, friend.Notes)
 }
 
-// Tests PUT /friends/:id
+// Tests PATCH /friends/:id
 // Tests the endpoint when only Birthday field is provided
-func TestPutBirthdayOnly(t *testing.T) {
+func TestPatchBirthdayOnly(t *testing.T) {
 	os.Setenv("TEST_ENV", "true")
 	logger.SetupLogger()
 
@@ -563,9 +606,9 @@ func TestPutBirthdayOnly(t *testing.T) {
 	updatedFriend := models.Friend{
 		Birthday: todaysDate,
 	}
-	jsonValue, _ := json.Marshal(updatedFriend)
+	jsonValue, _ := json.Marshal(map[string]string{"Birthday": updatedFriend.Birthday})
 
-	response := performHandlerRequest(mockRouter, "PUT", "/friends/1", jsonValue)
+	response := performHandlerRequest(mockRouter, "PATCH", "/friends/1", jsonValue)
 
 	assert.Equal(t, http.StatusOK, response.Code)
 
@@ -582,3 +625,1445 @@ func TestPutBirthdayOnly(t *testing.T) {
 	assert.Equal(t, todaysDate, friend.Birthday)
 	assert.Equal(t, mockFriend.Notes, friend.Notes)
 }
+
+// Tests GET /export
+func TestExportFriendsCSV(t *testing.T) {
+	router, _, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(router, "GET", "/export?format=csv", nil)
+
+	expectedResult := "ID,Name,LastContacted,Birthday,Notes,Tags\n" +
+		"1,John Wick,2023-06-06,1996-02-23,Nice guy,\n" +
+		"2,Peter Parker,2023-12-12,1996-02-23,I think he's Spiderman,\n"
+
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "text/csv", response.Header().Get("Content-Type"))
+	assert.Equal(t, expectedResult, response.Body.String())
+
+	response = performHandlerRequest(router, "GET", "/export?format=xml", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+// Tests POST /import
+func TestImportFriendsRoute(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	router, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	csvData := []byte("Name,LastContacted,Birthday\nJane Doe,2024-01-15,1990-01-23\n")
+
+	response := performHandlerRequest(router, "POST", "/import?format=csv&dryRun=true", csvData)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, 0, len(mockFriendsHandler.FriendsList))
+
+	response = performHandlerRequest(router, "POST", "/import?format=csv", csvData)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var report models.ImportReport
+	err = json.Unmarshal(response.Body.Bytes(), &report)
+	assert.NoError(t, err)
+	assert.True(t, report.Committed)
+	assert.Equal(t, 1, report.Created)
+	assert.Equal(t, "Jane Doe", mockFriendsHandler.FriendsList[0].Name)
+
+	badData := []byte(`[{"Name": "", "Birthday": "1990-01-23"}]`)
+	response = performHandlerRequest(router, "POST", "/import?format=json", badData)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+// Tests POST /admin/backup and POST /admin/restore
+func TestBackupAndRestoreRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	t.Setenv("BACKUP_DIR", t.TempDir())
+	t.Setenv("ADMIN_TOKEN", "secret")
+
+	router, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	mockFriend := mockFriendsList[0]
+	err = insertMockFriend(mockFriendsHandler.DB, mockFriend.ID, mockFriend.Name, mockFriend.LastContacted, mockFriend.Birthday, mockFriend.Notes)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(router, "POST", "/admin/backup", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	req, _ := http.NewRequest("POST", "/admin/backup", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	var backup models.BackupInfo
+	err = json.Unmarshal(response.Body.Bytes(), &backup)
+	assert.NoError(t, err)
+
+	err = models.DeleteFriend(mockFriendsHandler.DB, mockFriend)
+	assert.NoError(t, err)
+
+	body, _ := json.Marshal(map[string]string{"Name": backup.Name})
+	req, _ = http.NewRequest("POST", "/admin/restore", bytes.NewBuffer(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// Restoring migrates the backup, which gives friends saved without a slug one
+	mockFriend.Slug = "john-wick"
+	mockFriend.Version = 1
+	assert.Equal(t, models.FriendsList{mockFriend}, mockFriendsHandler.FriendsList)
+}
+
+// Tests the admin endpoints are turned off without ADMIN_TOKEN, apart from for the scheduler
+func TestAdminRoutesWithoutToken(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	t.Setenv("BACKUP_DIR", t.TempDir())
+	t.Setenv("ADMIN_TOKEN", "")
+
+	router, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+	mockFriendsHandler.SchedulerToken = "scheduler-secret"
+
+	for _, path := range []string{"/admin/backups", "/api/v1/admin/backups"} {
+		response := performHandlerRequest(router, "GET", path, nil)
+		assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/api/v1/admin/backups", nil)
+	req.Header.Set("Authorization", "Bearer anything")
+	response := httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusServiceUnavailable, response.Code)
+
+	req, _ = http.NewRequest("POST", "/api/v1/admin/backup", nil)
+	req.Header.Set("Authorization", "Bearer scheduler-secret")
+	response = httptest.NewRecorder()
+	router.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusCreated, response.Code)
+}
+
+// Tests GET /trash, POST /friends/:id/restore and POST /admin/trash/purge
+func TestTrashRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	t.Setenv("ADMIN_TOKEN", "secret")
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	mockFriend := mockFriendsList[0]
+	err = insertMockFriend(mockFriendsHandler.DB, mockFriend.ID, mockFriend.Name, mockFriend.LastContacted, mockFriend.Birthday, mockFriend.Notes)
+	assert.NoError(t, err)
+	mockFriendsHandler.FriendsList = models.FriendsList{mockFriend}
+
+	response := performHandlerRequest(mockRouter, "DELETE", "/friends/1", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, 0, len(mockFriendsHandler.FriendsList))
+
+	response = performHandlerRequest(mockRouter, "GET", "/trash", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var trash models.FriendsList
+	err = json.Unmarshal(response.Body.Bytes(), &trash)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(trash))
+	assert.Equal(t, mockFriend.Name, trash[0].Name)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/restore", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	// Deleting and restoring both count as changes
+	mockFriend.Version = 3
+	assert.Equal(t, models.FriendsList{mockFriend}, mockFriendsHandler.FriendsList)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/restore", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	// Purging can't be undone so it needs the admin token
+	response = performHandlerRequest(mockRouter, "POST", "/admin/trash/purge?all=true", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	req, _ := http.NewRequest("POST", "/admin/trash/purge?all=true", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	response = httptest.NewRecorder()
+	mockRouter.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `{"count":0,"message":"0 friends purged from the trash"}`, response.Body.String())
+}
+
+// Tests GET /friends/:id/history and GET /audit
+func TestFriendHistoryRoute(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	mockFriend := mockFriendsList[0]
+	err = insertMockFriend(mockFriendsHandler.DB, mockFriend.ID, mockFriend.Name, mockFriend.LastContacted, mockFriend.Birthday, mockFriend.Notes)
+	assert.NoError(t, err)
+	mockFriendsHandler.FriendsList = models.FriendsList{mockFriend}
+
+	req, _ := http.NewRequest("PATCH", "/friends/1", bytes.NewBufferString(`{"Notes": "Likes dogs"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer my-token")
+	response := httptest.NewRecorder()
+	mockRouter.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/1/history", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var history []models.AuditEntry
+	err = json.Unmarshal(response.Body.Bytes(), &history)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(history))
+	assert.Equal(t, models.FieldChange{Before: "Nice guy", After: "Likes dogs"}, history[0].Changes["Notes"])
+	assert.True(t, strings.HasPrefix(history[0].Actor, "token:"))
+	assert.NotContains(t, history[0].Actor, "my-token")
+
+	// The actor comes from how the request was authenticated, so X-Actor can't be used to make changes as someone else
+	mockFriendsHandler.SchedulerToken = "scheduler-secret"
+	for _, header := range []struct{ name, value, actor string }{
+		{"X-Actor", models.ActorScheduler, "api"},
+		{"Authorization", "Bearer scheduler-secret", models.ActorScheduler},
+	} {
+		req, _ = http.NewRequest("PATCH", "/friends/1", bytes.NewBufferString(`{"Notes": "Likes `+header.name+`"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header.name, header.value)
+		response = httptest.NewRecorder()
+		mockRouter.ServeHTTP(response, req)
+		assert.Equal(t, http.StatusOK, response.Code)
+	}
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/1/history", nil)
+	history = nil
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &history))
+	assert.Equal(t, 3, len(history))
+	assert.Equal(t, models.ActorScheduler, history[0].Actor)
+	assert.Equal(t, "api", history[1].Actor)
+
+	response = performHandlerRequest(mockRouter, "GET", "/audit?action=delete", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "[]", response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "GET", "/audit?limit=none", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+// Tests GET /tags, POST /friends/:id/tags, DELETE /friends/:id/tags/:tag and filtering by tag
+func TestTagRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	for _, mockFriend := range mockFriendsList {
+		err = insertMockFriend(mockFriendsHandler.DB, mockFriend.ID, mockFriend.Name, mockFriend.LastContacted, mockFriend.Birthday, mockFriend.Notes)
+		assert.NoError(t, err)
+	}
+	mockFriendsHandler.FriendsList, err = models.BuildFriendsList(mockFriendsHandler.DB)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "POST", "/friends/1/tags", []byte(`{"Tags": ["Family", "work"]}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PATCH", "/friends/2", []byte(`{"Tags": ["work"]}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends?tag=family", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var friends models.FriendsList
+	err = json.Unmarshal(response.Body.Bytes(), &friends)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(friends))
+	assert.Equal(t, "John Wick", friends[0].Name)
+	assert.Equal(t, []string{"family", "work"}, friends[0].Tags)
+
+	response = performHandlerRequest(mockRouter, "GET", "/tags", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `[{"Name":"family","Count":1},{"Name":"work","Count":2}]`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/1/tags/Family", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/1/tags/family", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/random?tag=family", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/random?tag=work", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+}
+
+// Tests the /friends/:id/contacts routes
+func TestContactMethodRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	mockFriend := mockFriendsList[0]
+	err = insertMockFriend(mockFriendsHandler.DB, mockFriend.ID, mockFriend.Name, mockFriend.LastContacted, mockFriend.Birthday, mockFriend.Notes)
+	assert.NoError(t, err)
+	mockFriendsHandler.FriendsList = models.FriendsList{mockFriend}
+
+	response := performHandlerRequest(mockRouter, "POST", "/friends/1/contacts", []byte(`{"Type": "whatsapp", "Value": "+44 7700 900123", "Preferred": true}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.Equal(t, `{"ID":1,"FriendID":"1","Type":"whatsapp","Value":"+44 7700 900123","Preferred":true,"Link":"https://wa.me/447700900123"}`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/contacts", []byte(`{"Type": "pager", "Value": "123"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/3/contacts", []byte(`{"Type": "email", "Value": "john@example.com"}`))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PUT", "/friends/1/contacts/1", []byte(`{"Type": "email", "Value": "john@example.com", "Label": "work"}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/1/contacts", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `[{"ID":1,"FriendID":"1","Type":"email","Value":"john@example.com","Label":"work","Preferred":false,"Link":"mailto:john@example.com"}]`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/1/contacts/1", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/1/contacts/1", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+// Tests the /fields routes and setting custom fields on friends
+func TestCustomFieldRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	mockFriend := mockFriendsList[0]
+	err = insertMockFriend(mockFriendsHandler.DB, mockFriend.ID, mockFriend.Name, mockFriend.LastContacted, mockFriend.Birthday, mockFriend.Notes)
+	assert.NoError(t, err)
+	mockFriendsHandler.FriendsList = models.FriendsList{mockFriend}
+
+	response := performHandlerRequest(mockRouter, "POST", "/fields", []byte(`{"Name": "partner", "Type": "text"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/fields", []byte(`{"Name": "kids", "Type": "number", "Description": "How many kids they have"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/fields", []byte(`{"Name": "kids", "Type": "number"}`))
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/fields", []byte(`{"Name": "kids", "Type": "boolean"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/fields", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `[{"Name":"kids","Type":"number","Description":"How many kids they have"},{"Name":"partner","Type":"text"}]`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "PATCH", "/friends/1", []byte(`{"Fields": {"kids": "two"}}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PATCH", "/friends/1", []byte(`{"Fields": {"kids": 2, "partner": "Helen"}}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	// Only the fields sent are changed
+	response = performHandlerRequest(mockRouter, "PATCH", "/friends/1", []byte(`{"Fields": {"kids": null}}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, map[string]interface{}{"partner": "Helen"}, mockFriendsHandler.FriendsList[0].Fields)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends", []byte(`{"Name": "Peter Parker", "LastContacted": "2023-12-12", "Fields": {"pets": "dog"}}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends?field[partner]=helen", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var friends models.FriendsList
+	err = json.Unmarshal(response.Body.Bytes(), &friends)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(friends))
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/fields/partner", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Nil(t, mockFriendsHandler.FriendsList[0].Fields)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/fields/partner", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+// Tests the /friends/:id/related routes
+func TestRelationshipRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	// Picking a friend saves them, so they need to be in the DB
+	for _, friend := range mockFriendsHandler.FriendsList {
+		assert.NoError(t, insertMockFriend(mockFriendsHandler.DB, friend.ID, friend.Name, friend.LastContacted, friend.Birthday, friend.Notes))
+	}
+
+	response := performHandlerRequest(mockRouter, "POST", "/friends/1/related", []byte(`{"RelatedID": "2", "Type": "group", "Label": "Avengers"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.Equal(t, `{"ID":1,"FriendID":"1","RelatedID":"2","Type":"group","Label":"Avengers"}`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/2/related", []byte(`{"RelatedID": "1", "Type": "group"}`))
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/related", []byte(`{"RelatedID": "9", "Type": "sibling"}`))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/related", []byte(`{"RelatedID": "2", "Type": "enemy"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/2/related", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var related []models.RelatedFriend
+	err = json.Unmarshal(response.Body.Bytes(), &related)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(related))
+	assert.Equal(t, mockFriendsHandler.FriendsList[0], related[0].Friend)
+	assert.Equal(t, "2", related[0].Relationship.FriendID)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/random?group=true", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/2/related/1", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/2/related/1", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+// Tests the /friends/:id/gifts routes
+func TestGiftIdeaRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, _, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "POST", "/friends/1/gifts", []byte(`{"Idea": "Pencil", "Price": 2.5}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.Equal(t, `{"ID":1,"FriendID":"1","Idea":"Pencil","Price":2.5,"Status":"idea"}`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/gifts", []byte(`{"Idea": ""}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PUT", "/friends/1/gifts/1", []byte(`{"Idea": "Pencil", "Price": 2.5, "Status": "given", "YearGiven": 2023}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/gifts", []byte(`{"Idea": "pencil"}`))
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/1/gifts", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `[{"ID":1,"FriendID":"1","Idea":"Pencil","Price":2.5,"Status":"given","YearGiven":2023}]`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "GET", "/birthdays", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/1/gifts/1", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PUT", "/friends/1/gifts/1", []byte(`{"Idea": "Pencil"}`))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+// Tests the /friends/:id/photo routes
+func TestPhotoRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, _, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	var photo bytes.Buffer
+	err = jpeg.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 300, 600)), nil)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "GET", "/friends/1/photo", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	req, _ := http.NewRequest("PUT", "/friends/1/photo", bytes.NewReader(photo.Bytes()))
+	req.Header.Set("Content-Type", "image/jpeg")
+	response = httptest.NewRecorder()
+	mockRouter.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/1/photo", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "image/jpeg", response.Header().Get("Content-Type"))
+	assert.Equal(t, photo.Bytes(), response.Body.Bytes())
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/1/photo?size=thumbnail", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	config, err := jpeg.DecodeConfig(response.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 128, config.Width)
+	assert.Equal(t, 256, config.Height)
+
+	response = performHandlerRequest(mockRouter, "PUT", "/friends/1/photo", []byte(`{"not": "a photo"}`))
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+	os.Setenv("PHOTO_MAX_SIZE_MB", "1")
+	defer os.Unsetenv("PHOTO_MAX_SIZE_MB")
+	response = performHandlerRequest(mockRouter, "PUT", "/friends/1/photo", bytes.Repeat([]byte("a"), 1<<20+1))
+	assert.Equal(t, http.StatusRequestEntityTooLarge, response.Code)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/1/photo", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/1/photo", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+// Tests the /search route
+func TestSearchRoute(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "GET", "/search?q=pete", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var results []models.SearchResult
+	err = json.Unmarshal(response.Body.Bytes(), &results)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, mockFriendsHandler.FriendsList[1], results[0].Friend)
+
+	response = performHandlerRequest(mockRouter, "GET", "/search?q=spiderman", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	err = json.Unmarshal(response.Body.Bytes(), &results)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(results))
+	assert.Equal(t, "Peter Parker", results[0].Friend.Name)
+
+	response = performHandlerRequest(mockRouter, "GET", "/search?q=nobody", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "[]", response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "GET", "/search", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+// Tests sorting and paging through GET /friends
+func TestFriendsListPagination(t *testing.T) {
+	router, _, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(router, "GET", "/friends?sort=-name&limit=1", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "2", response.Header().Get("X-Total-Count"))
+
+	var friends models.FriendsList
+	err = json.Unmarshal(response.Body.Bytes(), &friends)
+	assert.NoError(t, err)
+	assert.Equal(t, models.FriendsList{mockFriendsList[1]}, friends)
+
+	cursor := response.Header().Get("X-Next-Cursor")
+	assert.NotEmpty(t, cursor)
+
+	response = performHandlerRequest(router, "GET", "/friends?sort=-name&limit=1&cursor="+cursor, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	err = json.Unmarshal(response.Body.Bytes(), &friends)
+	assert.NoError(t, err)
+	assert.Equal(t, models.FriendsList{mockFriendsList[0]}, friends)
+	assert.Empty(t, response.Header().Get("X-Next-Cursor"))
+
+	response = performHandlerRequest(router, "GET", "/friends?contactedBefore=2023-12-01&hasBirthday=true", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "1", response.Header().Get("X-Total-Count"))
+
+	response = performHandlerRequest(router, "GET", "/friends?sort=age", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = performHandlerRequest(router, "GET", "/friends?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = performHandlerRequest(router, "GET", "/friends?hasBirthday=maybe", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = performHandlerRequest(router, "GET", "/friends?sort=name&cursor="+cursor, nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+}
+
+// Tests friends can be looked up by slug anywhere their ID can be used
+func TestFriendSlugRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	for i := 0; i < 2; i++ {
+		response := performHandlerRequest(mockRouter, "POST", "/friends", []byte(`{"Name": "Sam Smith", "LastContacted": "2023-12-12"}`))
+		assert.Equal(t, http.StatusCreated, response.Code)
+	}
+	assert.Equal(t, "sam-smith", mockFriendsHandler.FriendsList[0].Slug)
+	assert.Equal(t, "sam-smith-2", mockFriendsHandler.FriendsList[1].Slug)
+
+	response := performHandlerRequest(mockRouter, "GET", "/friends/id/sam-smith-2", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, `"2-1"`, response.Header().Get("ETag"))
+	var friend models.Friend
+	err = json.Unmarshal(response.Body.Bytes(), &friend)
+	assert.NoError(t, err)
+	// The version is only sent in the ETag
+	expected := mockFriendsHandler.FriendsList[1]
+	expected.Version = 0
+	assert.Equal(t, expected, friend)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/name/sam-smith", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/sam-smith/tags", []byte(`{"Tags": ["family"]}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, []string{"family"}, mockFriendsHandler.FriendsList[0].Tags)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/sam-smith/related", []byte(`{"RelatedID": "sam-smith-2", "Type": "sibling"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.Contains(t, response.Body.String(), `"RelatedID":"2"`)
+
+	response = performHandlerRequest(mockRouter, "PATCH", "/friends/sam-smith-2", []byte(`{"Slug": "sam-smith"}`))
+	assert.Equal(t, http.StatusConflict, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PATCH", "/friends/sam-smith-2", []byte(`{"Slug": "sam-the-younger"}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "sam-the-younger", mockFriendsHandler.FriendsList[1].Slug)
+
+	response = performHandlerRequest(mockRouter, "DELETE", "/friends/sam-the-younger", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/friends/sam-the-younger/restore", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/sam-the-younger/history", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), `"Slug"`)
+}
+
+// Test the /api/v1 routes and the error envelope
+func TestAPIVersionRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, _, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "GET", "/api/v1/friends/id/1", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Empty(t, response.Header().Get("Deprecation"))
+
+	response = performHandlerRequest(mockRouter, "GET", "/friends/id/1", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, "true", response.Header().Get("Deprecation"))
+	assert.Equal(t, `</api/v1/friends/id/1>; rel="successor-version"`, response.Header().Get("Link"))
+
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends", []byte(`{"Name": "Peter Parker", "Birthday": "23-02-1996"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	var errorResponse handler.ErrorResponse
+	err = json.Unmarshal(response.Body.Bytes(), &errorResponse)
+	assert.NoError(t, err)
+	assert.Equal(t, "validation_failed", errorResponse.Error.Code)
+	assert.Equal(t, []handler.FieldError{{Field: "Birthday", Message: errorResponse.Error.Message}}, errorResponse.Error.Details)
+
+	// The old routes keep the flat error format
+	response = performHandlerRequest(mockRouter, "POST", "/friends", []byte(`{"Name": ""}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.Equal(t, `{"error":"name must not be blank"}`, response.Body.String())
+
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/friends/id/99", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	assert.Contains(t, response.Body.String(), `"code":"not_found"`)
+
+	response = performHandlerRequest(mockRouter, "PUT", "/api/v1/friends/99", []byte(`{"Name": "Who?"}`))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends", []byte(`{"Name": `))
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	assert.Contains(t, response.Body.String(), `"code":"bad_request"`)
+
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/nothing", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	assert.Contains(t, response.Body.String(), `"code":"not_found"`)
+}
+
+// Test GET /openapi.json and that every route is documented
+func TestOpenAPISpec(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, _, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	spec, err := handler.LoadOpenAPISpec()
+	assert.NoError(t, err)
+
+	for _, route := range mockRouter.Routes() {
+		if !strings.HasPrefix(route.Path, "/api/v1/") {
+			continue
+		}
+		path := strings.TrimPrefix(route.Path, "/api/v1")
+		for _, segment := range strings.Split(path, "/") {
+			if strings.HasPrefix(segment, ":") {
+				path = strings.Replace(path, segment, "{"+segment[1:]+"}", 1)
+			}
+		}
+		pathItem := spec.Paths.Value(path)
+		if assert.NotNil(t, pathItem, route.Path+" is not documented") {
+			assert.NotNil(t, pathItem.GetOperation(route.Method), route.Method+" "+route.Path+" is not documented")
+		}
+	}
+
+	response := performHandlerRequest(mockRouter, "GET", "/openapi.json", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	var served map[string]interface{}
+	err = json.Unmarshal(response.Body.Bytes(), &served)
+	assert.NoError(t, err)
+	assert.Equal(t, "3.0.3", served["openapi"])
+
+	response = performHandlerRequest(mockRouter, "GET", "/docs/", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Contains(t, response.Body.String(), "/openapi.json")
+}
+
+// Test requests are checked against the OpenAPI document
+func TestRequestValidation(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, _, err := setupTestEnvironment(true)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		method string
+		path   string
+		body   string
+		status int
+		field  string
+	}{
+		{"POST", "/api/v1/friends", `{"Notes": "No name"}`, http.StatusUnprocessableEntity, "Name"},
+		{"POST", "/api/v1/friends", `{"Name": "Peter Parker", "Birthday": 19960223}`, http.StatusUnprocessableEntity, "Birthday"},
+		{"PUT", "/api/v1/friends/1", `{"Tags": ["work", 5]}`, http.StatusUnprocessableEntity, "Tags.1"},
+		{"POST", "/api/v1/friends/1/contacts", `{"Type": "pager", "Value": "123"}`, http.StatusUnprocessableEntity, "Type"},
+		{"POST", "/api/v1/friends/1/gifts", `{"Idea": "Pencil", "Price": "cheap"}`, http.StatusUnprocessableEntity, "Price"},
+		{"GET", "/api/v1/friends?limit=none", ``, http.StatusBadRequest, "limit"},
+		{"GET", "/api/v1/friends?hasBirthday=maybe", ``, http.StatusBadRequest, "hasBirthday"},
+		{"GET", "/api/v1/search", ``, http.StatusBadRequest, "q"},
+	}
+	for _, test := range tests {
+		response := performHandlerRequest(mockRouter, test.method, test.path, []byte(test.body))
+		assert.Equal(t, test.status, response.Code, test.method+" "+test.path+" "+test.body)
+
+		var errorResponse handler.ErrorResponse
+		err = json.Unmarshal(response.Body.Bytes(), &errorResponse)
+		assert.NoError(t, err)
+		if assert.Len(t, errorResponse.Error.Details, 1, test.method+" "+test.path+" "+test.body) {
+			assert.Equal(t, test.field, errorResponse.Error.Details[0].Field)
+		}
+	}
+
+	req, _ := http.NewRequest("POST", "/api/v1/friends", strings.NewReader(`Name=Peter`))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	response := httptest.NewRecorder()
+	mockRouter.ServeHTTP(response, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+	// The deprecated routes are checked too, but keep their error format
+	response = performHandlerRequest(mockRouter, "POST", "/friends/1/contacts", []byte(`{"Type": "pager", "Value": "123"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.Contains(t, response.Body.String(), `{"error":"Type: value is not one of the allowed values`)
+}
+
+// Tests PUT /friends/:id replaces the whole friend
+func TestPutReplacesFriend(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "POST", "/friends", []byte(`{"Name": "John Wick", "Birthday": "1964-09-02", "Notes": "Likes dogs", "Tags": ["work"]}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PUT", "/friends/john-wick", []byte(`{"Name": "Jonathan Wick", "LastContacted": "2024-01-15"}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	friend := mockFriendsHandler.FriendsList[0]
+	assert.Equal(t, "Jonathan Wick", friend.Name)
+	assert.Equal(t, "john-wick", friend.Slug)
+	assert.Equal(t, "2024-01-15", friend.LastContacted)
+	assert.Empty(t, friend.Birthday)
+	assert.Empty(t, friend.Notes)
+	assert.Empty(t, friend.Tags)
+
+	response = performHandlerRequest(mockRouter, "PUT", "/friends/john-wick", []byte(`{"Notes": "No name"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+// Tests PATCH /friends/:id with JSON Merge Patch and JSON Patch
+func TestPatchFriendRoute(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "POST", "/friends", []byte(`{"Name": "John Wick", "Birthday": "1964-09-02", "Notes": "Likes dogs", "Tags": ["work"]}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	patchRequest := func(contentType string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PATCH", "/api/v1/friends/john-wick", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		recorder := httptest.NewRecorder()
+		mockRouter.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	// null clears a field
+	response = patchRequest("application/merge-patch+json", `{"Notes": null, "Birthday": null}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	friend := mockFriendsHandler.FriendsList[0]
+	assert.Equal(t, "John Wick", friend.Name)
+	assert.Empty(t, friend.Notes)
+	assert.Empty(t, friend.Birthday)
+	assert.Equal(t, []string{"work"}, friend.Tags)
+
+	response = patchRequest("application/json-patch+json", `[{"op": "add", "path": "/Tags/-", "value": "Gym"}, {"op": "replace", "path": "/Notes", "value": "Has a dog called Daisy"}]`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	friend = mockFriendsHandler.FriendsList[0]
+	assert.Equal(t, []string{"gym", "work"}, friend.Tags)
+	assert.Equal(t, "Has a dog called Daisy", friend.Notes)
+
+	// Nothing changes if a test fails
+	response = patchRequest("application/json-patch+json", `[{"op": "replace", "path": "/Notes", "value": "Has a cat"}, {"op": "test", "path": "/Name", "value": "Jonathan"}]`)
+	assert.Equal(t, http.StatusConflict, response.Code)
+	assert.Equal(t, "Has a dog called Daisy", mockFriendsHandler.FriendsList[0].Notes)
+
+	response = patchRequest("application/json-patch+json", `[{"op": "remove", "path": "/Nickname"}]`)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.Contains(t, response.Body.String(), `"field":"Nickname"`)
+
+	response = patchRequest("application/merge-patch+json", `{"Name": null}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+
+	response = patchRequest("application/merge-patch+json", `{"Name": `)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = patchRequest("text/plain", `Notes=none`)
+	assert.Equal(t, http.StatusUnsupportedMediaType, response.Code)
+
+	response = performHandlerRequest(mockRouter, "PATCH", "/friends/99", []byte(`{"Notes": "Who?"}`))
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+func TestFriendETags(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "POST", "/friends", []byte(`{"Name": "John Wick", "Notes": "Likes dogs"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	conditionalRequest := func(method string, path string, header string, etag string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(header, etag)
+		recorder := httptest.NewRecorder()
+		mockRouter.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/friends/id/john-wick", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	etag := response.Header().Get("ETag")
+	assert.Equal(t, `"1-1"`, etag)
+
+	response = conditionalRequest("GET", "/api/v1/friends/id/1", "If-None-Match", etag, "")
+	assert.Equal(t, http.StatusNotModified, response.Code)
+	assert.Empty(t, response.Body.String())
+
+	response = conditionalRequest("PATCH", "/api/v1/friends/1", "If-Match", etag, `{"Notes": "Has a dog called Daisy"}`)
+	assert.Equal(t, http.StatusOK, response.Code)
+	newETag := response.Header().Get("ETag")
+	assert.Equal(t, `"1-2"`, newETag)
+
+	response = conditionalRequest("GET", "/api/v1/friends/name/john-wick", "If-None-Match", etag, "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, newETag, response.Header().Get("ETag"))
+
+	// Someone else's change isn't overwritten by a change based on the version before it
+	response = conditionalRequest("PUT", "/api/v1/friends/1", "If-Match", etag, `{"Name": "John Wick", "Notes": "Likes cats"}`)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+	assert.Contains(t, response.Body.String(), `"code":"precondition_failed"`)
+	assert.Equal(t, newETag, response.Header().Get("ETag"))
+	assert.Equal(t, "Has a dog called Daisy", mockFriendsHandler.FriendsList[0].Notes)
+
+	response = conditionalRequest("PUT", "/api/v1/friends/1", "If-Match", "W/"+newETag, `{"Name": "John Wick"}`)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code, "If-Match needs a strong match")
+
+	response = conditionalRequest("PUT", "/api/v1/friends/1", "If-None-Match", "*", `{"Name": "John Wick"}`)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+
+	response = conditionalRequest("DELETE", "/api/v1/friends/1", "If-Match", etag, "")
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+	assert.Equal(t, 1, len(mockFriendsHandler.FriendsList))
+
+	// The cached list can be behind the db, which is checked again when the change is saved
+	stale := mockFriendsHandler.FriendsList[0]
+	assert.NoError(t, models.SqlUpdateFriend(mockFriendsHandler.DB, "1", &stale))
+	response = conditionalRequest("DELETE", "/api/v1/friends/1", "If-Match", newETag, "")
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+
+	response = conditionalRequest("DELETE", "/api/v1/friends/1", "If-Match", "*", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, 0, len(mockFriendsHandler.FriendsList))
+}
+
+// Picking a friend changes them, so the ETag served afterwards has to match the version saved in the db
+func TestPickedFriendETag(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, _, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	response := performHandlerRequest(mockRouter, "POST", "/api/v1/friends", []byte(`{"Name": "John Wick", "LastContacted": "2023-06-06"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/friends/random", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/friends/id/john-wick", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	etag := response.Header().Get("ETag")
+	assert.Equal(t, `"1-2"`, etag)
+
+	req, _ := http.NewRequest("PUT", "/api/v1/friends/john-wick", strings.NewReader(`{"Name": "John Wick", "Notes": "Likes dogs"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("If-Match", etag)
+	recorder := httptest.NewRecorder()
+	mockRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Equal(t, `"1-3"`, recorder.Header().Get("ETag"))
+}
+
+func TestBatchRoute(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"John Wick", "Peter Parker"} {
+		response := performHandlerRequest(mockRouter, "POST", "/friends", []byte(`{"Name": "`+name+`"}`))
+		assert.Equal(t, http.StatusCreated, response.Code)
+	}
+
+	response := performHandlerRequest(mockRouter, "POST", "/api/v1/friends/batch", []byte(`{"Operations": [
+		{"Op": "update", "ID": "john-wick", "Friend": {"LastContacted": "2024-04-17"}},
+		{"Op": "update", "ID": "peter-parker", "Friend": {"LastContacted": "2024-04-17"}},
+		{"Op": "create", "Friend": {"Name": "Jane Doe", "LastContacted": "2024-04-17"}}
+	]}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	var report models.BatchReport
+	err = json.Unmarshal(response.Body.Bytes(), &report)
+	assert.NoError(t, err)
+	assert.True(t, report.Committed)
+	assert.Equal(t, 3, report.Succeeded)
+	assert.Equal(t, 3, len(mockFriendsHandler.FriendsList))
+	for _, friend := range mockFriendsHandler.FriendsList {
+		assert.Equal(t, "2024-04-17", friend.LastContacted)
+	}
+
+	// One bad operation stops the whole batch
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends/batch", []byte(`{"Operations": [
+		{"Op": "delete", "ID": "jane-doe"},
+		{"Op": "update", "ID": "john-wick", "Friend": {"Birthday": "23/02/1996"}}
+	]}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	report = models.BatchReport{}
+	err = json.Unmarshal(response.Body.Bytes(), &report)
+	assert.NoError(t, err)
+	assert.False(t, report.Committed)
+	assert.Equal(t, models.BatchStatusDeleted, report.Results[0].Status)
+	assert.Equal(t, models.BatchStatusFailed, report.Results[1].Status)
+	assert.Contains(t, report.Results[1].Error, "birthday must be in yyyy-mm-dd format")
+	assert.Equal(t, 3, len(mockFriendsHandler.FriendsList))
+
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends/batch", []byte(`{"Mode": "bestEffort", "Operations": [
+		{"Op": "delete", "ID": "jane-doe"},
+		{"Op": "update", "ID": "john-wick", "Friend": {"Birthday": "23/02/1996"}}
+	]}`))
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.Equal(t, 2, len(mockFriendsHandler.FriendsList))
+
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends/batch", []byte(`{"Operations": [{"Op": "rename", "ID": "1"}]}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.Contains(t, response.Body.String(), `"field":"Operations.0.Op"`)
+
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends/batch", []byte(`{"Operations": []}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+}
+
+func TestIdempotencyKeyRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	requestWithKey := func(method string, path string, key string, body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		recorder := httptest.NewRecorder()
+		mockRouter.ServeHTTP(recorder, req)
+		return recorder
+	}
+
+	first := requestWithKey("POST", "/api/v1/friends", "add-jane", `{"Name": "Jane Doe"}`)
+	assert.Equal(t, http.StatusCreated, first.Code)
+	assert.Empty(t, first.Header().Get("Idempotent-Replayed"))
+
+	// Retries get the first response back without adding Jane again
+	retry := requestWithKey("POST", "/api/v1/friends", "add-jane", `{"Name": "Jane Doe"}`)
+	assert.Equal(t, http.StatusCreated, retry.Code)
+	assert.Equal(t, "true", retry.Header().Get("Idempotent-Replayed"))
+	assert.Equal(t, first.Header().Get("Content-Type"), retry.Header().Get("Content-Type"))
+	assert.Equal(t, first.Body.String(), retry.Body.String())
+	assert.Equal(t, 1, len(mockFriendsHandler.FriendsList))
+
+	response := requestWithKey("POST", "/api/v1/friends", "add-jane", `{"Name": "John Wick"}`)
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.Contains(t, response.Body.String(), "already used for a different request")
+
+	// Failed requests are replayed too
+	response = requestWithKey("PATCH", "/api/v1/friends/99", "patch-99", `{"Notes": "Who?"}`)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = requestWithKey("PATCH", "/api/v1/friends/99", "patch-99", `{"Notes": "Who?"}`)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	assert.Equal(t, "true", response.Header().Get("Idempotent-Replayed"))
+
+	// A retry sent before the first request has finished isn't run alongside it
+	_, err = models.ClaimIdempotencyKey(mockFriendsHandler.DB, "delete-jane", "api", "in progress", time.Now().Add(-time.Hour), time.Now().Add(-time.Minute))
+	assert.NoError(t, err)
+	response = requestWithKey("DELETE", "/api/v1/friends/jane-doe", "delete-jane", "")
+	assert.Equal(t, http.StatusConflict, response.Code)
+	assert.Equal(t, 1, len(mockFriendsHandler.FriendsList))
+
+	// Reads and requests without a key aren't affected
+	response = requestWithKey("GET", "/api/v1/friends/jane-doe/history", "add-jane", "")
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends", []byte(`{"Name": "Jane Doe"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	assert.Equal(t, 2, len(mockFriendsHandler.FriendsList))
+
+	// Failed preconditions aren't saved, so the retry with the right ETag is run for real
+	putWithETag := func(etag string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("PUT", "/api/v1/friends/jane-doe", strings.NewReader(`{"Name": "Jane Doe", "Notes": "Likes cats"}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "update-jane")
+		req.Header.Set("If-Match", etag)
+		recorder := httptest.NewRecorder()
+		mockRouter.ServeHTTP(recorder, req)
+		return recorder
+	}
+	response = putWithETag(`"1-99"`)
+	assert.Equal(t, http.StatusPreconditionFailed, response.Code)
+	etag := performHandlerRequest(mockRouter, "GET", "/api/v1/friends/id/jane-doe", nil).Header().Get("ETag")
+	recorder := putWithETag(etag)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	assert.Empty(t, recorder.Header().Get("Idempotent-Replayed"))
+}
+
+// Reads the next Server-Sent Event from the stream, skipping keep-alive comments
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) (string, string, models.Event) {
+	var id, eventType string
+	var event models.Event
+	for {
+		line, err := reader.ReadString('\n')
+		if !assert.NoError(t, err) {
+			return id, eventType, event
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "" && id != "":
+			return id, eventType, event
+		case strings.HasPrefix(line, "id: "):
+			id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			eventType = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			assert.NoError(t, json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+		}
+	}
+}
+
+// Test GET /events
+func TestEventsRoute(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	mockRouter, _, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	server := httptest.NewServer(mockRouter)
+	defer server.Close()
+
+	subscribe := func(query string, lastEventID string) (*http.Response, *bufio.Reader) {
+		req, err := http.NewRequest("GET", server.URL+"/api/v1/events"+query, nil)
+		assert.NoError(t, err)
+		if lastEventID != "" {
+			req.Header.Set("Last-Event-ID", lastEventID)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+		return resp, bufio.NewReader(resp.Body)
+	}
+
+	stream, reader := subscribe("", "")
+	defer stream.Body.Close()
+	deletes, deletesReader := subscribe("?type=friend.deleted", "")
+	defer deletes.Body.Close()
+
+	response := performHandlerRequest(mockRouter, "POST", "/api/v1/friends", []byte(`{"Name": "Jane Doe"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	req, _ := http.NewRequest("PATCH", "/api/v1/friends/jane-doe", strings.NewReader(`{"Notes": "Met at the climbing gym"}`))
+	req.Header.Set("Content-Type", "application/merge-patch+json")
+	req.Header.Set("Authorization", "Bearer tests")
+	recorder := httptest.NewRecorder()
+	mockRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	response = performHandlerRequest(mockRouter, "DELETE", "/api/v1/friends/jane-doe", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	createdID, eventType, event := readServerSentEvent(t, reader)
+	assert.Equal(t, models.EventFriendCreated, eventType)
+	assert.Equal(t, models.EventFriendCreated, event.Type)
+	assert.Equal(t, "Jane Doe", event.Friend.Name)
+	assert.Equal(t, "api", event.Actor)
+
+	_, eventType, event = readServerSentEvent(t, reader)
+	assert.Equal(t, models.EventFriendUpdated, eventType)
+	assert.Equal(t, "Met at the climbing gym", event.Friend.Notes)
+	assert.True(t, strings.HasPrefix(event.Actor, "token:"))
+
+	deletedID, eventType, _ := readServerSentEvent(t, reader)
+	assert.Equal(t, models.EventFriendDeleted, eventType)
+
+	// Only the types asked for are sent
+	id, eventType, _ := readServerSentEvent(t, deletesReader)
+	assert.Equal(t, deletedID, id)
+	assert.Equal(t, models.EventFriendDeleted, eventType)
+
+	// Reconnecting with the last ID received sends the events missed since
+	resumed, resumedReader := subscribe("", createdID)
+	defer resumed.Body.Close()
+	_, eventType, _ = readServerSentEvent(t, resumedReader)
+	assert.Equal(t, models.EventFriendUpdated, eventType)
+	id, eventType, _ = readServerSentEvent(t, resumedReader)
+	assert.Equal(t, deletedID, id)
+	assert.Equal(t, models.EventFriendDeleted, eventType)
+
+	// WebSockets get the same events as JSON messages
+	conn, err := websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/api/v1/events?lastEventId="+createdID, "", server.URL)
+	assert.NoError(t, err)
+	defer conn.Close()
+	assert.NoError(t, websocket.JSON.Receive(conn, &event))
+	assert.Equal(t, models.EventFriendUpdated, event.Type)
+	assert.NoError(t, websocket.JSON.Receive(conn, &event))
+	assert.Equal(t, models.EventFriendDeleted, event.Type)
+
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/events?type=friend.exploded", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+	req, _ = http.NewRequest("GET", "/api/v1/events", nil)
+	req.Header.Set("Last-Event-ID", "yesterday")
+	recorder = httptest.NewRecorder()
+	mockRouter.ServeHTTP(recorder, req)
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+}
+
+// Test POST /webhooks, GET /webhooks, GET /webhooks/:id, DELETE /webhooks/:id and GET /webhooks/:id/deliveries
+func TestWebhookRoutes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	t.Setenv("ADMIN_TOKEN", "secret")
+	// The receiver is on this machine, which webhooks can't be sent to otherwise
+	t.Setenv("WEBHOOK_ALLOWED_HOSTS", "127.0.0.1")
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	received := make(chan *http.Request, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	}))
+	defer receiver.Close()
+
+	// Deliveries are made from another connection, which would get its own empty in-memory db
+	mockFriendsHandler.DB.SetMaxOpenConns(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	mockFriendsHandler.DeliverWebhooks(ctx)
+
+	response := performAdminRequest(mockRouter, "POST", "/api/v1/webhooks", []byte(`{"URL": "`+receiver.URL+`", "Events": ["friend.created"]}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	var webhook models.Webhook
+	assert.NoError(t, json.Unmarshal(response.Body.Bytes(), &webhook))
+	assert.NotEmpty(t, webhook.Secret)
+	assert.Equal(t, []string{models.EventFriendCreated}, webhook.Events)
+	location := response.Header().Get("Location")
+	assert.Equal(t, "/api/v1/webhooks/"+strconv.FormatInt(webhook.ID, 10), location)
+
+	// Webhooks need the admin token
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/webhooks", nil)
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/webhooks", []byte(`{"URL": "https://example.com"}`))
+	assert.Equal(t, http.StatusUnauthorized, response.Code)
+
+	// The secret is only shown when the webhook is created
+	response = performAdminRequest(mockRouter, "GET", location, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NotContains(t, response.Body.String(), "Secret")
+	response = performAdminRequest(mockRouter, "GET", "/api/v1/webhooks", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	assert.NotContains(t, response.Body.String(), "Secret")
+
+	// Only the events the webhook asked for are sent
+	response = performHandlerRequest(mockRouter, "POST", "/api/v1/friends", []byte(`{"Name": "Jane Doe"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+	response = performHandlerRequest(mockRouter, "DELETE", "/api/v1/friends/jane-doe", nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	select {
+	case request := <-received:
+		assert.Equal(t, models.EventFriendCreated, request.Header.Get("X-HowAreThey-Event"))
+		assert.True(t, strings.HasPrefix(request.Header.Get("X-HowAreThey-Signature"), "sha256="))
+	case <-time.After(5 * time.Second):
+		t.Fatal("the webhook wasn't sent the event")
+	}
+
+	var deliveries []models.WebhookDelivery
+	assert.Eventually(t, func() bool {
+		response = performAdminRequest(mockRouter, "GET", location+"/deliveries", nil)
+		deliveries = nil
+		_ = json.Unmarshal(response.Body.Bytes(), &deliveries)
+		return len(deliveries) == 1 && deliveries[0].Status == models.WebhookDeliverySucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, models.EventFriendCreated, deliveries[0].EventType)
+	assert.Equal(t, 1, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusOK, deliveries[0].ResponseStatus)
+	assert.Empty(t, received)
+
+	response = performAdminRequest(mockRouter, "POST", "/api/v1/webhooks", []byte(`{"URL": "not a url"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	response = performAdminRequest(mockRouter, "POST", "/api/v1/webhooks", []byte(`{"URL": "http://169.254.169.254/latest/meta-data"}`))
+	assert.Equal(t, http.StatusUnprocessableEntity, response.Code)
+	assert.Contains(t, response.Body.String(), "private or local address")
+	response = performAdminRequest(mockRouter, "GET", location+"/deliveries?limit=0", nil)
+	assert.Equal(t, http.StatusBadRequest, response.Code)
+
+	response = performAdminRequest(mockRouter, "DELETE", location, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+	response = performAdminRequest(mockRouter, "GET", location, nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = performAdminRequest(mockRouter, "GET", location+"/deliveries", nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+	response = performAdminRequest(mockRouter, "DELETE", location, nil)
+	assert.Equal(t, http.StatusNotFound, response.Code)
+}
+
+// Starts the gRPC server on an in-memory listener and connects to it
+func setupGRPCClient(t *testing.T, mockFriendsHandler *handler.FriendsHandler) *grpc.ClientConn {
+	listener := bufconn.Listen(1024 * 1024)
+	server := handler.NewGRPCServer(mockFriendsHandler)
+	go func() {
+		_ = server.Serve(listener)
+	}()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	assert.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return conn
+}
+
+func TestGRPCServer(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	t.Setenv("ADMIN_TOKEN", "grpc-test")
+
+	mockRouter, mockFriendsHandler, err := setupTestEnvironment(false)
+	assert.NoError(t, err)
+
+	// Calls are handled on other connections, which would get their own empty in-memory db
+	mockFriendsHandler.DB.SetMaxOpenConns(1)
+
+	conn := setupGRPCClient(t, mockFriendsHandler)
+	client := pb.NewFriendsServiceClient(conn)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer grpc-test")
+
+	// Calls need the admin token, the same as the admin endpoints
+	_, err = client.ListFriends(context.Background(), &pb.ListFriendsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	_, err = client.ListFriends(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer wrong"), &pb.ListFriendsRequest{})
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+	_, err = client.PickFriend(ctx, &pb.PickFriendRequest{})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	response := performHandlerRequest(mockRouter, "POST", "/api/v1/fields", []byte(`{"Name": "partner", "Type": "text"}`))
+	assert.Equal(t, http.StatusCreated, response.Code)
+
+	_, events, unsubscribe := mockFriendsHandler.Events.Subscribe(0)
+	defer unsubscribe()
+
+	fields, err := structpb.NewStruct(map[string]interface{}{"partner": "Donna"})
+	assert.NoError(t, err)
+	created, err := client.CreateFriend(ctx, &pb.CreateFriendRequest{Friend: &pb.Friend{
+		Name:          "Steve Carell",
+		LastContacted: "2023-06-06",
+		Tags:          []string{"Work"},
+		Fields:        fields,
+	}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.NotEmpty(t, created.Id)
+	assert.Equal(t, "steve-carell", created.Slug)
+	assert.Equal(t, []string{"work"}, created.Tags)
+	assert.Equal(t, "Donna", created.Fields.AsMap()["partner"])
+	assert.Equal(t, int64(1), created.Version)
+
+	// Changes made over gRPC are published like any other, against the token in the metadata
+	select {
+	case event := <-events:
+		assert.Equal(t, models.EventFriendCreated, event.Type)
+		assert.True(t, strings.HasPrefix(event.Actor, "token:"))
+		assert.Equal(t, created.Id, event.Friend.ID)
+	case <-time.After(time.Second):
+		t.Fatal("no event was published")
+	}
+
+	// Friends created over gRPC are served by the REST API too
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/friends/id/"+created.Id, nil)
+	assert.Equal(t, http.StatusOK, response.Code)
+
+	_, err = client.CreateFriend(ctx, &pb.CreateFriendRequest{Friend: &pb.Friend{Name: "Steve Carell", Birthday: "23-02-1996"}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	_, err = client.CreateFriend(ctx, &pb.CreateFriendRequest{})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	friend, err := client.GetFriend(ctx, &pb.GetFriendRequest{Id: "steve-carell"})
+	assert.NoError(t, err)
+	assert.Equal(t, created.Id, friend.Id)
+	_, err = client.GetFriend(ctx, &pb.GetFriendRequest{Id: "nobody"})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+
+	list, err := client.ListFriends(ctx, &pb.ListFriendsRequest{Tags: []string{"work"}})
+	assert.NoError(t, err)
+	assert.Equal(t, int32(1), list.TotalCount)
+	assert.Len(t, list.Friends, 1)
+	hasBirthday := true
+	list, err = client.ListFriends(ctx, &pb.ListFriendsRequest{HasBirthday: &hasBirthday})
+	assert.NoError(t, err)
+	assert.Empty(t, list.Friends)
+	_, err = client.ListFriends(ctx, &pb.ListFriendsRequest{Sort: "age"})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	updated, err := client.UpdateFriend(ctx, &pb.UpdateFriendRequest{
+		Id:      created.Id,
+		Friend:  &pb.Friend{Name: "Steve Carell", LastContacted: "2023-06-06", Notes: "Funny guy", Tags: []string{"work"}},
+		Version: created.Version,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "Funny guy", updated.Notes)
+	assert.Equal(t, "steve-carell", updated.Slug)
+	assert.Nil(t, updated.Fields)
+	assert.Equal(t, int64(2), updated.Version)
+
+	// Changes based on an old version are turned away
+	_, err = client.UpdateFriend(ctx, &pb.UpdateFriendRequest{Id: created.Id, Friend: &pb.Friend{Name: "Michael Scott"}, Version: created.Version})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+	_, err = client.DeleteFriend(ctx, &pb.DeleteFriendRequest{Id: created.Id, Version: created.Version})
+	assert.Equal(t, codes.Aborted, status.Code(err))
+
+	picked, err := client.PickFriend(ctx, &pb.PickFriendRequest{Tags: []string{"work"}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, created.Id, picked.Id)
+	friend, err = client.GetFriend(ctx, &pb.GetFriendRequest{Id: created.Id})
+	assert.NoError(t, err)
+	assert.Equal(t, time.Now().Format("2006-01-02"), friend.LastContacted)
+
+	birthdays, err := client.GetBirthdays(ctx, &pb.GetBirthdaysRequest{})
+	assert.NoError(t, err)
+	assert.Empty(t, birthdays.Friends)
+
+	deleted, err := client.DeleteFriend(ctx, &pb.DeleteFriendRequest{Id: "steve-carell", Version: friend.Version})
+	assert.NoError(t, err)
+	assert.Equal(t, created.Id, deleted.Id)
+	_, err = client.GetFriend(ctx, &pb.GetFriendRequest{Id: created.Id})
+	assert.Equal(t, codes.NotFound, status.Code(err))
+	response = performHandlerRequest(mockRouter, "GET", "/api/v1/trash", nil)
+	assert.Contains(t, response.Body.String(), created.Id)
+
+	// Health checks don't need the token
+	health, err := grpc_health_v1.NewHealthClient(conn).Check(context.Background(), &grpc_health_v1.HealthCheckRequest{Service: pb.FriendsService_ServiceDesc.ServiceName})
+	assert.NoError(t, err)
+	assert.Equal(t, grpc_health_v1.HealthCheckResponse_SERVING, health.Status)
+
+	stream, err := grpc_reflection_v1.NewServerReflectionClient(conn).ServerReflectionInfo(ctx)
+	assert.NoError(t, err)
+	assert.NoError(t, stream.Send(&grpc_reflection_v1.ServerReflectionRequest{
+		MessageRequest: &grpc_reflection_v1.ServerReflectionRequest_ListServices{},
+	}))
+	reflected, err := stream.Recv()
+	assert.NoError(t, err)
+	var services []string
+	for _, service := range reflected.GetListServicesResponse().GetService() {
+		services = append(services, service.GetName())
+	}
+	assert.Contains(t, services, pb.FriendsService_ServiceDesc.ServiceName)
+	assert.Contains(t, services, grpc_health_v1.Health_ServiceDesc.ServiceName)
+
+	// Without ADMIN_TOKEN the friends service is turned off, apart from the scheduler's token
+	t.Setenv("ADMIN_TOKEN", "")
+	_, err = client.ListFriends(ctx, &pb.ListFriendsRequest{})
+	assert.Equal(t, codes.Unavailable, status.Code(err))
+	mockFriendsHandler.SchedulerToken = "scheduler-secret"
+	_, err = client.ListFriends(metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer scheduler-secret"), &pb.ListFriendsRequest{})
+	assert.NoError(t, err)
+}
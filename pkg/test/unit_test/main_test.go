@@ -1,12 +1,28 @@
 package test
 
 import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"howarethey/pkg/handler"
 	"howarethey/pkg/logger"
 	"howarethey/pkg/models"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,13 +44,7 @@ func setupTestDB() (*sql.DB, error) {
 		return nil, err
 	}
 
-	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS friends (
-		id INTEGER PRIMARY KEY,
-		name TEXT NOT NULL,
-		lastContacted TEXT NOT NULL,
-		birthday TEXT NOT NULL,
-		notes TEXT NOT NULL
-	);`)
+	err = models.CreateTables(db)
 	if err != nil {
 		return nil, err
 	}
@@ -93,7 +103,7 @@ func TestCheckBirthday(t *testing.T) {
 
 	mockTodaysDate := time.Date(2020, time.February, 23, 0, 0, 0, 0, time.UTC)
 
-	result := models.CheckBirthdays(mockFriendsList, mockTodaysDate)
+	result := models.CheckBirthdays(mockFriendsList, mockTodaysDate, nil)
 
 	assert.Equal(t, 1, len(result))
 	assert.Equal(t, "John Wick", result[0].Name)
@@ -102,7 +112,7 @@ func TestCheckBirthday(t *testing.T) {
 func TestCheckBirthdayNoResults(t *testing.T) {
 	mockTodaysDate := time.Date(2020, time.January, 10, 0, 0, 0, 0, time.UTC)
 
-	result := models.CheckBirthdays(mockFriendsList, mockTodaysDate)
+	result := models.CheckBirthdays(mockFriendsList, mockTodaysDate, nil)
 
 	assert.Equal(t, len(result), 0)
 }
@@ -147,8 +157,13 @@ func TestAddFriend(t *testing.T) {
 		Notes:         "Definitely a lizard person",
 	}
 
-	err = models.AddFriend(db, newFriend)
+	created, err := models.AddFriend(db, newFriend)
 	assert.NoError(t, err)
+	assert.Equal(t, "1", created.ID)
+	assert.Equal(t, "zark-muckerberg", created.Slug)
+	assert.Equal(t, newFriend.Name, created.Name)
+	assert.Equal(t, newFriend.Notes, created.Notes)
+	assert.Equal(t, 1, created.Version)
 
 	var friendCount int
 	err = db.QueryRow("SELECT COUNT(*) FROM friends WHERE id = 1").Scan(&friendCount)
@@ -173,9 +188,100 @@ func TestDeleteFriend(t *testing.T) {
 	assert.NoError(t, err)
 
 	var friendCount int
-	err = db.QueryRow("SELECT COUNT(*) FROM friends").Scan(&friendCount)
+	err = db.QueryRow("SELECT COUNT(*) FROM friends WHERE deletedAt = ''").Scan(&friendCount)
 	assert.NoError(t, err)
 	assert.Equal(t, 1, friendCount, "Expected new friend to be deleted")
+
+	err = models.DeleteFriend(db, friendTwo)
+	assert.ErrorIs(t, err, models.ErrFriendNotFound, "Friends already in the trash can't be deleted again")
+}
+
+func TestTrash(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	friendOne := mockFriendsList[0]
+	friendTwo := mockFriendsList[1]
+
+	err = insertMockFriend(db, friendOne.ID, friendOne.Name, friendOne.LastContacted, friendOne.Birthday, friendOne.Notes)
+	assert.NoError(t, err)
+	err = insertMockFriend(db, friendTwo.ID, friendTwo.Name, friendTwo.LastContacted, friendTwo.Birthday, friendTwo.Notes)
+	assert.NoError(t, err)
+
+	err = models.DeleteFriend(db, friendOne)
+	assert.NoError(t, err)
+	err = models.DeleteFriend(db, friendTwo)
+	assert.NoError(t, err)
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(friends))
+
+	trash, err := models.BuildTrashList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(trash))
+	assert.NotEmpty(t, trash[0].DeletedAt)
+
+	err = models.RestoreFriend(db, friendOne.ID)
+	assert.NoError(t, err)
+	assert.ErrorIs(t, models.RestoreFriend(db, friendOne.ID), models.ErrFriendNotFound)
+
+	// Deleting and restoring both count as changes
+	restored := friendOne
+	restored.Version = 3
+
+	friends, err = models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, models.FriendsList{restored}, friends)
+
+	// Nothing has been in the trash long enough to be purged yet
+	purged, err := models.PurgeDeletedFriends(db, time.Now().AddDate(0, 0, -30))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, purged)
+
+	purged, err = models.PurgeDeletedFriends(db, time.Now().Add(time.Second))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	var friendCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM friends").Scan(&friendCount)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, friendCount)
+}
+
+func TestPurgeDeletedFriendsIsAtomic(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	for _, friend := range mockFriendsList[:2] {
+		err = insertMockFriend(db, friend.ID, friend.Name, friend.LastContacted, friend.Birthday, friend.Notes)
+		assert.NoError(t, err)
+		_, err = models.AddContactMethod(db, friend.ID, models.ContactMethod{Type: "email", Value: "friend@example.com"})
+		assert.NoError(t, err)
+		assert.NoError(t, models.DeleteFriend(db, friend))
+	}
+
+	// Make the purge fail after the first friend's row has already been deleted
+	_, err = db.Exec("DROP TABLE friend_photos")
+	assert.NoError(t, err)
+
+	purged, err := models.PurgeDeletedFriends(db, time.Now().Add(time.Second))
+	assert.Error(t, err)
+	assert.Equal(t, 0, purged)
+
+	var friendCount, contactCount, purgeCount int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM friends").Scan(&friendCount))
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM contact_methods").Scan(&contactCount))
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM audit_log WHERE action = ?", models.AuditActionPurge).Scan(&purgeCount))
+	assert.Equal(t, 2, friendCount)
+	assert.Equal(t, 2, contactCount)
+	assert.Equal(t, 0, purgeCount)
 }
 
 func TestSqlUpdateFriend(t *testing.T) {
@@ -204,6 +310,69 @@ func TestSqlUpdateFriend(t *testing.T) {
 	assert.Equal(t, updatedFriend.Notes, friend.Notes)
 }
 
+func TestSqlUpdateFriendAtVersion(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = insertMockFriend(db, "1", "John Wick", "2023-06-06", "1996-02-23", "Nice guy")
+	assert.NoError(t, err)
+
+	friend, err := models.SqlGetFriend(db, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, friend.Version)
+
+	friend.Notes = "Likes dogs"
+	assert.NoError(t, models.SqlUpdateFriendAtVersion(db, "1", friend, 1))
+	assert.Equal(t, 2, friend.Version)
+
+	friend.Notes = "Likes cats"
+	assert.ErrorIs(t, models.SqlUpdateFriendAtVersion(db, "1", friend, 1), models.ErrVersionMismatch)
+	assert.ErrorIs(t, models.DeleteFriendAtVersion(db, *friend, 1), models.ErrVersionMismatch)
+
+	saved, err := models.SqlGetFriend(db, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "Likes dogs", saved.Notes)
+	assert.Equal(t, 2, saved.Version)
+
+	// 0 ignores the version, and the friend is given the version they were saved at
+	assert.NoError(t, models.SqlUpdateFriendAtVersion(db, "1", friend, 0))
+	assert.Equal(t, 3, friend.Version)
+	assert.NoError(t, models.DeleteFriendAtVersion(db, *friend, 3))
+	assert.ErrorIs(t, models.DeleteFriendAtVersion(db, *friend, 4), models.ErrFriendNotFound)
+}
+
+func TestSqlUpdateFriendIsAtomic(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = insertMockFriend(db, "1", "John Wick", "2023-06-06", "1996-02-23", "Nice guy")
+	assert.NoError(t, err)
+
+	// Friends that don't exist aren't updated, whatever the version
+	missing := models.Friend{Name: "Nobody", Tags: []string{"work"}}
+	assert.ErrorIs(t, models.SqlUpdateFriend(db, "9", &missing), models.ErrFriendNotFound)
+	var tagged int
+	assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM friend_tags WHERE friendId = '9'").Scan(&tagged))
+	assert.Equal(t, 0, tagged)
+
+	// A change that fails part way through leaves the friend as they were, with nothing in the audit log
+	friend, err := models.SqlGetFriend(db, "1")
+	assert.NoError(t, err)
+	friend.Name = "Jonathan Wick"
+	friend.Fields = map[string]interface{}{"partner": "Helen"}
+	assert.Error(t, models.SqlUpdateFriend(db, "1", friend))
+
+	saved, err := models.SqlGetFriend(db, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, "John Wick", saved.Name)
+	assert.Equal(t, 1, saved.Version)
+	entries, err := models.GetAuditLog(db, models.AuditFilter{FriendID: "1"})
+	assert.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
 func TestIsValidDate(t *testing.T) {
 	assert.True(t, handler.IsValidDate("2024-03-02"))
 }
@@ -215,6 +384,1629 @@ func TestInvalidDate(t *testing.T) {
 	assert.False(t, handler.IsValidDate("this should fail"))
 }
 
+func TestParseFriendsCSV(t *testing.T) {
+	csvData := "Name,ID,Birthday\nJohn Wick,1,1996-02-23\nPeter Parker,,\n"
+
+	friends, err := models.ParseFriendsCSV(strings.NewReader(csvData))
+	assert.NoError(t, err)
+
+	assert.Equal(t, 2, len(friends))
+	assert.Equal(t, models.Friend{ID: "1", Name: "John Wick", Birthday: "1996-02-23"}, friends[0])
+	assert.Equal(t, models.Friend{Name: "Peter Parker"}, friends[1])
+
+	_, err = models.ParseFriendsCSV(strings.NewReader("ID,Birthday\n1,1996-02-23\n"))
+	assert.Error(t, err)
+}
+
+func TestImportFriends(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	friendOne := mockFriendsList[0]
+	err = insertMockFriend(db, friendOne.ID, friendOne.Name, friendOne.LastContacted, friendOne.Birthday, friendOne.Notes)
+	assert.NoError(t, err)
+
+	updatedFriendOne := friendOne
+	updatedFriendOne.Notes = "Likes dogs"
+
+	importList := models.FriendsList{
+		updatedFriendOne,
+		mockFriendsList[1],
+		{Name: "Jane Doe", LastContacted: "2024-01-15"},
+	}
+
+	report, err := models.ImportFriends(db, importList, false)
+	assert.NoError(t, err)
+	assert.True(t, report.Committed)
+	assert.Equal(t, 2, report.Created)
+	assert.Equal(t, 1, report.Updated)
+	assert.Equal(t, models.ImportStatusUpdated, report.Results[0].Status)
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(friends))
+	assert.Equal(t, "Likes dogs", friends[0].Notes)
+
+	// Importing the same data again shouldn't change anything
+	report, err = models.ImportFriends(db, friends, false)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, report.Skipped)
+}
+
+func TestImportFriendsRollsBack(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	importList := models.FriendsList{
+		{Name: "Jane Doe", LastContacted: "2024-01-15"},
+		{Name: "Bad Date", Birthday: "23/02/1996"},
+	}
+
+	report, err := models.ImportFriends(db, importList, false)
+	assert.NoError(t, err)
+	assert.False(t, report.Committed)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, models.ImportStatusFailed, report.Results[1].Status)
+
+	// Dry runs never get written
+	report, err = models.ImportFriends(db, importList[:1], true)
+	assert.NoError(t, err)
+	assert.False(t, report.Committed)
+	assert.Equal(t, 1, report.Created)
+
+	var friendCount int
+	err = db.QueryRow("SELECT COUNT(*) FROM friends").Scan(&friendCount)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, friendCount)
+}
+
+func TestRunBatch(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = insertMockFriend(db, "1", "John Wick", "2023-06-06", "1996-02-23", "Nice guy")
+	assert.NoError(t, err)
+	err = insertMockFriend(db, "2", "Peter Parker", "2023-12-12", "1996-02-23", "I think he's Spiderman")
+	assert.NoError(t, err)
+
+	batch := models.Batch{Operations: []models.BatchOperation{
+		{Op: models.BatchOpCreate, Friend: json.RawMessage(`{"Name": "Jane Doe", "Tags": ["party"]}`)},
+		{Op: models.BatchOpUpdate, ID: "1", Friend: json.RawMessage(`{"LastContacted": "2024-04-17"}`)},
+		{Op: models.BatchOpDelete, ID: "99"},
+	}}
+
+	// Nothing is saved when an operation fails in atomic mode
+	report, err := models.RunBatch(db, "api", batch)
+	assert.NoError(t, err)
+	assert.Equal(t, models.BatchModeAtomic, report.Mode)
+	assert.False(t, report.Committed)
+	assert.Equal(t, 2, report.Succeeded)
+	assert.Equal(t, 1, report.Failed)
+	assert.Equal(t, models.BatchStatusFailed, report.Results[2].Status)
+	assert.Equal(t, models.ErrFriendNotFound.Error(), report.Results[2].Error)
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(friends))
+	assert.Equal(t, "2023-06-06", friends[0].LastContacted)
+
+	batch.Mode = models.BatchModeBestEffort
+	batch.Operations = append(batch.Operations,
+		models.BatchOperation{Op: models.BatchOpUpdate, ID: "2", Friend: json.RawMessage(`{"Birthday": "23/02/1996"}`)},
+		models.BatchOperation{Op: models.BatchOpDelete, ID: "2"})
+	report, err = models.RunBatch(db, "api", batch)
+	assert.NoError(t, err)
+	assert.True(t, report.Committed)
+	assert.Equal(t, 3, report.Succeeded)
+	assert.Equal(t, 2, report.Failed)
+	assert.Equal(t, models.BatchStatusCreated, report.Results[0].Status)
+	assert.Equal(t, "3", report.Results[0].ID)
+	assert.Equal(t, models.BatchStatusUpdated, report.Results[1].Status)
+	assert.Equal(t, models.BatchStatusFailed, report.Results[3].Status)
+	assert.Equal(t, models.BatchStatusDeleted, report.Results[4].Status)
+	assert.Equal(t, "2", report.Results[4].ID)
+
+	friends, err = models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(friends))
+	assert.Equal(t, "2024-04-17", friends[0].LastContacted)
+	assert.Equal(t, "Jane Doe", friends[1].Name)
+	assert.Equal(t, []string{"party"}, friends[1].Tags)
+
+	entries, err := models.GetAuditLog(db, models.AuditFilter{Actor: "api"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+
+	_, err = models.RunBatch(db, "api", models.Batch{Mode: "sometimes", Operations: batch.Operations})
+	var validationErr *models.ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "Mode", validationErr.Field)
+
+	_, err = models.RunBatch(db, "api", models.Batch{})
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "Operations", validationErr.Field)
+}
+
+func TestIdempotencyKeys(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	since := time.Now().Add(-time.Hour)
+	claimedSince := time.Now().Add(-time.Minute)
+
+	stored, err := models.ClaimIdempotencyKey(db, "key-1", "api", "post-friends", since, claimedSince)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	_, err = models.ClaimIdempotencyKey(db, "key-1", "api", "post-friends", since, claimedSince)
+	assert.ErrorIs(t, err, models.ErrIdempotencyKeyInUse)
+
+	response := models.StoredResponse{Status: 201, Header: map[string]string{"Content-Type": "application/json"}, Body: []byte(`{"ID":"1"}`)}
+	assert.NoError(t, models.SaveIdempotentResponse(db, "key-1", "api", response))
+
+	stored, err = models.ClaimIdempotencyKey(db, "key-1", "api", "post-friends", since, claimedSince)
+	assert.NoError(t, err)
+	assert.Equal(t, &response, stored)
+
+	_, err = models.ClaimIdempotencyKey(db, "key-1", "api", "delete-friend", since, claimedSince)
+	assert.ErrorIs(t, err, models.ErrIdempotencyKeyReused)
+
+	// Keys belong to the actor that sent them
+	stored, err = models.ClaimIdempotencyKey(db, "key-1", "scheduler", "delete-friend", since, claimedSince)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	// Released keys can be claimed again
+	assert.NoError(t, models.ReleaseIdempotencyKey(db, "key-1", "scheduler"))
+	stored, err = models.ClaimIdempotencyKey(db, "key-1", "scheduler", "post-friends", since, claimedSince)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	// As can keys older than the window
+	stored, err = models.ClaimIdempotencyKey(db, "key-1", "api", "delete-friend", time.Now().Add(time.Minute), claimedSince)
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+
+	// Claims that never saved a response are let go of after a while, i.e. if the app stopped part way through the request
+	_, err = models.ClaimIdempotencyKey(db, "key-1", "api", "delete-friend", since, claimedSince)
+	assert.ErrorIs(t, err, models.ErrIdempotencyKeyInUse)
+	stored, err = models.ClaimIdempotencyKey(db, "key-1", "api", "delete-friend", since, time.Now().Add(time.Minute))
+	assert.NoError(t, err)
+	assert.Nil(t, stored)
+}
+
+func TestEventBus(t *testing.T) {
+	bus := models.NewEventBus(2)
+
+	missed, events, unsubscribe := bus.Subscribe(0)
+	assert.Empty(t, missed)
+
+	first := bus.Publish(models.Event{Type: models.EventFriendCreated, Friend: models.Friend{ID: "1", Name: "John Wick"}})
+	second := bus.Publish(models.Event{Type: models.EventFriendUpdated, Friend: models.Friend{ID: "1", Name: "John Wick"}})
+	third := bus.Publish(models.Event{Type: models.EventFriendDeleted, Friend: models.Friend{ID: "1", Name: "John Wick"}})
+	assert.Equal(t, first.ID+1, second.ID)
+	assert.NotEmpty(t, first.Timestamp)
+
+	assert.Equal(t, first, <-events)
+	assert.Equal(t, second, <-events)
+	assert.Equal(t, third, <-events)
+	unsubscribe()
+	unsubscribe()
+
+	// Only the events after the last one received are sent again, and only as many as are kept
+	missed, _, unsubscribe = bus.Subscribe(first.ID)
+	assert.Equal(t, []models.Event{second, third}, missed)
+	unsubscribe()
+	missed, _, unsubscribe = bus.Subscribe(first.ID - 1)
+	assert.Equal(t, []models.Event{second, third}, missed)
+	unsubscribe()
+
+	// IDs from before a restart are older than the new bus's events
+	time.Sleep(10 * time.Millisecond)
+	restarted := models.NewEventBus(2)
+	event := restarted.Publish(models.Event{Type: models.EventBirthday})
+	assert.Greater(t, event.ID, third.ID)
+
+	// Subscribers that stop reading are dropped rather than holding up the bus
+	_, events, unsubscribe = bus.Subscribe(0)
+	defer unsubscribe()
+	for i := 0; i < 100; i++ {
+		bus.Publish(models.Event{Type: models.EventFriendPicked})
+	}
+	received := 0
+	for range events {
+		received++
+	}
+	assert.Less(t, received, 100)
+
+	var nilBus *models.EventBus
+	assert.Equal(t, models.EventBirthday, nilBus.Publish(models.Event{Type: models.EventBirthday}).Type)
+}
+
+func TestFriendsListEvents(t *testing.T) {
+	john := models.Friend{ID: "1", Name: "John Wick", Version: 1}
+	peter := models.Friend{ID: "2", Name: "Peter Parker", Version: 1}
+	tony := models.Friend{ID: "3", Name: "Tony Stark", Version: 1}
+
+	updatedJohn := john
+	updatedJohn.Notes = "Likes dogs"
+	updatedJohn.Version = 2
+	restoredTony := tony
+	restoredTony.Version = 3
+	newFriend := models.Friend{ID: "4", Name: "Jane Doe", Version: 1}
+
+	events := models.FriendsListEvents(models.FriendsList{john, peter}, models.FriendsList{updatedJohn, restoredTony, newFriend})
+	assert.Equal(t, []models.Event{
+		{Type: models.EventFriendUpdated, Friend: updatedJohn},
+		{Type: models.EventFriendRestored, Friend: restoredTony},
+		{Type: models.EventFriendCreated, Friend: newFriend},
+		{Type: models.EventFriendDeleted, Friend: peter},
+	}, events)
+
+	assert.Empty(t, models.FriendsListEvents(models.FriendsList{john, peter}, models.FriendsList{john, peter}))
+	assert.Empty(t, models.FriendsListEvents(nil, nil))
+}
+
+func TestWebhooks(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = models.AddWebhook(db, models.Webhook{URL: "ftp://example.com"})
+	assert.EqualError(t, err, "url must be an http or https link")
+	_, err = models.AddWebhook(db, models.Webhook{URL: "https://example.com", Events: []string{"friend.exploded"}})
+	assert.ErrorContains(t, err, "events must be one of")
+	_, err = models.AddWebhook(db, models.Webhook{URL: "https://example.com", Secret: "short"})
+	assert.EqualError(t, err, "secret must be at least 16 characters")
+
+	webhook, err := models.AddWebhook(db, models.Webhook{
+		URL:    " https://example.com/hook ",
+		Events: []string{models.EventBirthday, models.EventBirthday, models.EventFriendPicked},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/hook", webhook.URL)
+	assert.Equal(t, []string{models.EventBirthday, models.EventFriendPicked}, webhook.Events)
+	assert.Len(t, webhook.Secret, 64)
+	assert.True(t, webhook.Wants(models.EventBirthday))
+	assert.False(t, webhook.Wants(models.EventFriendCreated))
+
+	everything, err := models.AddWebhook(db, models.Webhook{URL: "http://localhost:9000", Secret: "a secret that is long enough"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{}, everything.Events)
+	assert.Equal(t, "a secret that is long enough", everything.Secret)
+	assert.True(t, everything.Wants(models.EventFriendCreated))
+
+	webhooks, err := models.ListWebhooks(db)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Webhook{webhook, everything}, webhooks)
+
+	assert.NoError(t, models.DeleteWebhook(db, webhook.ID))
+	_, err = models.GetWebhook(db, webhook.ID)
+	assert.Equal(t, models.ErrWebhookNotFound, err)
+	assert.Equal(t, models.ErrWebhookNotFound, models.DeleteWebhook(db, webhook.ID))
+	_, err = models.ListWebhookDeliveries(db, webhook.ID, 0)
+	assert.Equal(t, models.ErrWebhookNotFound, err)
+
+	// Webhooks can't be sent to this machine or a private network unless the host is allowed
+	for _, link := range []string{"http://localhost:9000", "http://127.0.0.1", "http://[::1]/hook", "http://169.254.169.254/latest", "https://10.0.0.1", "http://0.0.0.0"} {
+		assert.EqualError(t, models.CheckWebhookHost(context.Background(), link, nil), "url must not point at a private or local address", link)
+	}
+	assert.NoError(t, models.CheckWebhookHost(context.Background(), "http://localhost:9000", []string{"LOCALHOST"}))
+	assert.NoError(t, models.CheckWebhookHost(context.Background(), "https://93.184.216.34/hook", nil))
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Fails the first attempt at every delivery
+	var requests []*http.Request
+	var bodies [][]byte
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		if len(requests)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	webhook, err := models.AddWebhook(db, models.Webhook{URL: receiver.URL, Secret: "a secret that is long enough"})
+	assert.NoError(t, err)
+
+	// Deliveries are sent from other connections, which would get their own empty in-memory db
+	db.SetMaxOpenConns(1)
+	ctx := context.Background()
+	getDelivery := func(id int64) models.WebhookDelivery {
+		deliveries, err := models.ListWebhookDeliveries(db, webhook.ID, 0)
+		assert.NoError(t, err)
+		for _, delivery := range deliveries {
+			if delivery.ID == id {
+				return delivery
+			}
+		}
+		return models.WebhookDelivery{}
+	}
+
+	// Deliveries to this machine are refused unless it's allowed
+	refusing := &models.WebhookDispatcher{DB: db, MaxAttempts: 1}
+	refused, err := refusing.Queue(webhook, models.Event{ID: 41, Type: models.EventBirthday})
+	assert.NoError(t, err)
+	next, err := refusing.DeliverDue(ctx)
+	assert.NoError(t, err)
+	assert.True(t, next.IsZero())
+	refused = getDelivery(refused.ID)
+	assert.Equal(t, models.WebhookDeliveryFailed, refused.Status)
+	assert.Contains(t, refused.Error, models.ErrPrivateWebhookAddress.Error())
+	assert.Empty(t, requests)
+
+	newDispatcher := func() *models.WebhookDispatcher {
+		return &models.WebhookDispatcher{
+			DB:          db,
+			Client:      models.NewWebhookClient(time.Second, []string{"127.0.0.1"}),
+			MaxAttempts: 3,
+			RetryDelay:  50 * time.Millisecond,
+		}
+	}
+	dispatcher := newDispatcher()
+	event := models.Event{ID: 42, Type: models.EventBirthday, Friend: models.Friend{ID: "1", Name: "John Wick"}}
+
+	delivery, err := dispatcher.Queue(webhook, event)
+	assert.NoError(t, err)
+	assert.Equal(t, models.WebhookDeliveryPending, delivery.Status)
+	assert.Equal(t, 0, delivery.Attempts)
+
+	// The first attempt fails, so the retry is kept until it's due
+	next, err = dispatcher.DeliverDue(ctx)
+	assert.NoError(t, err)
+	assert.False(t, next.IsZero())
+	delivery = getDelivery(delivery.ID)
+	assert.Equal(t, models.WebhookDeliveryPending, delivery.Status)
+	assert.Equal(t, 1, delivery.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, delivery.ResponseStatus)
+	assert.Equal(t, next.UTC().Format(time.RFC3339Nano), delivery.NextAttemptAt)
+	_, err = dispatcher.DeliverDue(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, requests, 1)
+
+	// Retries are in the db, so they're sent even if the app restarted while waiting
+	time.Sleep(time.Until(next))
+	next, err = newDispatcher().DeliverDue(ctx)
+	assert.NoError(t, err)
+	assert.True(t, next.IsZero())
+	delivery = getDelivery(delivery.ID)
+	assert.Equal(t, models.WebhookDeliverySucceeded, delivery.Status)
+	assert.Equal(t, 2, delivery.Attempts)
+	assert.Equal(t, http.StatusNoContent, delivery.ResponseStatus)
+	assert.Empty(t, delivery.Error)
+	assert.Empty(t, delivery.NextAttemptAt)
+
+	// The payload is the event, signed with the webhook's secret
+	assert.Len(t, requests, 2)
+	request := requests[1]
+	var sent models.Event
+	assert.NoError(t, json.Unmarshal(bodies[1], &sent))
+	assert.Equal(t, event, sent)
+	assert.Equal(t, models.EventBirthday, request.Header.Get("X-HowAreThey-Event"))
+	assert.Equal(t, strconv.FormatInt(delivery.ID, 10), request.Header.Get("X-HowAreThey-Delivery"))
+	mac := hmac.New(sha256.New, []byte("a secret that is long enough"))
+	mac.Write([]byte(request.Header.Get("X-HowAreThey-Timestamp") + "."))
+	mac.Write(bodies[1])
+	assert.Equal(t, "sha256="+hex.EncodeToString(mac.Sum(nil)), request.Header.Get("X-HowAreThey-Signature"))
+
+	// Deliveries that never work are given up on after the last attempt
+	dispatcher.MaxAttempts = 1
+	failed, err := dispatcher.Queue(webhook, models.Event{ID: 43, Type: models.EventFriendPicked})
+	assert.NoError(t, err)
+	_, err = dispatcher.DeliverDue(ctx)
+	assert.NoError(t, err)
+	failed = getDelivery(failed.ID)
+	assert.Equal(t, models.WebhookDeliveryFailed, failed.Status)
+	assert.Equal(t, 1, failed.Attempts)
+	assert.Equal(t, http.StatusServiceUnavailable, failed.ResponseStatus)
+	assert.Equal(t, "webhook responded with 503 Service Unavailable", failed.Error)
+
+	deliveries, err := models.ListWebhookDeliveries(db, webhook.ID, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.WebhookDelivery{failed, delivery, refused}, deliveries)
+
+	deliveries, err = models.ListWebhookDeliveries(db, webhook.ID, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.WebhookDelivery{failed}, deliveries)
+
+	// Deliveries left pending are picked up when the dispatcher starts, and it stops when the context is cancelled
+	pending, err := dispatcher.Queue(webhook, models.Event{ID: 44, Type: models.EventBirthday})
+	assert.NoError(t, err)
+	startCtx, cancel := context.WithCancel(ctx)
+	newDispatcher().Start(startCtx, models.NewEventBus(10))
+	assert.Eventually(t, func() bool {
+		return getDelivery(pending.ID).Status == models.WebhookDeliverySucceeded
+	}, 5*time.Second, 10*time.Millisecond)
+	cancel()
+}
+
+func TestLoadSeedFile(t *testing.T) {
+	seedFilePath := t.TempDir() + "/friends.yaml"
+	seedData := `friends:
+  - name: John Wick
+    lastContacted: 2023-06-06
+    birthday: 1996-02-23
+    notes: Nice guy
+  - key: spidey
+    name: Peter Parker
+`
+	err := os.WriteFile(seedFilePath, []byte(seedData), 0644)
+	assert.NoError(t, err)
+
+	seed, err := models.LoadSeedFile(seedFilePath)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(seed.Friends))
+	assert.Equal(t, "john-wick", seed.Friends[0].Key)
+	assert.Equal(t, "1996-02-23", seed.Friends[0].Birthday)
+	assert.Equal(t, "spidey", seed.Friends[1].Key)
+
+	err = os.WriteFile(seedFilePath, []byte("friends:\n  - name: John Wick\n    birthday: 23/02/1996\n"), 0644)
+	assert.NoError(t, err)
+
+	_, err = models.LoadSeedFile(seedFilePath)
+	assert.Error(t, err)
+}
+
+func TestSyncSeed(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	// Added through the API before the seed file existed so should be adopted rather than duplicated
+	friendOne := mockFriendsList[0]
+	err = insertMockFriend(db, friendOne.ID, friendOne.Name, friendOne.LastContacted, friendOne.Birthday, friendOne.Notes)
+	assert.NoError(t, err)
+
+	seed := models.SeedFile{Friends: []models.SeedFriend{
+		{Key: "john-wick", Name: "John Wick", LastContacted: "2024-01-01", Birthday: "1996-02-23", Notes: "Likes dogs"},
+		{Key: "spidey", Name: "Peter Parker", LastContacted: "2023-12-12"},
+	}}
+
+	report, err := models.SyncSeed(db, seed, false)
+	assert.NoError(t, err)
+	assert.Equal(t, models.SeedReport{Created: 1, Updated: 1}, report)
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(friends))
+	assert.Equal(t, "Likes dogs", friends[0].Notes)
+	assert.Equal(t, friendOne.LastContacted, friends[0].LastContacted, "LastContacted should only be set on create")
+
+	// Renaming keeps the same row because the key hasn't changed
+	seed.Friends = seed.Friends[1:]
+	seed.Friends[0].Name = "Spider-Man"
+
+	report, err = models.SyncSeed(db, seed, true)
+	assert.NoError(t, err)
+	assert.Equal(t, models.SeedReport{Updated: 1, Pruned: 1}, report)
+
+	friends, err = models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(friends))
+	assert.Equal(t, "Spider-Man", friends[0].Name)
+}
+
+func TestBackupAndRestore(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	friendOne := mockFriendsList[0]
+	err = insertMockFriend(db, friendOne.ID, friendOne.Name, friendOne.LastContacted, friendOne.Birthday, friendOne.Notes)
+	assert.NoError(t, err)
+
+	backupDir := t.TempDir()
+
+	backup, err := models.BackupDB(db, backupDir)
+	assert.NoError(t, err)
+	assert.True(t, models.IsBackupName(backup.Name))
+	assert.NoError(t, models.ValidateBackup(backupDir+"/"+backup.Name))
+
+	friendTwo := mockFriendsList[1]
+	err = insertMockFriend(db, friendTwo.ID, friendTwo.Name, friendTwo.LastContacted, friendTwo.Birthday, friendTwo.Notes)
+	assert.NoError(t, err)
+
+	err = models.RestoreDB(db, backupDir+"/"+backup.Name)
+	assert.NoError(t, err)
+
+	// Restoring migrates the backup, which gives friends saved without a slug one
+	restored := friendOne
+	restored.Slug = "john-wick"
+	restored.Version = 1
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, models.FriendsList{restored}, friends)
+}
+
+func TestRestoreInvalidBackup(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	notADatabase := t.TempDir() + "/friends-20240101-080000.db"
+	err = os.WriteFile(notADatabase, []byte("definitely not sqlite"), 0644)
+	assert.NoError(t, err)
+
+	assert.Error(t, models.ValidateBackup(notADatabase))
+	assert.Error(t, models.RestoreDB(db, notADatabase))
+
+	wrongSchema := t.TempDir() + "/other.db"
+	otherDB, err := sql.Open("sqlite3", wrongSchema)
+	assert.NoError(t, err)
+	_, err = otherDB.Exec("CREATE TABLE friends (id INTEGER PRIMARY KEY, name TEXT)")
+	assert.NoError(t, err)
+	otherDB.Close()
+
+	err = models.ValidateBackup(wrongSchema)
+	assert.EqualError(t, err, "friends table is missing the lastContacted column")
+}
+
+func TestPruneBackups(t *testing.T) {
+	backupDir := t.TempDir()
+	for _, name := range []string{"friends-20240101-080000.db", "friends-20240102-080000.db", "friends-20240103-080000.db", "notes.txt"} {
+		err := os.WriteFile(backupDir+"/"+name, []byte{}, 0644)
+		assert.NoError(t, err)
+	}
+
+	deleted, err := models.PruneBackups(backupDir, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+
+	backups, err := models.ListBackups(backupDir)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(backups))
+	assert.Equal(t, "friends-20240103-080000.db", backups[0].Name)
+
+	assert.False(t, models.IsBackupName("../friends-20240101-080000.db"))
+}
+
+func TestEncryptedNotes(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	key := bytes.Repeat([]byte{1}, 32)
+	err = models.SetEncryptionKey(key)
+	assert.NoError(t, err)
+	defer models.SetEncryptionKey(nil) //nolint:errcheck
+
+	// Friends written before encryption was turned on are still readable
+	err = insertMockFriend(db, "1", "John Wick", "2023-06-06", "1996-02-23", "Nice guy")
+	assert.NoError(t, err)
+
+	_, err = models.AddFriend(db, models.Friend{Name: "Peter Parker", LastContacted: "2023-12-12", Notes: "I think he's Spiderman"})
+	assert.NoError(t, err)
+
+	var storedNotes string
+	err = db.QueryRow("SELECT notes FROM friends WHERE id = 2").Scan(&storedNotes)
+	assert.NoError(t, err)
+	assert.NotContains(t, storedNotes, "Spiderman")
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "Nice guy", friends[0].Notes)
+	assert.Equal(t, "I think he's Spiderman", friends[1].Notes)
+
+	// Without the key the encrypted notes can't be read
+	err = models.SetEncryptionKey(nil)
+	assert.NoError(t, err)
+	_, err = models.BuildFriendsList(db)
+	assert.ErrorIs(t, err, models.ErrNoEncryptionKey)
+
+	err = models.SetEncryptionKey(bytes.Repeat([]byte{2}, 32))
+	assert.NoError(t, err)
+	_, err = models.BuildFriendsList(db)
+	assert.Error(t, err)
+
+	assert.Error(t, models.SetEncryptionKey([]byte("too short")))
+}
+
+func TestRotateEncryptionKey(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = insertMockFriend(db, "1", "John Wick", "2023-06-06", "1996-02-23", "Nice guy")
+	assert.NoError(t, err)
+
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 32)
+
+	// Encrypts the plaintext notes for the first time
+	count, err := models.RotateEncryptionKey(db, nil, oldKey)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	_, err = models.RotateEncryptionKey(db, newKey, oldKey)
+	assert.Error(t, err, "Rotating with the wrong current key should fail")
+
+	_, err = models.RotateEncryptionKey(db, oldKey, newKey)
+	assert.NoError(t, err)
+
+	err = models.SetEncryptionKey(newKey)
+	assert.NoError(t, err)
+	defer models.SetEncryptionKey(nil) //nolint:errcheck
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "Nice guy", friends[0].Notes)
+}
+
+func TestRotateEncryptionKeyBeforeUpgrade(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	// A db from before the other tables were added, that the app hasn't opened since
+	db, err := sql.Open("sqlite3", ":memory:")
+	assert.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE friends (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT NOT NULL, lastContacted TEXT NOT NULL, birthday TEXT NOT NULL, notes TEXT NOT NULL)")
+	assert.NoError(t, err)
+	_, err = db.Exec("INSERT INTO friends (name, lastContacted, birthday, notes) VALUES ('John Wick', '2023-06-06', '1996-02-23', 'Nice guy')")
+	assert.NoError(t, err)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	count, err := models.RotateEncryptionKey(db, nil, key)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	var storedNotes string
+	assert.NoError(t, db.QueryRow("SELECT notes FROM friends").Scan(&storedNotes))
+	assert.NotContains(t, storedNotes, "Nice guy")
+
+	err = models.SetEncryptionKey(key)
+	assert.NoError(t, err)
+	defer models.SetEncryptionKey(nil) //nolint:errcheck
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "Nice guy", friends[0].Notes)
+	assert.Equal(t, "john-wick", friends[0].Slug)
+}
+
+func TestLoadEncryptionKey(t *testing.T) {
+	t.Setenv("TEST_KEY", "")
+	key, err := models.LoadEncryptionKey("TEST_KEY")
+	assert.NoError(t, err)
+	assert.Nil(t, key)
+
+	keyFile := t.TempDir() + "/key"
+	err = os.WriteFile(keyFile, []byte(base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))+"\n"), 0600)
+	assert.NoError(t, err)
+	t.Setenv("TEST_KEY_FILE", keyFile)
+
+	key, err = models.LoadEncryptionKey("TEST_KEY")
+	assert.NoError(t, err)
+	assert.Equal(t, 32, len(key))
+
+	t.Setenv("TEST_KEY", "not base64!")
+	_, err = models.LoadEncryptionKey("TEST_KEY")
+	assert.Error(t, err)
+}
+
+func TestAuditLog(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = models.AddFriend(models.WithActor(db, "token:abc"), models.Friend{Name: "John Wick", LastContacted: "2023-06-06"})
+	assert.NoError(t, err)
+
+	friend, err := models.SqlGetFriend(db, "1")
+	assert.NoError(t, err)
+
+	updated := models.UpdateLastContacted(*friend, time.Date(2024, time.January, 10, 0, 0, 0, 0, time.UTC))
+	err = models.SqlUpdateFriend(models.WithActor(db, models.ActorScheduler), "1", updated)
+	assert.NoError(t, err)
+
+	// Updates that don't change anything aren't recorded
+	err = models.SqlUpdateFriend(db, "1", updated)
+	assert.NoError(t, err)
+
+	err = models.DeleteFriend(db, *updated)
+	assert.NoError(t, err)
+
+	entries, err := models.GetAuditLog(db, models.AuditFilter{FriendID: "1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, len(entries))
+
+	assert.Equal(t, models.AuditActionDelete, entries[0].Action)
+	assert.Equal(t, models.ActorSystem, entries[0].Actor)
+
+	assert.Equal(t, models.AuditActionUpdate, entries[1].Action)
+	assert.Equal(t, models.ActorScheduler, entries[1].Actor)
+	assert.Equal(t, map[string]models.FieldChange{
+		"LastContacted": {Before: "2023-06-06", After: "2024-01-10"},
+	}, entries[1].Changes)
+
+	assert.Equal(t, models.AuditActionCreate, entries[2].Action)
+	assert.Equal(t, "token:abc", entries[2].Actor)
+	assert.Equal(t, models.FieldChange{Before: "", After: "John Wick"}, entries[2].Changes["Name"])
+
+	entries, err = models.GetAuditLog(db, models.AuditFilter{Actor: models.ActorScheduler})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(entries))
+}
+
+func TestAuditLogIsEncrypted(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	err = models.SetEncryptionKey(bytes.Repeat([]byte{1}, 32))
+	assert.NoError(t, err)
+	defer models.SetEncryptionKey(nil) //nolint:errcheck
+
+	_, err = models.AddFriend(db, models.Friend{Name: "Peter Parker", Notes: "I think he's Spiderman"})
+	assert.NoError(t, err)
+
+	var storedChanges string
+	err = db.QueryRow("SELECT changes FROM audit_log").Scan(&storedChanges)
+	assert.NoError(t, err)
+	assert.NotContains(t, storedChanges, "Spiderman")
+
+	entries, err := models.GetAuditLog(db, models.AuditFilter{})
+	assert.NoError(t, err)
+	assert.Equal(t, "I think he's Spiderman", entries[0].Changes["Notes"].After)
+}
+
+func TestWebhookDeliveryHistory(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	// Nothing listens here, and it isn't allowed anyway, so every attempt fails
+	webhook, err := models.AddWebhook(db, models.Webhook{URL: "http://127.0.0.1:1"})
+	assert.NoError(t, err)
+	dispatcher := &models.WebhookDispatcher{DB: db, MaxAttempts: 1}
+
+	countDeliveries := func(status string) int {
+		var count int
+		assert.NoError(t, db.QueryRow("SELECT COUNT(*) FROM webhook_deliveries WHERE status = ?", status).Scan(&count))
+		return count
+	}
+
+	// Deliveries still waiting to be sent are never trimmed
+	for i := 1; i <= 105; i++ {
+		_, err := dispatcher.Queue(webhook, models.Event{ID: int64(i), Type: models.EventBirthday})
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 105, countDeliveries(models.WebhookDeliveryPending))
+
+	_, err = dispatcher.DeliverDue(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, 105, countDeliveries(models.WebhookDeliveryFailed))
+
+	// Only the most recent finished deliveries are kept
+	_, err = dispatcher.Queue(webhook, models.Event{ID: 106, Type: models.EventBirthday})
+	assert.NoError(t, err)
+	assert.Equal(t, 100, countDeliveries(models.WebhookDeliveryFailed))
+	assert.Equal(t, 1, countDeliveries(models.WebhookDeliveryPending))
+}
+
+func TestWebhookPayloadIsEncrypted(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	key := bytes.Repeat([]byte{1}, 32)
+	err = models.SetEncryptionKey(key)
+	assert.NoError(t, err)
+	defer models.SetEncryptionKey(nil) //nolint:errcheck
+
+	webhook, err := models.AddWebhook(db, models.Webhook{URL: "https://example.com/hook"})
+	assert.NoError(t, err)
+	event := models.Event{ID: 1, Type: models.EventFriendCreated, Friend: models.Friend{ID: "1", Name: "Peter Parker", Notes: "I think he's Spiderman"}}
+	delivery, err := (&models.WebhookDispatcher{DB: db}).Queue(webhook, event)
+	assert.NoError(t, err)
+	assert.Contains(t, delivery.Payload, "Spiderman")
+
+	var storedPayload string
+	err = db.QueryRow("SELECT payload FROM webhook_deliveries").Scan(&storedPayload)
+	assert.NoError(t, err)
+	assert.NotContains(t, storedPayload, "Spiderman")
+
+	// Rotating the key re-encrypts the payloads waiting to be sent
+	newKey := bytes.Repeat([]byte{2}, 32)
+	_, err = models.RotateEncryptionKey(db, key, newKey)
+	assert.NoError(t, err)
+	err = models.SetEncryptionKey(newKey)
+	assert.NoError(t, err)
+	deliveries, err := models.ListWebhookDeliveries(db, webhook.ID, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, delivery.Payload, deliveries[0].Payload)
+}
+
+func TestNormaliseTags(t *testing.T) {
+	tags, err := models.NormaliseTags([]string{" Work", "family", "work "})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"family", "work"}, tags)
+
+	_, err = models.NormaliseTags([]string{"family", " "})
+	assert.Error(t, err)
+
+	_, err = models.NormaliseTags([]string{strings.Repeat("a", 51)})
+	assert.Error(t, err)
+}
+
+func TestFilterByTags(t *testing.T) {
+	friends := models.FriendsList{
+		{ID: "1", Name: "John Wick", Tags: []string{"family", "work"}},
+		{ID: "2", Name: "Peter Parker", Tags: []string{"work"}},
+		{ID: "3", Name: "Bruce Wayne"},
+	}
+
+	assert.Equal(t, 2, len(models.FilterByTags(friends, []string{"Work"})))
+	assert.Equal(t, models.FriendsList{friends[0]}, models.FilterByTags(friends, []string{"work", "family"}))
+	assert.Equal(t, 0, len(models.FilterByTags(friends, []string{"climbing"})))
+}
+
+func TestFriendTags(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = models.AddFriend(db, models.Friend{Name: "John Wick", LastContacted: "2023-06-06", Tags: []string{"Work", "family"}})
+	assert.NoError(t, err)
+	_, err = models.AddFriend(db, models.Friend{Name: "Peter Parker", LastContacted: "2023-06-06", Tags: []string{"work"}})
+	assert.NoError(t, err)
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"family", "work"}, friends[0].Tags)
+	assert.Equal(t, []string{"work"}, friends[1].Tags)
+
+	tags, err := models.ListTags(db)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.TagCount{{Name: "family", Count: 1}, {Name: "work", Count: 2}}, tags)
+
+	// Updates without tags leave them as they are
+	friend := friends[1]
+	friend.Tags = nil
+	friend.Notes = "Likes spiders"
+	err = models.SqlUpdateFriend(db, friend.ID, &friend)
+	assert.NoError(t, err)
+
+	updated, err := models.SqlGetFriend(db, friend.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"work"}, updated.Tags)
+
+	// Friends in the trash aren't counted
+	err = models.DeleteFriend(db, friends[0])
+	assert.NoError(t, err)
+
+	tags, err = models.ListTags(db)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.TagCount{{Name: "work", Count: 1}}, tags)
+}
+
+func TestParseTagSchedules(t *testing.T) {
+	schedules, err := models.ParseTagSchedules("Family=0 7 * * 1; work=0 7 1 * *;")
+	assert.NoError(t, err)
+	assert.Equal(t, []models.TagSchedule{
+		{Tag: "family", Schedule: "0 7 * * 1"},
+		{Tag: "work", Schedule: "0 7 1 * *"},
+	}, schedules)
+
+	schedules, err = models.ParseTagSchedules("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(schedules))
+
+	_, err = models.ParseTagSchedules("family")
+	assert.Error(t, err)
+}
+
+func TestValidateContactMethod(t *testing.T) {
+	assert.NoError(t, models.ValidateContactMethod(models.ContactMethod{Type: models.ContactPhone, Value: "+44 (0)7700 900123"}))
+	assert.NoError(t, models.ValidateContactMethod(models.ContactMethod{Type: models.ContactDiscord, Value: "johnwick"}))
+	assert.Error(t, models.ValidateContactMethod(models.ContactMethod{Type: "pager", Value: "123"}))
+	assert.Error(t, models.ValidateContactMethod(models.ContactMethod{Type: models.ContactEmail, Value: "not an email"}))
+	assert.Error(t, models.ValidateContactMethod(models.ContactMethod{Type: models.ContactSignal, Value: "call me"}))
+	assert.Error(t, models.ValidateContactMethod(models.ContactMethod{Type: models.ContactAddress, Value: " "}))
+}
+
+func TestContactLink(t *testing.T) {
+	assert.Equal(t, "tel:+447700900123", models.ContactLink(models.ContactMethod{Type: models.ContactPhone, Value: "+44 7700 900123"}))
+	assert.Equal(t, "mailto:john@example.com", models.ContactLink(models.ContactMethod{Type: models.ContactEmail, Value: "john@example.com"}))
+	assert.Equal(t, "https://signal.me/#p/+447700900123", models.ContactLink(models.ContactMethod{Type: models.ContactSignal, Value: "+44 7700 900123"}))
+	assert.Equal(t, "https://wa.me/447700900123", models.ContactLink(models.ContactMethod{Type: models.ContactWhatsApp, Value: "+44 7700 900123"}))
+	assert.Equal(t, "https://discord.com/users/80351110224678912", models.ContactLink(models.ContactMethod{Type: models.ContactDiscord, Value: "80351110224678912"}))
+	assert.Equal(t, "", models.ContactLink(models.ContactMethod{Type: models.ContactDiscord, Value: "johnwick"}))
+	assert.Equal(t, "https://www.openstreetmap.org/search?query=1+Main+St", models.ContactLink(models.ContactMethod{Type: models.ContactAddress, Value: "1 Main St"}))
+}
+
+func TestContactMethods(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = models.AddFriend(db, models.Friend{Name: "John Wick", LastContacted: "2023-06-06"})
+	assert.NoError(t, err)
+
+	email, err := models.AddContactMethod(db, "1", models.ContactMethod{Type: models.ContactEmail, Value: "john@example.com", Preferred: true})
+	assert.NoError(t, err)
+	assert.True(t, email.Preferred)
+
+	// Only one method can be preferred
+	signal, err := models.AddContactMethod(db, "1", models.ContactMethod{Type: models.ContactSignal, Value: "+447700900123", Preferred: true})
+	assert.NoError(t, err)
+
+	methods, err := models.ListContactMethods(db, "1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(methods))
+	assert.Equal(t, signal, methods[0])
+	assert.False(t, methods[1].Preferred)
+
+	assert.Equal(t, "Signal: +447700900123 https://signal.me/#p/+447700900123 (preferred)\nEmail: john@example.com",
+		models.FormatContactMethods(methods))
+
+	_, err = models.UpdateContactMethod(db, "1", 99, models.ContactMethod{Type: models.ContactPhone, Value: "123"})
+	assert.ErrorIs(t, err, models.ErrContactMethodNotFound)
+
+	err = models.DeleteContactMethod(db, "1", signal.ID)
+	assert.NoError(t, err)
+
+	err = models.DeleteContactMethod(db, "1", signal.ID)
+	assert.ErrorIs(t, err, models.ErrContactMethodNotFound)
+}
+
+func TestCustomFields(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	assert.NoError(t, models.AddCustomField(db, models.CustomField{Name: "partner", Type: models.FieldTypeText}))
+	assert.NoError(t, models.AddCustomField(db, models.CustomField{Name: "anniversary", Type: models.FieldTypeDate}))
+	assert.NoError(t, models.AddCustomField(db, models.CustomField{Name: "kids", Type: models.FieldTypeNumber}))
+	assert.NoError(t, models.AddCustomField(db, models.CustomField{Name: "dietary", Type: models.FieldTypeList}))
+	assert.ErrorIs(t, models.AddCustomField(db, models.CustomField{Name: "kids", Type: models.FieldTypeText}), models.ErrCustomFieldExists)
+	assert.Error(t, models.AddCustomField(db, models.CustomField{Name: "Partner Name", Type: models.FieldTypeText}))
+	assert.Error(t, models.AddCustomField(db, models.CustomField{Name: "pets", Type: "boolean"}))
+
+	_, err = models.NormaliseFields(db, map[string]interface{}{"kids": "two"})
+	assert.Error(t, err)
+	_, err = models.NormaliseFields(db, map[string]interface{}{"anniversary": "June"})
+	assert.Error(t, err)
+	_, err = models.NormaliseFields(db, map[string]interface{}{"pets": "cat"})
+	assert.Error(t, err)
+
+	fields := map[string]interface{}{
+		"partner":     "Helen",
+		"anniversary": "2010-06-06",
+		"kids":        float64(2),
+		"dietary":     []interface{}{"vegetarian", "no nuts"},
+	}
+	_, err = models.AddFriend(db, models.Friend{Name: "John Wick", LastContacted: "2023-06-06", Fields: fields})
+	assert.NoError(t, err)
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"partner":     "Helen",
+		"anniversary": "2010-06-06",
+		"kids":        float64(2),
+		"dietary":     []string{"vegetarian", "no nuts"},
+	}, friends[0].Fields)
+
+	assert.Equal(t, 1, len(models.FilterByFields(friends, map[string]string{"dietary": "Vegetarian", "kids": "2"})))
+	assert.Equal(t, 0, len(models.FilterByFields(friends, map[string]string{"partner": "Ruth"})))
+
+	// Changes to custom fields are recorded in the audit log
+	friend := friends[0]
+	friend.Fields = map[string]interface{}{"partner": "Helen", "kids": float64(3)}
+	err = models.SqlUpdateFriend(db, friend.ID, &friend)
+	assert.NoError(t, err)
+
+	entries, err := models.GetAuditLog(db, models.AuditFilter{Action: models.AuditActionUpdate})
+	assert.NoError(t, err)
+	assert.Equal(t, models.FieldChange{Before: "2", After: "3"}, entries[0].Changes["Fields.kids"])
+	assert.Equal(t, models.FieldChange{Before: "vegetarian, no nuts", After: ""}, entries[0].Changes["Fields.dietary"])
+
+	err = models.DeleteCustomField(db, "partner")
+	assert.NoError(t, err)
+	assert.ErrorIs(t, models.DeleteCustomField(db, "partner"), models.ErrCustomFieldNotFound)
+
+	updated, err := models.SqlGetFriend(db, friend.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]interface{}{"kids": float64(3)}, updated.Fields)
+}
+
+func TestRenderReminder(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	friend := models.Friend{
+		Name:          "John Wick",
+		LastContacted: "2023-06-06",
+		Notes:         "Nice guy",
+		Fields:        map[string]interface{}{"partner": "Helen"},
+	}
+	methods := []models.ContactMethod{{Type: models.ContactEmail, Value: "john@example.com", Link: "mailto:john@example.com"}}
+
+	os.Setenv("NOTIFICATION_TEMPLATE", "")
+	assert.Equal(t, "You should get in touch with John Wick. You haven't spoken to them since 2023-06-06. "+
+		"Here's what you've got written down for them: Nice guy\nYou can reach them on:\nEmail: john@example.com",
+		models.RenderReminder(friend, methods, nil))
+
+	os.Setenv("NOTIFICATION_TEMPLATE", `Call {{.Name}} and ask how {{field . "partner"}} is{{with field . "kids"}} and the {{.}} kids{{end}}`)
+	defer os.Unsetenv("NOTIFICATION_TEMPLATE")
+	assert.Equal(t, "Call John Wick and ask how Helen is", models.RenderReminder(friend, nil, nil))
+
+	assert.Error(t, models.ValidateReminderTemplate("{{.Name"))
+
+	os.Unsetenv("NOTIFICATION_TEMPLATE")
+	meetUp := models.FriendsList{{Name: "Peter Parker"}, {Name: "Bruce Wayne"}}
+	assert.Equal(t, "You should get in touch with John Wick. You haven't spoken to them since 2023-06-06. "+
+		"\nYou could catch up with John Wick, Peter Parker and Bruce Wayne together.",
+		models.RenderReminder(models.Friend{Name: "John Wick", LastContacted: "2023-06-06"}, nil, meetUp))
+}
+
+func TestRelationships(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	friends := models.FriendsList{
+		{ID: "1", Name: "John Wick", LastContacted: "2023-06-06"},
+		{ID: "2", Name: "Helen Wick", LastContacted: "2023-06-06"},
+		{ID: "3", Name: "Winston", LastContacted: time.Now().Format("2006-01-02")},
+	}
+
+	partner, err := models.AddRelationship(db, models.Relationship{FriendID: "1", RelatedID: "2", Type: models.RelationshipPartner})
+	assert.NoError(t, err)
+	_, err = models.AddRelationship(db, models.Relationship{FriendID: "2", RelatedID: "1", Type: models.RelationshipPartner})
+	assert.ErrorIs(t, err, models.ErrRelationshipExists)
+	_, err = models.AddRelationship(db, models.Relationship{FriendID: "1", RelatedID: "1", Type: models.RelationshipGroup})
+	assert.Error(t, err)
+	_, err = models.AddRelationship(db, models.Relationship{FriendID: "1", RelatedID: "2", Type: "enemy"})
+	assert.Error(t, err)
+	_, err = models.AddRelationship(db, models.Relationship{FriendID: "3", RelatedID: "1", Type: models.RelationshipGroup, Label: "The Continental"})
+	assert.NoError(t, err)
+
+	// Relationships work both ways
+	relationships, err := models.ListRelationships(db, "2")
+	assert.NoError(t, err)
+	assert.Equal(t, []models.Relationship{{ID: partner.ID, FriendID: "2", RelatedID: "1", Type: models.RelationshipPartner}}, relationships)
+
+	related, err := models.RelatedFriends(db, "1", friends)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(related))
+	assert.Equal(t, "Helen Wick", related[0].Friend.Name)
+	assert.Equal(t, "The Continental", related[1].Relationship.Label)
+
+	// Only friends that haven't been contacted recently are suggested for a meet-up
+	overdue, err := models.OverdueRelatedFriends(db, "1", friends, time.Now().AddDate(0, 0, -30))
+	assert.NoError(t, err)
+	assert.Equal(t, models.FriendsList{friends[1]}, overdue)
+
+	assert.NoError(t, models.DeleteRelationship(db, "2", partner.ID))
+	assert.ErrorIs(t, models.DeleteRelationship(db, "2", partner.ID), models.ErrRelationshipNotFound)
+}
+
+func TestGiftIdeas(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	lego, err := models.AddGiftIdea(db, "1", models.GiftIdea{Idea: "Lego Millennium Falcon", Price: 149.99, Link: "https://example.com/lego"})
+	assert.NoError(t, err)
+	assert.Equal(t, models.GiftStatusIdea, lego.Status)
+
+	_, err = models.AddGiftIdea(db, "1", models.GiftIdea{Idea: "Socks", Status: "wrapped"})
+	assert.Error(t, err)
+	_, err = models.AddGiftIdea(db, "1", models.GiftIdea{Idea: "Socks", YearGiven: 2020})
+	assert.Error(t, err)
+	_, err = models.AddGiftIdea(db, "1", models.GiftIdea{Idea: "Socks", Link: "not a link"})
+	assert.Error(t, err)
+
+	book, err := models.AddGiftIdea(db, "1", models.GiftIdea{Idea: "Book", Status: models.GiftStatusBought})
+	assert.NoError(t, err)
+
+	outstanding, err := models.OutstandingGiftIdeas(db)
+	assert.NoError(t, err)
+	assert.Equal(t, "Lego Millennium Falcon (149.99) https://example.com/lego, Book [already bought]", models.FormatGiftIdeas(outstanding["1"]))
+
+	// Once a gift has been given it drops off the list and can't be given again
+	book.Status = models.GiftStatusGiven
+	book, err = models.UpdateGiftIdea(db, "1", book.ID, book)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Now().Year(), book.YearGiven)
+
+	_, err = models.AddGiftIdea(db, "1", models.GiftIdea{Idea: "book"})
+	assert.ErrorIs(t, err, models.ErrGiftAlreadyGiven)
+
+	// Gift ideas for another friend aren't affected
+	_, err = models.AddGiftIdea(db, "2", models.GiftIdea{Idea: "Book"})
+	assert.NoError(t, err)
+
+	outstanding, err = models.OutstandingGiftIdeas(db)
+	assert.NoError(t, err)
+	assert.Equal(t, []models.GiftIdea{lego}, outstanding["1"])
+
+	mockTodaysDate := time.Date(2020, time.February, 23, 0, 0, 0, 0, time.UTC)
+	result := models.CheckBirthdays(mockFriendsList, mockTodaysDate, outstanding)
+	assert.Equal(t, 1, len(result))
+
+	assert.NoError(t, models.DeleteGiftIdea(db, "1", lego.ID))
+	assert.ErrorIs(t, models.DeleteGiftIdea(db, "1", lego.ID), models.ErrGiftIdeaNotFound)
+}
+
+func TestMakeThumbnail(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 1024, 512))
+	for x := 0; x < 1024; x++ {
+		for y := 0; y < 512; y++ {
+			img.Set(x, y, color.RGBA{R: 200, G: 100, B: 50, A: 255})
+		}
+	}
+
+	thumb := models.MakeThumbnail(img, 256)
+	assert.Equal(t, image.Rect(0, 0, 256, 128), thumb.Bounds())
+	assert.Equal(t, color.RGBA{R: 200, G: 100, B: 50, A: 255}, thumb.At(100, 100))
+
+	// Images that already fit aren't changed
+	small := image.NewRGBA(image.Rect(0, 0, 100, 200))
+	assert.Equal(t, image.Image(small), models.MakeThumbnail(small, 256))
+}
+
+func TestPhotos(t *testing.T) {
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	var photo bytes.Buffer
+	err = png.Encode(&photo, image.NewRGBA(image.Rect(0, 0, 600, 300)))
+	assert.NoError(t, err)
+
+	err = models.SavePhoto(db, "1", photo.Bytes())
+	assert.NoError(t, err)
+
+	saved, err := models.GetPhoto(db, "1", false)
+	assert.NoError(t, err)
+	assert.Equal(t, models.Photo{ContentType: "image/png", Data: photo.Bytes()}, saved)
+
+	thumbnail, err := models.GetPhoto(db, "1", true)
+	assert.NoError(t, err)
+	config, err := png.DecodeConfig(bytes.NewReader(thumbnail.Data))
+	assert.NoError(t, err)
+	assert.Equal(t, 256, config.Width)
+	assert.Equal(t, 128, config.Height)
+
+	err = models.SavePhoto(db, "1", []byte("GIF89a not really a gif"))
+	assert.ErrorIs(t, err, models.ErrUnsupportedPhoto)
+
+	assert.NoError(t, models.DeletePhoto(db, "1"))
+	_, err = models.GetPhoto(db, "1", false)
+	assert.ErrorIs(t, err, models.ErrPhotoNotFound)
+}
+
+func TestSearchFriends(t *testing.T) {
+	friends := models.FriendsList{
+		{ID: "1", Name: "Steve Carell", Notes: "Works in an office"},
+		{ID: "2", Name: "Office Manager", Tags: []string{"work"}},
+		{ID: "3", Name: "Jonathan Smith", Tags: []string{"book club"}, Fields: map[string]interface{}{"partner": "Sam"}},
+	}
+
+	results, err := models.SearchFriends(friends, "ste")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "Steve Carell", results[0].Friend.Name)
+	assert.False(t, results[0].Fuzzy)
+
+	// Names count for more than notes
+	results, err = models.SearchFriends(friends, "office")
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+	assert.Equal(t, "Office Manager", results[0].Friend.Name)
+	assert.Equal(t, "Steve Carell", results[1].Friend.Name)
+	assert.Greater(t, results[0].Score, results[1].Score)
+
+	// Every word has to match
+	results, err = models.SearchFriends(friends, "club sam")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "3", results[0].Friend.ID)
+
+	results, err = models.SearchFriends(friends, "club steve")
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	results, err = models.SearchFriends(friends, "Carrell")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "Steve Carell", results[0].Friend.Name)
+	assert.True(t, results[0].Fuzzy)
+
+	// Short words have to be spelt right
+	results, err = models.SearchFriends(friends, "stv")
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+
+	_, err = models.SearchFriends(friends, " ?! ")
+	assert.ErrorIs(t, err, models.ErrBlankSearch)
+}
+
+func TestSearchIndex(t *testing.T) {
+	index, err := models.NewSearchIndex()
+	assert.NoError(t, err)
+	defer index.Close()
+
+	friends := models.FriendsList{
+		{ID: "1", Name: "Steve Carell", Notes: "Works in an office"},
+		{ID: "2", Name: "Office Manager", Tags: []string{"work"}},
+	}
+	assert.NoError(t, index.Sync(friends))
+
+	results, err := index.Search(friends, "office")
+	assert.NoError(t, err)
+	assert.Len(t, results, 2)
+
+	// Only the friends that changed are indexed again, but the results always match the friends searched
+	friends = models.FriendsList{
+		{ID: "1", Name: "Steve Carell", Notes: "Moved to a farm"},
+		{ID: "3", Name: "Jim Halpert", Notes: "Still in the office"},
+	}
+	results, err = index.Search(friends, "office")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "Jim Halpert", results[0].Friend.Name)
+
+	results, err = index.Search(friends, "farm")
+	assert.NoError(t, err)
+	assert.Len(t, results, 1)
+	assert.Equal(t, "1", results[0].Friend.ID)
+
+	_, err = index.Search(friends, " ?! ")
+	assert.ErrorIs(t, err, models.ErrBlankSearch)
+}
+
+func TestQueryFriends(t *testing.T) {
+	today := time.Date(2024, 3, 10, 0, 0, 0, 0, time.UTC)
+	friends := models.FriendsList{
+		{ID: "1", Name: "steve", LastContacted: "2024-03-01", Birthday: "1990-03-12"},
+		{ID: "2", Name: "Alice", LastContacted: "2023-12-25", Tags: []string{"work"}},
+		{ID: "10", Name: "Bob", Birthday: "1988-02-29"},
+		{ID: "4", Name: "carol", LastContacted: "2024-01-15", Birthday: "1995-03-10", Tags: []string{"work"}},
+	}
+
+	names := func(page models.FriendsPage) []string {
+		return models.ListFriendsNames(page.Friends)
+	}
+
+	page, err := models.QueryFriends(friends, models.FriendsQuery{}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"steve", "Alice", "carol", "Bob"}, names(page))
+	assert.Equal(t, 4, page.Total)
+	assert.Empty(t, page.NextCursor)
+
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "name"}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Alice", "Bob", "carol", "steve"}, names(page))
+
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "-name"}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"steve", "carol", "Bob", "Alice"}, names(page))
+
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "overdue"}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bob", "Alice", "carol", "steve"}, names(page))
+
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "birthday"}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"carol", "steve", "Bob", "Alice"}, names(page))
+
+	// Friends without a date stay last when the order is reversed
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "-birthday"}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bob", "steve", "carol", "Alice"}, names(page))
+
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "lastContacted"}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Alice", "carol", "steve", "Bob"}, names(page))
+
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "-lastContacted", Limit: 3}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"steve", "carol", "Alice"}, names(page))
+
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "-lastContacted", Cursor: page.NextCursor}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Bob"}, names(page))
+
+	before := "2024-02-01"
+	page, err = models.QueryFriends(friends, models.FriendsQuery{ContactedBefore: before, Tags: []string{"work"}}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Alice", "carol"}, names(page))
+
+	hasBirthday := false
+	page, err = models.QueryFriends(friends, models.FriendsQuery{HasBirthday: &hasBirthday}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Alice"}, names(page))
+
+	// Page through two at a time
+	page, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "name", Limit: 2}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"Alice", "Bob"}, names(page))
+	assert.Equal(t, 4, page.Total)
+	assert.NotEmpty(t, page.NextCursor)
+
+	// Friends added before the cursor don't shift the next page
+	withAaron := append(models.FriendsList{{ID: "11", Name: "Aaron"}}, friends...)
+	page, err = models.QueryFriends(withAaron, models.FriendsQuery{Sort: "name", Limit: 2, Cursor: page.NextCursor}, today)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"carol", "steve"}, names(page))
+	assert.Empty(t, page.NextCursor)
+
+	_, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "-name", Cursor: page.NextCursor + "x"}, today)
+	assert.ErrorIs(t, err, models.ErrInvalidCursor)
+
+	_, err = models.QueryFriends(friends, models.FriendsQuery{Sort: "age"}, today)
+	assert.Error(t, err)
+
+	_, err = models.QueryFriends(friends, models.FriendsQuery{ContactedBefore: "yesterday"}, today)
+	assert.Error(t, err)
+}
+
+func TestDaysUntilBirthday(t *testing.T) {
+	today := time.Date(2023, 3, 10, 0, 0, 0, 0, time.UTC)
+	assert.Equal(t, 0, models.DaysUntilBirthday("1995-03-10", today))
+	assert.Equal(t, 2, models.DaysUntilBirthday("1990-03-12", today))
+	assert.Equal(t, 365, models.DaysUntilBirthday("1990-03-09", today))
+	assert.Equal(t, 356, models.DaysUntilBirthday("1988-02-29", today))
+	// The 29th of February falls on the 1st of March in other years
+	assert.Equal(t, 9, models.DaysUntilBirthday("1988-02-29", time.Date(2023, 2, 20, 0, 0, 0, 0, time.UTC)))
+	assert.Equal(t, math.MaxInt32, models.DaysUntilBirthday("", today))
+}
+
+func TestSlugify(t *testing.T) {
+	assert.Equal(t, "steve-carell", models.Slugify("Steve Carell"))
+	assert.Equal(t, "zoe-o-brien", models.Slugify("  Zoë O'Brien! "))
+	assert.Equal(t, "jurgen-strasse", models.Slugify("Jürgen Straße"))
+	assert.Equal(t, "lukasz-sorensen", models.Slugify("Łukasz Sørensen"))
+	assert.Equal(t, "friend-42", models.Slugify("42"))
+	assert.Equal(t, "friend", models.Slugify("王伟"))
+
+	assert.NoError(t, models.ValidateSlug("sam-smith-2"))
+	assert.Error(t, models.ValidateSlug("Sam-Smith"))
+	assert.Error(t, models.ValidateSlug("sam--smith"))
+	assert.Error(t, models.ValidateSlug("-sam"))
+	assert.Error(t, models.ValidateSlug("123"))
+}
+
+func TestFriendSlugs(t *testing.T) {
+	os.Setenv("TEST_ENV", "true")
+	logger.SetupLogger()
+
+	db, err := setupTestDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	_, err = models.AddFriend(db, models.Friend{Name: "Sam Smith"})
+	assert.NoError(t, err)
+	_, err = models.AddFriend(db, models.Friend{Name: "Sam Smith"})
+	assert.NoError(t, err)
+	_, err = models.AddFriend(db, models.Friend{Name: "Sám Smíth"})
+	assert.NoError(t, err)
+
+	friends, err := models.BuildFriendsList(db)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"sam-smith", "sam-smith-2", "sam-smith-3"}, []string{friends[0].Slug, friends[1].Slug, friends[2].Slug})
+
+	friend, err := models.GetFriendByID("sam-smith-2", friends)
+	assert.NoError(t, err)
+	assert.Equal(t, friends[1].ID, friend.ID)
+
+	friend, err = models.GetFriendByName("sam-smith-3", friends)
+	assert.NoError(t, err)
+	assert.Equal(t, "Sám Smíth", friend.Name)
+
+	// Renaming a friend keeps their slug, but it can be changed
+	renamed := friends[0]
+	renamed.Name = "Samantha Smith"
+	assert.NoError(t, models.SqlUpdateFriend(db, renamed.ID, &renamed))
+	updated, err := models.SqlGetFriend(db, renamed.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "sam-smith", updated.Slug)
+
+	renamed.Slug = "samantha"
+	assert.NoError(t, models.SqlUpdateFriend(db, renamed.ID, &renamed))
+	updated, err = models.SqlGetFriend(db, renamed.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "samantha", updated.Slug)
+
+	renamed.Slug = "sam-smith-2"
+	assert.ErrorIs(t, models.SqlUpdateFriend(db, renamed.ID, &renamed), models.ErrSlugTaken)
+
+	_, err = models.AddFriend(db, models.Friend{Name: "Sam", Slug: "samantha"})
+	assert.ErrorIs(t, err, models.ErrSlugTaken)
+
+	id, err := models.ResolveFriendID(db, "samantha")
+	assert.NoError(t, err)
+	assert.Equal(t, renamed.ID, id)
+}
+
+func TestMergePatch(t *testing.T) {
+	// The examples from RFC 7396
+	tests := []struct {
+		target string
+		patch  string
+		result string
+	}{
+		{`{"a":"b"}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":"b"}`, `{"b":"c"}`, `{"a":"b","b":"c"}`},
+		{`{"a":"b"}`, `{"a":null}`, `{}`},
+		{`{"a":"b","b":"c"}`, `{"a":null}`, `{"b":"c"}`},
+		{`{"a":["b"]}`, `{"a":"c"}`, `{"a":"c"}`},
+		{`{"a":{"b":"c"}}`, `{"a":{"b":"d","c":null}}`, `{"a":{"b":"d"}}`},
+		{`{"a":[{"b":"c"}]}`, `{"a":[1]}`, `{"a":[1]}`},
+		{`["a","b"]`, `["c","d"]`, `["c","d"]`},
+		{`{"e":null}`, `{"a":1}`, `{"a":1,"e":null}`},
+		{`[1,2]`, `{"a":"b","c":null}`, `{"a":"b"}`},
+	}
+	for _, test := range tests {
+		var target, patch, result interface{}
+		assert.NoError(t, json.Unmarshal([]byte(test.target), &target))
+		assert.NoError(t, json.Unmarshal([]byte(test.patch), &patch))
+		assert.NoError(t, json.Unmarshal([]byte(test.result), &result))
+		assert.Equal(t, result, models.MergePatch(target, patch), test.patch)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tests := []struct {
+		document string
+		patch    string
+		result   string
+	}{
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz","value":"qux"}]`, `{"foo":"bar","baz":"qux"}`},
+		{`{"foo":["bar","baz"]}`, `[{"op":"add","path":"/foo/1","value":"qux"}]`, `{"foo":["bar","qux","baz"]}`},
+		{`{"foo":["bar"]}`, `[{"op":"add","path":"/foo/-","value":"baz"}]`, `{"foo":["bar","baz"]}`},
+		{`{"foo":["bar","qux","baz"]}`, `[{"op":"remove","path":"/foo/1"}]`, `{"foo":["bar","baz"]}`},
+		{`{"baz":"qux","foo":"bar"}`, `[{"op":"replace","path":"/baz","value":"boo"}]`, `{"baz":"boo","foo":"bar"}`},
+		{`{"foo":{"bar":"baz","waldo":"fred"},"qux":{"corge":"grault"}}`, `[{"op":"move","from":"/foo/waldo","path":"/qux/thud"}]`, `{"foo":{"bar":"baz"},"qux":{"corge":"grault","thud":"fred"}}`},
+		{`{"foo":["all","grass","cows","eat"]}`, `[{"op":"move","from":"/foo/1","path":"/foo/3"}]`, `{"foo":["all","cows","eat","grass"]}`},
+		{`{"foo":{"bar":1}}`, `[{"op":"copy","from":"/foo","path":"/baz"},{"op":"replace","path":"/baz/bar","value":2}]`, `{"foo":{"bar":1},"baz":{"bar":2}}`},
+		{`{"a/b":1,"m~n":2}`, `[{"op":"test","path":"/a~1b","value":1},{"op":"remove","path":"/m~0n"}]`, `{"a/b":1}`},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/foo","value":null}]`, `{"foo":null}`},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+	}
+	for _, test := range tests {
+		var document, result interface{}
+		var patch []models.PatchOperation
+		assert.NoError(t, json.Unmarshal([]byte(test.document), &document))
+		assert.NoError(t, json.Unmarshal([]byte(test.patch), &patch))
+		assert.NoError(t, json.Unmarshal([]byte(test.result), &result))
+
+		patched, err := models.ApplyJSONPatch(document, patch)
+		assert.NoError(t, err, test.patch)
+		assert.Equal(t, result, patched, test.patch)
+	}
+
+	failures := []struct {
+		document string
+		patch    string
+		err      error
+	}{
+		{`{"foo":"bar"}`, `[{"op":"test","path":"/foo","value":"baz"}]`, models.ErrPatchTestFailed},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"/baz"}]`, &models.ValidationError{}},
+		{`{"foo":"bar"}`, `[{"op":"replace","path":"/baz","value":1}]`, &models.ValidationError{}},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz/bat","value":1}]`, &models.ValidationError{}},
+		{`{"foo":[1]}`, `[{"op":"add","path":"/foo/2","value":1}]`, &models.ValidationError{}},
+		{`{"foo":[1]}`, `[{"op":"remove","path":"/foo/01"}]`, &models.ValidationError{}},
+		{`{"foo":{"bar":1}}`, `[{"op":"move","from":"/foo","path":"/foo/bar/baz"}]`, &models.ValidationError{}},
+		{`{"foo":"bar"}`, `[{"op":"add","path":"/baz"}]`, &models.ValidationError{}},
+		{`{"foo":"bar"}`, `[{"op":"delete","path":"/foo"}]`, &models.ValidationError{}},
+		{`{"foo":"bar"}`, `[{"op":"remove","path":"foo"}]`, &models.ValidationError{}},
+	}
+	for _, test := range failures {
+		var document interface{}
+		var patch []models.PatchOperation
+		assert.NoError(t, json.Unmarshal([]byte(test.document), &document))
+		assert.NoError(t, json.Unmarshal([]byte(test.patch), &patch))
+
+		_, err := models.ApplyJSONPatch(document, patch)
+		if validationErr, ok := test.err.(*models.ValidationError); ok {
+			assert.ErrorAs(t, err, &validationErr, test.patch)
+		} else {
+			assert.ErrorIs(t, err, test.err, test.patch)
+		}
+	}
+}
+
+func TestPatchFriend(t *testing.T) {
+	friend := models.Friend{ID: "1", Name: "John Wick", Birthday: "1964-09-02", Notes: "Likes dogs", Tags: []string{"work"}}
+
+	patched, err := models.PatchFriend(friend, models.MergePatchContentType, []byte(`{"Notes": null, "Birthday": null, "Tags": ["family", "work"]}`))
+	assert.NoError(t, err)
+	assert.Equal(t, models.Friend{ID: "1", Name: "John Wick", Tags: []string{"family", "work"}}, patched)
+
+	patched, err = models.PatchFriend(friend, models.JSONPatchContentType, []byte(`[{"op": "test", "path": "/Notes", "value": "Likes dogs"}, {"op": "add", "path": "/Tags/-", "value": "gym"}, {"op": "remove", "path": "/Birthday"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, models.Friend{ID: "1", Name: "John Wick", Notes: "Likes dogs", Tags: []string{"work", "gym"}}, patched)
+
+	// Friends without tags or custom fields can still have them added
+	patched, err = models.PatchFriend(models.Friend{ID: "1", Name: "John Wick"}, models.JSONPatchContentType, []byte(`[{"op": "add", "path": "/Tags/-", "value": "gym"}, {"op": "add", "path": "/Fields/partner", "value": "Helen"}]`))
+	assert.NoError(t, err)
+	assert.Equal(t, models.Friend{ID: "1", Name: "John Wick", Tags: []string{"gym"}, Fields: map[string]interface{}{"partner": "Helen"}}, patched)
+
+	_, err = models.PatchFriend(friend, models.MergePatchContentType, []byte(`{"ID": "2"}`))
+	var validationErr *models.ValidationError
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "ID", validationErr.Field)
+
+	_, err = models.PatchFriend(friend, models.MergePatchContentType, []byte(`{"Tags": "work"}`))
+	assert.ErrorAs(t, err, &validationErr)
+	assert.Equal(t, "Tags", validationErr.Field)
+
+	_, err = models.PatchFriend(friend, models.MergePatchContentType, []byte(`{"Notes": `))
+	assert.ErrorIs(t, err, models.ErrMalformedPatch)
+
+	_, err = models.PatchFriend(friend, "text/plain", []byte(`Notes=none`))
+	assert.ErrorIs(t, err, models.ErrUnsupportedPatch)
+}
+
 func containsFriend(friends models.FriendsList, friend models.Friend) bool {
 	for _, f := range friends {
 		if reflect.DeepEqual(f, friend) {
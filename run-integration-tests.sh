@@ -34,4 +34,4 @@ else
     echo "INFO: Skipping image build"
 fi
 
-go test -v ./pkg/test/integration_test
+go test -v -tags sqlite_fts5 ./pkg/test/integration_test